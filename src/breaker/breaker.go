@@ -0,0 +1,191 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package breaker is a circuit breaker shared by qmail-remote processes.
+// After Failures consecutive connect or greeting failures a remote address
+// is marked down for Backoff : deliveries skip it instead of waiting for
+// the connect timeout. Then a single process probes it, a success closes
+// the circuit, a failure keeps it open for another Backoff.
+//
+// The state is a file per address in Dir, "failures downUntil" (unix
+// time), updated under flock.
+package breaker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Breaker is the shared state of remote addresses
+type Breaker struct {
+	Dir      string
+	Failures int           // consecutive failures marking an address down
+	Backoff  time.Duration // time an address is skipped
+	now      func() time.Time
+}
+
+// New returns a Breaker keeping its state in dir
+func New(dir string, failures int, backoff time.Duration) *Breaker {
+	return &Breaker{Dir: dir, Failures: failures, Backoff: backoff, now: time.Now}
+}
+
+// state is the state of an address
+type state struct {
+	failures  int
+	downUntil time.Time
+}
+
+// path returns the state file of addr (ip:port)
+func (b *Breaker) path(addr string) string {
+	return filepath.Join(b.Dir, strings.Replace(addr, "/", "_", -1))
+}
+
+func parse(content []byte) state {
+	var s state
+	var until int64
+	fmt.Sscan(string(content), &s.failures, &until)
+	if until > 0 {
+		s.downUntil = time.Unix(until, 0)
+	}
+	return s
+}
+
+// lock opens and locks the state file of addr, it is created if create
+// is true. A file removed while waiting for the lock is opened again.
+func (b *Breaker) lock(addr string, create bool) (*os.File, error) {
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	for {
+		file, err := os.OpenFile(b.path(addr), flags, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			file.Close()
+			return nil, err
+		}
+		fi, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		cur, err := os.Stat(b.path(addr))
+		if err == nil && os.SameFile(fi, cur) {
+			return file, nil
+		}
+		file.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+// update changes the state of addr under lock, the file is created if
+// create is true. f returns false to leave the state unchanged. The file
+// of a closed circuit (zero state) is removed.
+func (b *Breaker) update(addr string, create bool, f func(s *state) bool) error {
+	file, err := b.lock(addr, create)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	s := parse(content)
+	if !f(&s) {
+		return nil
+	}
+	if s == (state{}) {
+		return os.Remove(b.path(addr))
+	}
+	var until int64
+	if !s.downUntil.IsZero() {
+		until = s.downUntil.Unix()
+	}
+	if err = file.Truncate(0); err == nil {
+		_, err = file.WriteAt([]byte(fmt.Sprintf("%d %d\n", s.failures, until)), 0)
+	}
+	return err
+}
+
+// Allow tells if addr may be dialed. Once its back-off is over the first
+// caller gets the probe, the others keep skipping it. A state which can't
+// be read allows everything.
+func (b *Breaker) Allow(addr string) bool {
+	content, err := ioutil.ReadFile(b.path(addr))
+	if err != nil {
+		return true
+	}
+	s := parse(content)
+	now := b.now()
+	if s.failures < b.Failures {
+		return true
+	}
+	if now.Before(s.downUntil) {
+		return false
+	}
+	probe := false
+	err = b.update(addr, false, func(s *state) bool {
+		if s.failures < b.Failures {
+			// closed meanwhile
+			probe = true
+			return false
+		}
+		if now.Before(s.downUntil) {
+			return false
+		}
+		probe = true
+		s.downUntil = now.Add(b.Backoff)
+		return true
+	})
+	return probe || err != nil
+}
+
+// Success records a connection to addr, its circuit is closed
+func (b *Breaker) Success(addr string) error {
+	err := b.update(addr, false, func(s *state) bool {
+		*s = state{}
+		return true
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Failure records a connect or greeting failure of addr
+func (b *Breaker) Failure(addr string) error {
+	now := b.now()
+	return b.update(addr, true, func(s *state) bool {
+		s.failures++
+		// a failed probe has already set the next back-off
+		if s.failures >= b.Failures && !now.Before(s.downUntil) {
+			s.downUntil = now.Add(b.Backoff)
+		}
+		return true
+	})
+}
@@ -0,0 +1,84 @@
+package breaker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breaker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	b := New(dir, 3, time.Minute)
+	now := time.Unix(1400000000, 0)
+	b.now = func() time.Time { return now }
+	const addr = "192.0.2.1:25"
+
+	for i := 0; i < 2; i++ {
+		if err = b.Failure(addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !b.Allow(addr) {
+		t.Fatalf("down after 2 failures")
+	}
+	b.Failure(addr)
+	if b.Allow(addr) {
+		t.Fatalf("up after 3 failures")
+	}
+	if !b.Allow("192.0.2.2:25") {
+		t.Errorf("other address down")
+	}
+
+	// a single probe after the back-off
+	now = now.Add(time.Minute)
+	if !b.Allow(addr) {
+		t.Fatalf("no probe after back-off")
+	}
+	if b.Allow(addr) {
+		t.Errorf("second probe")
+	}
+	// failed probe : down for another back-off
+	now = now.Add(time.Second)
+	b.Failure(addr)
+	if now = now.Add(58 * time.Second); b.Allow(addr) {
+		t.Errorf("up before the end of the back-off")
+	}
+	now = now.Add(time.Second)
+	if !b.Allow(addr) {
+		t.Fatalf("no probe after back-off")
+	}
+	if err = b.Success(addr); err != nil {
+		t.Fatal(err)
+	}
+	if !b.Allow(addr) || !b.Allow(addr) {
+		t.Errorf("down after success")
+	}
+	if err = b.Success(addr); err != nil {
+		t.Errorf("got %v", err)
+	}
+
+	// Success waits for the lock of a concurrent update
+	b.Failure(addr)
+	file, err := b.lock(addr, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- b.Success(addr) }()
+	time.Sleep(50 * time.Millisecond)
+	if _, err = os.Stat(b.path(addr)); err != nil {
+		t.Errorf("state removed under lock: %v", err)
+	}
+	file.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(b.path(addr)); !os.IsNotExist(err) {
+		t.Errorf("state not removed: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package cdb reads and writes constant databases (http://cr.yp.to/cdb.html),
+// as used by qmail for morercpthosts.cdb and users/cdb
+package cdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+const headerSize = 256 * 8
+
+// ErrFormat is returned for a corrupted database
+var ErrFormat = errors.New("cdb: bad format")
+
+func hash(key []byte) uint32 {
+	h := uint32(5381)
+	for _, c := range key {
+		h = (h<<5 + h) ^ uint32(c)
+	}
+	return h
+}
+
+// CDB is an open database
+type CDB struct {
+	r      io.ReaderAt
+	f      *os.File // nil if not opened by Open
+	header [256][2]uint32
+}
+
+// Open opens the database file
+func Open(file string) (*CDB, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	c, err := New(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	c.f = f
+	return c, nil
+}
+
+// New returns a database reading r
+func New(r io.ReaderAt) (*CDB, error) {
+	c := &CDB{r: r}
+	buf := make([]byte, headerSize)
+	if _, err := r.ReadAt(buf, 0); err != nil {
+		return nil, ErrFormat
+	}
+	for i := range c.header {
+		c.header[i][0] = binary.LittleEndian.Uint32(buf[i*8:])
+		c.header[i][1] = binary.LittleEndian.Uint32(buf[i*8+4:])
+	}
+	return c, nil
+}
+
+// Close closes the file opened by Open
+func (c *CDB) Close() error {
+	if c.f == nil {
+		return nil
+	}
+	return c.f.Close()
+}
+
+func (c *CDB) readPair(pos uint32) (a, b uint32, err error) {
+	var buf [8]byte
+	if _, err = c.r.ReadAt(buf[:], int64(pos)); err != nil {
+		return 0, 0, ErrFormat
+	}
+	return binary.LittleEndian.Uint32(buf[:]), binary.LittleEndian.Uint32(buf[4:]), nil
+}
+
+// Get returns the data of the first record of key, nil if there is none
+func (c *CDB) Get(key []byte) ([]byte, error) {
+	h := hash(key)
+	pos, slots := c.header[h%256][0], c.header[h%256][1]
+	if slots == 0 {
+		return nil, nil
+	}
+	slot := (h >> 8) % slots
+	for i := uint32(0); i < slots; i++ {
+		hh, rpos, err := c.readPair(pos + slot*8)
+		if err != nil {
+			return nil, err
+		}
+		if rpos == 0 {
+			return nil, nil
+		}
+		if hh == h {
+			klen, dlen, err := c.readPair(rpos)
+			if err != nil {
+				return nil, err
+			}
+			if int(klen) == len(key) {
+				buf := make([]byte, klen+dlen)
+				if _, err = c.r.ReadAt(buf, int64(rpos)+8); err != nil {
+					return nil, ErrFormat
+				}
+				if bytes.Equal(buf[:klen], key) {
+					return buf[klen:], nil
+				}
+			}
+		}
+		slot = (slot + 1) % slots
+	}
+	return nil, nil
+}
+
+// Has tells if there is a record for key
+func (c *CDB) Has(key []byte) (bool, error) {
+	data, err := c.Get(key)
+	return data != nil, err
+}
+
+// Writer writes a database
+type Writer struct {
+	w       *bufio.Writer
+	ws      io.WriteSeeker
+	pos     uint32
+	entries [256][][2]uint32 // hash, position
+}
+
+// NewWriter returns a Writer on ws, which must be empty
+func NewWriter(ws io.WriteSeeker) (*Writer, error) {
+	if _, err := ws.Seek(headerSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return &Writer{w: bufio.NewWriter(ws), ws: ws, pos: headerSize}, nil
+}
+
+func (w *Writer) writePair(a, b uint32) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:], a)
+	binary.LittleEndian.PutUint32(buf[4:], b)
+	w.w.Write(buf[:])
+}
+
+// Put adds a record
+func (w *Writer) Put(key, data []byte) error {
+	h := hash(key)
+	w.entries[h%256] = append(w.entries[h%256], [2]uint32{h, w.pos})
+	w.writePair(uint32(len(key)), uint32(len(data)))
+	w.w.Write(key)
+	if _, err := w.w.Write(data); err != nil {
+		return err
+	}
+	w.pos += 8 + uint32(len(key)) + uint32(len(data))
+	return nil
+}
+
+// Close writes the hash tables and the header
+func (w *Writer) Close() error {
+	var header [256][2]uint32
+	for i, entries := range w.entries {
+		slots := uint32(len(entries) * 2)
+		header[i] = [2]uint32{w.pos, slots}
+		table := make([][2]uint32, slots)
+		for _, e := range entries {
+			slot := (e[0] >> 8) % slots
+			for table[slot][1] != 0 {
+				slot = (slot + 1) % slots
+			}
+			table[slot] = e
+		}
+		for _, e := range table {
+			w.writePair(e[0], e[1])
+		}
+		w.pos += slots * 8
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.ws.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	for _, h := range header {
+		w.writePair(h[0], h[1])
+	}
+	return w.w.Flush()
+}
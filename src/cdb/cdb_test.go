@@ -0,0 +1,43 @@
+package cdb
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// key, data pairs, Get returns the first record of a key
+var testCDB = []string{"one", "first", "two", "second", "one", "again", "", "empty"}
+
+func TestWriteRead(t *testing.T) {
+	f, err := ioutil.TempFile("", "cdb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	w, err := NewWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(testCDB); i += 2 {
+		w.Put([]byte(testCDB[i]), []byte(testCDB[i+1]))
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	c, err := Open(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	for key, want := range map[string]string{"one": "first", "two": "second", "": "empty"} {
+		if got, err := c.Get([]byte(key)); err != nil || string(got) != want {
+			t.Errorf("Get(%q): got %q, %v, want %q", key, got, err, want)
+		}
+	}
+	if ok, err := c.Has([]byte("three")); ok || err != nil {
+		t.Errorf("Has(three): got %v, %v", ok, err)
+	}
+}
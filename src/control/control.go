@@ -0,0 +1,77 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package control reads qmail control files.
+// Lines begining with "#" or " " are ignored (comments), as are empty lines.
+package control
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+)
+
+// QmailHome is the qmail home directory, overridden by tests
+var QmailHome = "/var/qmail"
+
+// Path returns the path of file, relative to QmailHome
+func Path(file string) string {
+	return fmt.Sprintf("%s/%s", QmailHome, file)
+}
+
+// ReadLines returns the lines of file (ex: "control/routes")
+func ReadLines(file string) (lines []string, err error) {
+	f, err := os.Open(Path(file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	for {
+		line, _, err := r.ReadLine()
+		if err != nil {
+			break
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == 35 || line[0] == 32 {
+			continue
+		}
+		lines = append(lines, string(line))
+	}
+	return
+}
+
+// ReadFirstLine returns the first line of file, or def if file doesn't
+// exist or is empty
+func ReadFirstLine(file, def string) (string, error) {
+	lines, err := ReadLines(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return def, nil
+		}
+		return "", err
+	}
+	if len(lines) == 0 {
+		return def, nil
+	}
+	return lines[0], nil
+}
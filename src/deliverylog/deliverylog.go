@@ -0,0 +1,140 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package deliverylog writes one JSON record per delivery attempt to a file,
+// an Unix datagram socket or syslog.
+//
+// Destination format (control/deliverylog) :
+//
+//	file:/var/log/qmail/deliveries.json
+//	unixgram:/var/run/qmail-boosters/deliverylog.sock
+//	syslog
+package deliverylog
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/syslog"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Recipient is the result of a RCPT TO
+type Recipient struct {
+	Address      string `json:"address"`
+	Status       string `json:"status,omitempty"` // r (accepted), h (rejected), s (deferred), empty if RCPT was not reached
+	Code         int    `json:"code,omitempty"`
+	EnhancedCode string `json:"enhanced_code,omitempty"`
+	Message      string `json:"message,omitempty"`
+}
+
+// TLS describes the TLS session of an attempt
+type TLS struct {
+	Version string `json:"version"`
+	Cipher  string `json:"cipher"`
+}
+
+// Record represents a delivery attempt to one remote host
+type Record struct {
+	Time         time.Time          `json:"time"`
+	UUID         string             `json:"uuid"`
+	Sender       string             `json:"sender"`
+	MailFrom     string             `json:"mail_from,omitempty"` // rewritten sender, if any
+	Recipients   []Recipient        `json:"recipients"`
+	Route        string             `json:"route"`
+	Attempt      int                `json:"attempt"`
+	LocalIP      string             `json:"local_ip"`
+	RemoteIP     string             `json:"remote_ip"`
+	RemotePort   string             `json:"remote_port"`
+	Helo         string             `json:"helo,omitempty"`
+	TLS          *TLS               `json:"tls,omitempty"`
+	Auth         string             `json:"auth,omitempty"`
+	Status       string             `json:"status"` // K, Z or D as sent to qmail-rspawn
+	Code         int                `json:"code,omitempty"`
+	EnhancedCode string             `json:"enhanced_code,omitempty"`
+	Message      string             `json:"message"`
+	Retry        bool               `json:"retry"` // temporary failure before commit, next host may be tried
+	Phases       map[string]float64 `json:"phases,omitempty"`
+}
+
+// SetPhases converts phase durations to seconds
+func (r *Record) SetPhases(timings map[string]time.Duration) {
+	r.Phases = make(map[string]float64, len(timings))
+	for phase, d := range timings {
+		r.Phases[phase] = d.Seconds()
+	}
+}
+
+// Logger writes records to a destination
+type Logger struct {
+	w io.WriteCloser
+}
+
+// Open returns a Logger for dest
+func Open(dest string) (*Logger, error) {
+	t := strings.SplitN(dest, ":", 2)
+	switch t[0] {
+	case "file":
+		if len(t) != 2 || t[1] == "" {
+			return nil, errors.New("missing path for file destination")
+		}
+		f, err := os.OpenFile(t[1], os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+		if err != nil {
+			return nil, err
+		}
+		return &Logger{f}, nil
+	case "unixgram":
+		if len(t) != 2 || t[1] == "" {
+			return nil, errors.New("missing path for unixgram destination")
+		}
+		conn, err := net.Dial("unixgram", t[1])
+		if err != nil {
+			return nil, err
+		}
+		return &Logger{conn}, nil
+	case "syslog":
+		w, err := syslog.New(syslog.LOG_MAIL|syslog.LOG_INFO, "qmail-remote")
+		if err != nil {
+			return nil, err
+		}
+		return &Logger{w}, nil
+	}
+	return nil, fmt.Errorf("unknown destination %s", dest)
+}
+
+// Log writes r as a single JSON line (one datagram, one syslog message)
+func (l *Logger) Log(r *Record) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, ok := l.w.(*os.File); ok {
+		b = append(b, '\n')
+	}
+	_, err = l.w.Write(b)
+	return err
+}
+
+// Close closes the destination
+func (l *Logger) Close() error {
+	return l.w.Close()
+}
@@ -0,0 +1,279 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package dkim
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARC header fields (RFC 8617)
+const (
+	arcSeal      = "ARC-Seal"
+	arcSignature = "ARC-Message-Signature"
+	arcResults   = "ARC-Authentication-Results"
+	maxInstance  = 50
+)
+
+// SealOptions are the ARC sealing parameters. The ARC-Message-Signature
+// uses relaxed/relaxed canonicalization and Options.Headers (or
+// DefaultHeaders and DKIM-Signature).
+type SealOptions struct {
+	Options
+	// AuthServID is our authentication service identifier. Results of
+	// the Authentication-Results field with this identifier, if any, are
+	// copied in ARC-Authentication-Results.
+	AuthServID string
+}
+
+// arcSet is an ARC set of a message, as raw header fields
+type arcSet struct {
+	results, signature, seal string
+}
+
+// readChain returns the ARC sets of the header, by instance (index 0 is
+// unused). ok is false if the chain is malformed.
+func readChain(fields []string) (sets []arcSet, ok bool) {
+	byInstance := make(map[int]*arcSet)
+	max := 0
+	for _, f := range fields {
+		name := FieldName(f)
+		var field *string
+		i, err := strconv.Atoi(fieldTags(f)["i"])
+		set := byInstance[i]
+		if set == nil {
+			set = &arcSet{}
+		}
+		switch {
+		case strings.EqualFold(name, arcSeal):
+			field = &set.seal
+		case strings.EqualFold(name, arcSignature):
+			field = &set.signature
+		case strings.EqualFold(name, arcResults):
+			field = &set.results
+		default:
+			continue
+		}
+		if err != nil || i < 1 || i > maxInstance || *field != "" {
+			return nil, false
+		}
+		*field = f
+		byInstance[i] = set
+		if i > max {
+			max = i
+		}
+	}
+	sets = make([]arcSet, max+1)
+	for i := 1; i <= max; i++ {
+		set := byInstance[i]
+		if set == nil || set.seal == "" || set.signature == "" || set.results == "" {
+			return nil, false
+		}
+		sets[i] = *set
+	}
+	return sets, true
+}
+
+// lastInstance returns the highest instance of the ARC fields, for a
+// malformed chain. It is at most maxInstance.
+func lastInstance(fields []string) int {
+	last := 0
+	for _, f := range fields {
+		name := FieldName(f)
+		if !strings.EqualFold(name, arcSeal) && !strings.EqualFold(name, arcSignature) && !strings.EqualFold(name, arcResults) {
+			continue
+		}
+		i, err := strconv.Atoi(fieldTags(f)["i"])
+		if err != nil || i < 1 {
+			continue
+		}
+		if i > maxInstance {
+			return maxInstance
+		}
+		if i > last {
+			last = i
+		}
+	}
+	return last
+}
+
+// hashSeal adds the ARC sets up to instance n to h, for an ARC-Seal
+// signature. The seal of instance n is not added. Empty sets (those of a
+// malformed chain) are skipped.
+func hashSeal(h hash.Hash, sets []arcSet, n int) {
+	for i := 1; i <= n; i++ {
+		if sets[i].results == "" {
+			continue
+		}
+		io.WriteString(h, canonicalizeHeader(sets[i].results, Relaxed))
+		io.WriteString(h, canonicalizeHeader(sets[i].signature, Relaxed))
+		if i < n {
+			io.WriteString(h, canonicalizeHeader(sets[i].seal, Relaxed))
+		}
+	}
+}
+
+// validate returns the chain validation status (cv=) of the existing
+// chain : the most recent ARC-Message-Signature and all ARC-Seals must
+// verify
+func validate(fields []string, sets []arcSet, bodyHash string) string {
+	n := len(sets) - 1
+	ams := fieldTags(sets[n].signature)
+	hc, _, err := ParseCanonicalization(ams["c"])
+	if err != nil || ams["bh"] != bodyHash || ams["l"] != "" {
+		return "fail"
+	}
+	h := sha256.New()
+	hashHeaders(h, fields, strings.Split(ams["h"], ":"), hc)
+	if verifyHash(h, sets[n].signature, hc) != nil {
+		return "fail"
+	}
+	for i := n; i >= 1; i-- {
+		h := sha256.New()
+		hashSeal(h, sets, i)
+		if verifyHash(h, sets[i].seal, Relaxed) != nil {
+			return "fail"
+		}
+	}
+	return "pass"
+}
+
+// authResults returns the results of the Authentication-Results field of
+// authServID, "" if none
+func authResults(fields []string, authServID string) string {
+	for _, f := range fields {
+		if !strings.EqualFold(FieldName(f), "Authentication-Results") {
+			continue
+		}
+		v := strings.Replace(f[strings.IndexByte(f, ':')+1:], "\r\n", "", -1)
+		t := strings.SplitN(v, ";", 2)
+		if len(t) != 2 {
+			continue
+		}
+		// authserv-id may be followed by a version
+		id := strings.TrimSpace(t[0])
+		if i := strings.IndexAny(id, " \t"); i >= 0 {
+			id = id[:i]
+		}
+		if strings.EqualFold(id, authServID) {
+			return strings.TrimSpace(collapseWSP(t[1]))
+		}
+	}
+	return ""
+}
+
+// Seal reads the message from r and returns the ARC set to add at its
+// top (ARC-Seal, ARC-Message-Signature and ARC-Authentication-Results),
+// CRLF terminated. It returns "" if the message must not be sealed : the
+// existing chain has failed or is too long. A malformed chain is sealed
+// with cv=fail, after its highest instance.
+func Seal(r io.Reader, o *SealOptions) (string, error) {
+	algo, err := algorithm(o.Signer)
+	if err != nil {
+		return "", err
+	}
+	t := o.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+	names := o.Headers
+	if len(names) == 0 {
+		names = append(append([]string{}, DefaultHeaders...), "DKIM-Signature")
+	}
+	if !containsFold(names, "From") {
+		names = append([]string{"From"}, names...)
+	}
+
+	br := bufio.NewReader(r)
+	fields, err := ReadHeader(br)
+	if err != nil {
+		return "", err
+	}
+	sets, ok := readChain(fields)
+	if !ok {
+		// the new set follows the existing ones, its seal covers it only
+		sets = make([]arcSet, lastInstance(fields)+1)
+	}
+	n := len(sets) - 1
+	if ok && n > 0 && fieldTags(sets[n].seal)["cv"] == "fail" {
+		return "", nil
+	}
+	if n+1 > maxInstance {
+		return "", nil
+	}
+	bh := newBodyHasher(Relaxed)
+	hashers := []*bodyHasher{bh}
+	var prev *bodyHasher
+	if ok && n > 0 {
+		if _, bc, err := ParseCanonicalization(fieldTags(sets[n].signature)["c"]); err == nil {
+			prev = newBodyHasher(bc)
+			hashers = append(hashers, prev)
+		}
+	}
+	if err = hashBody(br, hashers...); err != nil {
+		return "", err
+	}
+
+	cv := "none"
+	switch {
+	case !ok:
+		cv = "fail"
+	case n > 0 && prev == nil:
+		cv = "fail"
+	case n > 0:
+		cv = validate(fields, sets, prev.sum())
+	}
+	i := len(sets)
+
+	set := arcSet{}
+	set.results = fmt.Sprintf("%s: i=%d; %s; ", arcResults, i, o.AuthServID)
+	if res := authResults(fields, o.AuthServID); res != "" {
+		set.results += res
+		if !strings.Contains(res, "arc=") {
+			set.results += ";\r\n\tarc=" + cv
+		}
+	} else {
+		set.results += "arc=" + cv
+	}
+
+	h := sha256.New()
+	signed := hashHeaders(h, fields, names, Relaxed)
+	sig := fmt.Sprintf("%s: i=%d; a=%s; c=relaxed/relaxed; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		arcSignature, i, algo, o.Domain, o.Selector, t.Unix(), strings.Join(signed, ":"), bh.sum())
+	b, err := signHash(o.Signer, h, sig, Relaxed)
+	if err != nil {
+		return "", err
+	}
+	set.signature = sig + fold(b)
+
+	sets = append(sets, set)
+	h = sha256.New()
+	hashSeal(h, sets, i)
+	seal := fmt.Sprintf("%s: i=%d; a=%s; t=%d; cv=%s;\r\n\td=%s; s=%s;\r\n\tb=", arcSeal, i, algo, t.Unix(), cv, o.Domain, o.Selector)
+	if b, err = signHash(o.Signer, h, seal, Relaxed); err != nil {
+		return "", err
+	}
+	return seal + fold(b) + "\r\n" + set.signature + "\r\n" + set.results + "\r\n", nil
+}
@@ -0,0 +1,82 @@
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSeal(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keys := map[string]crypto.PublicKey{"a._domainkey.relay1.example": rsaKey.Public(), "b._domainkey.relay2.example": edKey.Public()}
+	defer func(f func(string, string) (crypto.PublicKey, error)) { LookupKey = f }(LookupKey)
+	LookupKey = func(domain, selector string) (crypto.PublicKey, error) {
+		if k, ok := keys[selector+"._domainkey."+domain]; ok {
+			return k, nil
+		}
+		return nil, errors.New("no key")
+	}
+	relay1 := &SealOptions{Options{Domain: "relay1.example", Selector: "a", Signer: rsaKey}, "mx.relay1.example"}
+	relay2 := &SealOptions{Options{Domain: "relay2.example", Selector: "b", Signer: edKey}, "mx.relay2.example"}
+
+	msg := "Authentication-Results: mx.relay1.example;\n\tspf=pass smtp.mailfrom=sender.example\n" +
+		"From: a@sender.example\nTo: list@relay1.example\nSubject: hi\n\nhello  world\n\n"
+
+	set1, err := Seal(strings.NewReader(msg), relay1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(set1, "ARC-Seal: i=1; a=rsa-sha256;") || !strings.Contains(set1, "cv=none;") ||
+		!strings.Contains(set1, "ARC-Authentication-Results: i=1; mx.relay1.example; spf=pass smtp.mailfrom=sender.example;\r\n\tarc=none\r\n") {
+		t.Errorf("bad first set: %s", set1)
+	}
+
+	set2, err := Seal(strings.NewReader(set1+msg), relay2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(set2, "ARC-Seal: i=2; a=ed25519-sha256;") || !strings.Contains(set2, "cv=pass;") || !strings.Contains(set2, "ARC-Authentication-Results: i=2; mx.relay2.example; arc=pass\r\n") {
+		t.Errorf("bad second set: %s", set2)
+	}
+
+	// the whole chain verifies
+	br := bufio.NewReader(strings.NewReader(set2 + set1 + msg))
+	fields, _ := ReadHeader(br)
+	sets, ok := readChain(fields)
+	bh := newBodyHasher(Relaxed)
+	hashBody(br, bh)
+	if !ok || len(sets) != 3 || validate(fields, sets, bh.sum()) != "pass" {
+		t.Errorf("chain doesn't verify")
+	}
+
+	// body modified after the first seal
+	set2, _ = Seal(strings.NewReader(set1+strings.Replace(msg, "hello", "buy", 1)), relay2)
+	if !strings.Contains(set2, "cv=fail;") {
+		t.Errorf("expected cv=fail: %s", set2)
+	}
+	// a failed chain is not sealed again
+	if set3, err := Seal(strings.NewReader(set2+set1+msg), relay1); set3 != "" || err != nil {
+		t.Errorf("failed chain sealed: %s %v", set3, err)
+	}
+
+	// a malformed chain (no instance 2) is sealed after its highest instance
+	broken := strings.Replace(set2, "i=2;", "i=3;", -1)
+	set3, err := Seal(strings.NewReader(broken+set1+msg), relay1)
+	if err != nil || !strings.HasPrefix(set3, "ARC-Seal: i=4; a=rsa-sha256;") || !strings.Contains(set3, "cv=fail;") ||
+		!strings.Contains(set3, "ARC-Authentication-Results: i=4;") {
+		t.Errorf("bad set on a broken chain: %s %v", set3, err)
+	}
+	br = bufio.NewReader(strings.NewReader(set3 + broken + set1 + msg))
+	if fields, _ = ReadHeader(br); lastInstance(fields) != 4 {
+		t.Errorf("got last instance %d", lastInstance(fields))
+	}
+}
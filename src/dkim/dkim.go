@@ -0,0 +1,355 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package dkim signs messages (RFC 6376) and seals them with ARC (RFC 8617),
+// with RSA-SHA256 or Ed25519-SHA256 (RFC 8463) keys.
+//
+// The message is read once : header fields are kept in memory, the body is
+// hashed as it is read. The caller then sends the returned header fields
+// followed by the message.
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// Canonicalization algorithms
+const (
+	Simple  = "simple"
+	Relaxed = "relaxed"
+)
+
+// DefaultHeaders are the header fields signed if Options.Headers is empty
+var DefaultHeaders = []string{"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-ID", "In-Reply-To", "References", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// Options are the signing parameters
+type Options struct {
+	Domain   string // d=
+	Selector string // s=
+	// Signer is a *rsa.PrivateKey or an ed25519.PrivateKey
+	Signer crypto.Signer
+	// HeaderCanonicalization and BodyCanonicalization are Simple or
+	// Relaxed, Simple if empty
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+	// Headers are the names of the header fields to sign, From is always
+	// signed. Fields missing from the message are not signed.
+	Headers []string
+	// Time is the signature timestamp (t=), now if zero
+	Time time.Time
+}
+
+// ParseCanonicalization parses a c= value like "relaxed/simple"
+func ParseCanonicalization(c string) (header, body string, err error) {
+	t := strings.SplitN(c, "/", 2)
+	header, body = t[0], Simple
+	if len(t) == 2 {
+		body = t[1]
+	}
+	for _, v := range []string{header, body} {
+		if v != Simple && v != Relaxed {
+			return "", "", fmt.Errorf("unknown canonicalization %s", c)
+		}
+	}
+	return
+}
+
+// ParseKey parses a PEM encoded private key : RSA (PKCS#1 or PKCS#8) or
+// Ed25519 (PKCS#8)
+func ParseKey(b []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, errors.New("unsupported key type")
+}
+
+// LoadKey reads a PEM encoded private key from file
+func LoadKey(file string) (crypto.Signer, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(b)
+}
+
+// Sign reads the message from r and returns its DKIM-Signature header
+// field, CRLF terminated
+func Sign(r io.Reader, o *Options) (string, error) {
+	algo, err := algorithm(o.Signer)
+	if err != nil {
+		return "", err
+	}
+	hc, bc := o.HeaderCanonicalization, o.BodyCanonicalization
+	if hc == "" {
+		hc = Simple
+	}
+	if bc == "" {
+		bc = Simple
+	}
+	names := o.Headers
+	if len(names) == 0 {
+		names = DefaultHeaders
+	}
+	if !containsFold(names, "From") {
+		names = append([]string{"From"}, names...)
+	}
+	t := o.Time
+	if t.IsZero() {
+		t = time.Now()
+	}
+
+	br := bufio.NewReader(r)
+	fields, err := ReadHeader(br)
+	if err != nil {
+		return "", err
+	}
+	bh := newBodyHasher(bc)
+	if err = hashBody(br, bh); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	signed := hashHeaders(h, fields, names, hc)
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=%s/%s; d=%s; s=%s;\r\n\tt=%d; h=%s;\r\n\tbh=%s;\r\n\tb=",
+		algo, hc, bc, o.Domain, o.Selector, t.Unix(), strings.Join(signed, ":"), bh.sum())
+	b, err := signHash(o.Signer, h, sig, hc)
+	if err != nil {
+		return "", err
+	}
+	return sig + fold(b) + "\r\n", nil
+}
+
+// algorithm returns the a= tag for signer
+func algorithm(signer crypto.Signer) (string, error) {
+	switch signer.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	}
+	return "", errors.New("unsupported key type")
+}
+
+// signHash adds the signature field sig (with an empty b= tag) to h, as
+// the last field without its CRLF, and returns the base64 signature of h
+func signHash(signer crypto.Signer, h hash.Hash, sig, canon string) (string, error) {
+	io.WriteString(h, strings.TrimSuffix(canonicalizeHeader(sig, canon), "\r\n"))
+	sum := h.Sum(nil)
+	var b []byte
+	var err error
+	switch k := signer.(type) {
+	case *rsa.PrivateKey:
+		b, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum)
+	case ed25519.PrivateKey:
+		b = ed25519.Sign(k, sum)
+	default:
+		err = errors.New("unsupported key type")
+	}
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// fold folds a long tag value (b=) on several lines
+func fold(v string) string {
+	var lines []string
+	for len(v) > 72 {
+		lines = append(lines, v[:72])
+		v = v[72:]
+	}
+	lines = append(lines, v)
+	return strings.Join(lines, "\r\n\t ")
+}
+
+// ReadHeader reads the header section, up to and including the empty
+// line. Fields are returned raw, without their final CRLF, folding lines
+// joined with CRLF. LF only line endings are accepted.
+func ReadHeader(br *bufio.Reader) (fields []string, err error) {
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line == "" {
+			return fields, nil
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += "\r\n" + line
+		} else {
+			fields = append(fields, line)
+		}
+		if err == io.EOF {
+			return fields, nil
+		}
+	}
+}
+
+// FieldName returns the name of a raw header field
+func FieldName(f string) string {
+	if i := strings.IndexByte(f, ':'); i >= 0 {
+		return strings.TrimRight(f[:i], " \t")
+	}
+	return f
+}
+
+// hashHeaders adds the fields named in names to h, canonicalized, and
+// returns the names of the fields found. For fields appearing more than
+// once, instances are taken from the bottom of the header.
+func hashHeaders(h io.Writer, fields, names []string, canon string) (signed []string) {
+	used := make(map[int]bool)
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(FieldName(fields[i]), name) {
+				used[i] = true
+				io.WriteString(h, canonicalizeHeader(fields[i], canon))
+				signed = append(signed, name)
+				break
+			}
+		}
+	}
+	return
+}
+
+// canonicalizeHeader returns the canonical form of a raw header field,
+// CRLF terminated
+func canonicalizeHeader(f, canon string) string {
+	if canon != Relaxed {
+		return f + "\r\n"
+	}
+	i := strings.IndexByte(f, ':')
+	if i < 0 {
+		return strings.ToLower(f) + ":\r\n"
+	}
+	name := strings.ToLower(strings.TrimRight(f[:i], " \t"))
+	value := strings.Replace(f[i+1:], "\r\n", "", -1)
+	value = strings.Trim(collapseWSP(value), " ")
+	return name + ":" + value + "\r\n"
+}
+
+// bodyHasher canonicalizes and hashes a body, line by line
+type bodyHasher struct {
+	h        hash.Hash
+	canon    string
+	empty    int // pending empty lines, dropped at the end of the body
+	nonEmpty bool
+}
+
+func newBodyHasher(canon string) *bodyHasher {
+	return &bodyHasher{h: sha256.New(), canon: canon}
+}
+
+// line adds a body line, without its line ending
+func (b *bodyHasher) line(line string) {
+	if b.canon == Relaxed {
+		line = strings.TrimRight(collapseWSP(line), " ")
+	}
+	if line == "" {
+		b.empty++
+		return
+	}
+	for ; b.empty > 0; b.empty-- {
+		io.WriteString(b.h, "\r\n")
+	}
+	io.WriteString(b.h, line+"\r\n")
+	b.nonEmpty = true
+}
+
+// sum returns the base64 body hash
+func (b *bodyHasher) sum() string {
+	if !b.nonEmpty && b.canon != Relaxed {
+		io.WriteString(b.h, "\r\n")
+	}
+	return base64.StdEncoding.EncodeToString(b.h.Sum(nil))
+}
+
+// hashBody reads the body from r and feeds its lines to hashers
+func hashBody(r *bufio.Reader, hashers ...*bodyHasher) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) > 0 {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			for _, b := range hashers {
+				b.line(line)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// collapseWSP reduces sequences of spaces and tabs to a single space
+func collapseWSP(s string) string {
+	var b strings.Builder
+	wsp := false
+	for i := 0; i < len(s); i++ {
+		if s[i] == ' ' || s[i] == '\t' {
+			if !wsp {
+				b.WriteByte(' ')
+			}
+			wsp = true
+			continue
+		}
+		wsp = false
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// RFC 8463 appendix A
+const (
+	rfc8463Seed   = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	rfc8463Public = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	rfc8463Msg    = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+)
+
+var bRe = regexp.MustCompile(`(;\s*b=)[^;]*`)
+
+// verify checks the first DKIM-Signature of msg with pub
+func verify(t *testing.T, msg string, pub crypto.PublicKey) {
+	br := bufio.NewReader(strings.NewReader(msg))
+	fields, err := ReadHeader(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := fields[0]
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(sig[strings.IndexByte(sig, ':')+1:], ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			tags[strings.TrimSpace(kv[0])] = strings.Map(func(r rune) rune {
+				if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+					return -1
+				}
+				return r
+			}, kv[1])
+		}
+	}
+	hc, bc, err := ParseCanonicalization(tags["c"])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bh := newBodyHasher(bc)
+	hashBody(br, bh)
+	if got := bh.sum(); got != tags["bh"] {
+		t.Fatalf("got body hash %s, want %s", got, tags["bh"])
+	}
+
+	h := sha256.New()
+	hashHeaders(h, fields[1:], strings.Split(tags["h"], ":"), hc)
+	h.Write([]byte(strings.TrimSuffix(canonicalizeHeader(bRe.ReplaceAllString(sig, "$1"), hc), "\r\n")))
+	b, _ := base64.StdEncoding.DecodeString(tags["b"])
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, h.Sum(nil), b)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, h.Sum(nil), b) {
+			err = rsa.ErrVerification
+		}
+	}
+	if err != nil {
+		t.Errorf("bad signature: %v\n%s", err, msg)
+	}
+}
+
+func TestVerifyRFC8463(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString(rfc8463Seed)
+	pub, _ := base64.StdEncoding.DecodeString(rfc8463Public)
+	key := ed25519.NewKeyFromSeed(seed)
+	if !key.Public().(ed25519.PublicKey).Equal(ed25519.PublicKey(pub)) {
+		t.Fatal("bad test vector")
+	}
+	verify(t, rfc8463Msg, ed25519.PublicKey(pub))
+}
+
+func TestSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	// qmail queue files have LF line endings, folded Subject, trailing
+	// blank lines and white spaces
+	msg := "From: Joe SixPack <joe@football.example.com>\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\n" +
+		"Subject:  Is dinner\n\tready?\n" +
+		"Received: from x\n" +
+		"Received: from y\n" +
+		"\n" +
+		"Hi.  \n\n\tWe lost.\n\n\n"
+
+	for _, c := range []string{"simple/simple", "relaxed/simple", "relaxed/relaxed", "simple/relaxed"} {
+		for _, key := range []crypto.Signer{rsaKey, edKey} {
+			hc, bc, _ := ParseCanonicalization(c)
+			o := &Options{Domain: "football.example.com", Selector: "s1", Signer: key, HeaderCanonicalization: hc, BodyCanonicalization: bc, Headers: []string{"to", "subject", "received", "received", "x-missing"}}
+			sig, err := Sign(strings.NewReader(msg), o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(sig, "h=From:to:subject:received:received;") {
+				t.Errorf("%s: bad h= tag: %s", c, sig)
+			}
+			verify(t, sig+msg, key.Public())
+		}
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	if _, err := ParseKey([]byte("nope")); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,134 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// LookupKey returns the public key of selector for domain. The default
+// looks up the selector._domainkey.domain TXT record.
+var LookupKey = lookupKeyDNS
+
+func lookupKeyDNS(domain, selector string) (crypto.PublicKey, error) {
+	txts, err := net.LookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, txt := range txts {
+		if key, err := ParsePublicKey(txt); err == nil {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no usable key found for %s._domainkey.%s", selector, domain)
+}
+
+// ParsePublicKey parses a DKIM key record ("v=DKIM1; k=rsa; p=...")
+func ParsePublicKey(record string) (crypto.PublicKey, error) {
+	tags := parseTags(record)
+	p, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil || len(p) == 0 {
+		return nil, errors.New("bad or revoked key")
+	}
+	switch tags["k"] {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(p); err == nil {
+			if k, ok := key.(*rsa.PublicKey); ok {
+				return k, nil
+			}
+			return nil, errors.New("not a RSA key")
+		}
+		return x509.ParsePKCS1PublicKey(p)
+	case "ed25519":
+		if len(p) != ed25519.PublicKeySize {
+			return nil, errors.New("bad ed25519 key")
+		}
+		return ed25519.PublicKey(p), nil
+	}
+	return nil, fmt.Errorf("unknown key type %s", tags["k"])
+}
+
+// parseTags parses a tag list (RFC 6376 section 3.2), white spaces are
+// removed from values
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		tags[strings.TrimSpace(kv[0])] = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+				return -1
+			}
+			return r
+		}, kv[1])
+	}
+	return tags
+}
+
+// fieldTags parses the tag list of a raw signature header field
+func fieldTags(f string) map[string]string {
+	return parseTags(f[strings.IndexByte(f, ':')+1:])
+}
+
+var bTagRe = regexp.MustCompile(`((?:^|;)\s*b=)[^;]*`)
+
+// verifyHash adds the signature field sig, with its b= value removed, to
+// h and checks the b= signature of h with the key of d= and s=
+func verifyHash(h hash.Hash, sig, canon string) error {
+	colon := strings.IndexByte(sig, ':')
+	io.WriteString(h, strings.TrimSuffix(canonicalizeHeader(sig[:colon+1]+bTagRe.ReplaceAllString(sig[colon+1:], "$1"), canon), "\r\n"))
+	tags := fieldTags(sig)
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+	pub, err := LookupKey(tags["d"], tags["s"])
+	if err != nil {
+		return err
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if tags["a"] != "rsa-sha256" {
+			return errors.New("algorithm mismatch")
+		}
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h.Sum(nil), b)
+	case ed25519.PublicKey:
+		if tags["a"] != "ed25519-sha256" {
+			return errors.New("algorithm mismatch")
+		}
+		if !ed25519.Verify(k, h.Sum(nil), b) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key type")
+}
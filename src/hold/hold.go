@@ -0,0 +1,274 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package hold manages control/holddomains : qmail-remote defers the
+// deliveries to held recipient domains or routes at once, without
+// connecting, until the hold is removed or expires. A line per hold :
+//
+//	# name;until (unix time, empty for none);reason
+//	example.com;1413720000;MX down
+//	.example.net;;blocking us
+//	route:mailjet;;
+//
+// A name starting with a dot holds the subdomains, as in rcpthosts.
+package hold
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+// File is the control file of holds
+const File = "control/holddomains"
+
+// RoutePrefix is the prefix of route names in holds
+const RoutePrefix = "route:"
+
+// Hold is a held domain or route
+type Hold struct {
+	Name   string    // domain, .domain or route:name
+	Until  time.Time // zero : until removed
+	Reason string
+}
+
+// Expired tells if h is over at now
+func (h *Hold) Expired(now time.Time) bool {
+	return !h.Until.IsZero() && !now.Before(h.Until)
+}
+
+// matches tells if h holds deliveries to host through route
+func (h *Hold) matches(host, route string) bool {
+	switch {
+	case strings.HasPrefix(h.Name, RoutePrefix):
+		return h.Name[len(RoutePrefix):] == route
+	case h.Name[0] == '.':
+		return strings.HasSuffix(host, h.Name)
+	}
+	return host == h.Name
+}
+
+// BadLines is returned by Load, with the holds of the other lines, when
+// some lines can't be parsed : a typo doesn't stop all deliveries
+type BadLines []string
+
+func (b BadLines) Error() string {
+	return "bad hold(s) in " + File + ": " + strings.Join(b, ", ")
+}
+
+// CheckName tells why name can't be held, nil if it can : a domain,
+// .domain or route:name, without ";" or spaces
+func CheckName(name string) error {
+	if name == "" || name == "." || name == RoutePrefix || strings.Contains(name, ";") {
+		return fmt.Errorf("bad hold name %q", name)
+	}
+	for _, r := range name {
+		if r <= ' ' || r == 0x7f {
+			return fmt.Errorf("bad hold name %q", name)
+		}
+	}
+	return nil
+}
+
+// parse parses a line of the holds file
+func parse(l string) (Hold, error) {
+	t := strings.SplitN(l, ";", 3)
+	h := Hold{Name: strings.ToLower(t[0])}
+	if err := CheckName(h.Name); err != nil {
+		return h, err
+	}
+	if len(t) > 1 && t[1] != "" {
+		n, err := strconv.ParseInt(t[1], 10, 64)
+		if err != nil {
+			return h, err
+		}
+		h.Until = time.Unix(n, 0)
+	}
+	if len(t) > 2 {
+		h.Reason = t[2]
+	}
+	return h, nil
+}
+
+// Load reads the holds, none if the file doesn't exist. Bad lines are
+// skipped and returned as BadLines.
+func Load() ([]Hold, error) {
+	lines, err := control.ReadLines(File)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var holds []Hold
+	var bad BadLines
+	for _, l := range lines {
+		h, err := parse(l)
+		if err != nil {
+			bad = append(bad, l)
+			continue
+		}
+		holds = append(holds, h)
+	}
+	if bad != nil {
+		return holds, bad
+	}
+	return holds, nil
+}
+
+// loadGood returns the holds of the good lines, bad ones are dropped by
+// the next save
+func loadGood() ([]Hold, error) {
+	holds, err := Load()
+	if _, ok := err.(BadLines); ok {
+		err = nil
+	}
+	return holds, err
+}
+
+// Find returns the hold of deliveries to host through route at now, nil
+// if there is none
+func Find(holds []Hold, host, route string, now time.Time) *Hold {
+	host = strings.ToLower(host)
+	for i := range holds {
+		if !holds[i].Expired(now) && holds[i].matches(host, route) {
+			return &holds[i]
+		}
+	}
+	return nil
+}
+
+// lock takes the lock of the holds file against concurrent changes, the
+// returned function releases it. Readers don't need it : the file is
+// replaced at once.
+func lock() (unlock func(), err error) {
+	f, err := os.OpenFile(control.Path(File+".lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// Save replaces the holds, expired ones are dropped. qmail-remote never
+// reads a partial file.
+func Save(holds []Hold, now time.Time) error {
+	unlock, err := lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return save(holds, now)
+}
+
+func save(holds []Hold, now time.Time) error {
+	path := control.Path(File)
+	f, err := ioutil.TempFile(filepath.Dir(path), ".holddomains")
+	if err != nil {
+		return err
+	}
+	for _, h := range holds {
+		if h.Expired(now) {
+			continue
+		}
+		if err = CheckName(h.Name); err != nil {
+			break
+		}
+		until := ""
+		if !h.Until.IsZero() {
+			until = strconv.FormatInt(h.Until.Unix(), 10)
+		}
+		reason := strings.NewReplacer("\n", " ", "\r", " ").Replace(h.Reason)
+		if _, err = fmt.Fprintf(f, "%s;%s;%s\n", h.Name, until, reason); err != nil {
+			break
+		}
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		// qmail-remote runs as qmailr
+		if err = os.Chmod(f.Name(), 0644); err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Add holds h.Name, replacing its previous hold
+func Add(h Hold, now time.Time) error {
+	h.Name = strings.ToLower(h.Name)
+	if err := CheckName(h.Name); err != nil {
+		return err
+	}
+	unlock, err := lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	holds, err := loadGood()
+	if err != nil {
+		return err
+	}
+	for i := range holds {
+		if holds[i].Name == h.Name {
+			holds[i] = h
+			return save(holds, now)
+		}
+	}
+	return save(append(holds, h), now)
+}
+
+// Remove releases name, found is false if it wasn't held
+func Remove(name string, now time.Time) (found bool, err error) {
+	unlock, err := lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	holds, err := loadGood()
+	if err != nil {
+		return false, err
+	}
+	name = strings.ToLower(name)
+	kept := holds[:0]
+	for _, h := range holds {
+		if h.Name == name {
+			found = true
+			continue
+		}
+		kept = append(kept, h)
+	}
+	if !found {
+		return false, nil
+	}
+	return true, save(kept, now)
+}
@@ -0,0 +1,111 @@
+package hold
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+func TestHold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hold")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "control"), 0755)
+	old := control.QmailHome
+	control.QmailHome = dir
+	defer func() { control.QmailHome = old }()
+
+	now := time.Unix(1400000000, 0)
+	if holds, err := Load(); holds != nil || err != nil {
+		t.Fatalf("no file: got %v, %v", holds, err)
+	}
+	for _, h := range []Hold{
+		{Name: "Example.com", Reason: "MX down"},
+		{Name: ".example.net", Until: now.Add(time.Hour)},
+		{Name: "route:mailjet"},
+		{Name: "old.example", Until: now.Add(time.Minute)},
+	} {
+		if err = Add(h, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+	holds, err := Load()
+	if err != nil || len(holds) != 4 {
+		t.Fatalf("got %v, %v", holds, err)
+	}
+	later := now.Add(2 * time.Minute)
+	for _, test := range []struct {
+		host, route, want string
+	}{
+		{"EXAMPLE.COM", "default", "example.com"},
+		{"mx.example.com", "default", ""},
+		{"mx.example.net", "default", ".example.net"},
+		{"example.net", "default", ""},
+		{"example.org", "mailjet", "route:mailjet"},
+		{"old.example", "default", ""},
+	} {
+		got := ""
+		if h := Find(holds, test.host, test.route, later); h != nil {
+			got = h.Name
+		}
+		if got != test.want {
+			t.Errorf("Find(%s, %s): got %q, want %q", test.host, test.route, got, test.want)
+		}
+	}
+	if h := Find(holds, "mx.example.net", "default", now.Add(time.Hour)); h != nil {
+		t.Errorf("expired hold found")
+	}
+
+	if found, err := Remove("example.com", later); !found || err != nil {
+		t.Fatalf("Remove: got %t, %v", found, err)
+	}
+	if found, _ := Remove("example.com", later); found {
+		t.Errorf("removed twice")
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(dir, File))
+	if string(b) != ".example.net;1400003600;\nroute:mailjet;;\n" {
+		t.Errorf("got file %q", b)
+	}
+
+	// concurrent changes are all kept
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := Add(Hold{Name: fmt.Sprintf("d%d.example", i)}, later); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if holds, _ = Load(); len(holds) != 22 {
+		t.Errorf("got %d holds after concurrent adds, want 22", len(holds))
+	}
+
+	// bad names are refused, bad lines skipped
+	for _, name := range []string{"a;b", "a b", "a\nb", "", "route:"} {
+		if err = Add(Hold{Name: name}, later); err == nil {
+			t.Errorf("%q added", name)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, File), []byte("example.com;;\na b;;\nexample.org;x;\n"), 0644)
+	holds, err = Load()
+	if b, ok := err.(BadLines); !ok || len(b) != 2 || len(holds) != 1 {
+		t.Errorf("bad lines: got %v, %v", holds, err)
+	}
+	if err = Add(Hold{Name: "example.net"}, later); err != nil {
+		t.Fatal(err)
+	}
+	if holds, err = Load(); len(holds) != 2 || err != nil {
+		t.Errorf("after add: got %v, %v", holds, err)
+	}
+}
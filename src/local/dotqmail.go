@@ -0,0 +1,112 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package local delivers messages as qmail-local does : instructions of
+// .qmail files (programs, mbox, maildirs, forwards), with Maildir++
+// quotas and rules filing messages in maildir folders.
+package local
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kind is the kind of a delivery instruction
+type Kind int
+
+// Kinds
+const (
+	Program Kind = iota // | command
+	Forward             // & address, or address
+	Mbox                // ./file or /file
+	Maildir             // ./dir/ or /dir/
+)
+
+func (k Kind) String() string {
+	return [...]string{"program", "forward", "mbox", "maildir"}[k]
+}
+
+// Instruction is a line of a .qmail file
+type Instruction struct {
+	Kind Kind
+	Arg  string
+}
+
+// ParseDotQmail reads delivery instructions, comments and empty lines
+// are ignored
+func ParseDotQmail(r io.Reader) ([]Instruction, error) {
+	var ins []Instruction
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		l := strings.TrimRight(s.Text(), "\r")
+		switch {
+		case l == "" || l[0] == '#':
+		case l[0] == '|':
+			ins = append(ins, Instruction{Program, l[1:]})
+		case l[0] == '.' || l[0] == '/':
+			if strings.HasSuffix(l, "/") {
+				ins = append(ins, Instruction{Maildir, l})
+			} else {
+				ins = append(ins, Instruction{Mbox, l})
+			}
+		default:
+			l = strings.TrimRight(strings.TrimPrefix(l, "&"), " \t")
+			if l != "" {
+				ins = append(ins, Instruction{Forward, l})
+			}
+		}
+	}
+	return ins, s.Err()
+}
+
+// FindDotQmail returns the .qmail file of ext in home : .qmail-ext, then
+// .qmail-foo-default for ext foo-bar, up to .qmail-default. def is the
+// part of ext matched by "default". name is "" if there is none.
+func FindDotQmail(home, dash, ext string) (name, def string, err error) {
+	// qmail-local replaces dots by colons
+	ext = strings.Replace(strings.ToLower(ext), ".", ":", -1)
+	try := func(n string) (bool, error) {
+		_, err := os.Stat(filepath.Join(home, n))
+		if err == nil {
+			return true, nil
+		}
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	n := ".qmail" + dash + ext
+	if ok, err := try(n); ok || err != nil || ext == "" {
+		if !ok {
+			n = ""
+		}
+		return n, "", err
+	}
+	for i := len(ext); i >= 0; i-- {
+		if i == 0 || ext[i-1] == '-' {
+			n = ".qmail" + dash + ext[:i] + "default"
+			if ok, err := try(n); ok || err != nil {
+				return n, ext[i:], err
+			}
+		}
+	}
+	return "", "", nil
+}
@@ -0,0 +1,419 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package local
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/qmailqueue"
+)
+
+// Error is a failed delivery, qmail-local exits with 100 if it is
+// permanent, 111 otherwise
+type Error struct {
+	Permanent bool
+	Msg       string // ex: "Sorry, no mailbox here by that name. (#5.1.1)"
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func tempError(format string, v ...interface{}) *Error {
+	return &Error{false, fmt.Sprintf(format, v...)}
+}
+
+func permError(format string, v ...interface{}) *Error {
+	return &Error{true, fmt.Sprintf(format, v...)}
+}
+
+// Delivery is a delivery to a local user, the arguments of qmail-local
+type Delivery struct {
+	User            string
+	Home            string
+	Local           string
+	Dash            string
+	Ext             string
+	Host            string
+	Sender          string
+	DefaultDelivery string    // used if there is no .qmail file
+	Message         *os.File  // seekable
+	Out             io.Writer // reported to qmail-lspawn, programs write there too
+	DryRun          bool      // print instructions instead of delivering (-n)
+
+	UUID                      string // X-QB-UUID of the message, "nouuid" if none
+	Files, Forwards, Programs int    // done deliveries
+	header                    textproto.MIMEHeader
+	size                      int64
+	newSender, def            string
+	forwardOnly               bool
+}
+
+// logf writes a line to Out, prefixed by the UUID as in the status lines
+// of qmail-remote
+func (d *Delivery) logf(format string, v ...interface{}) {
+	fmt.Fprintf(d.Out, "%s:%s\n", d.UUID, fmt.Sprintf(format, v...))
+}
+
+// message rewinds the message
+func (d *Delivery) message() (io.Reader, error) {
+	if _, err := d.Message.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return bufio.NewReader(d.Message), nil
+}
+
+// noNewline replaces newlines, which would break header fields
+func noNewline(s string) string {
+	return strings.Replace(s, "\n", "_", -1)
+}
+
+func (d *Delivery) rpline() string {
+	return "Return-Path: <" + noNewline(d.Sender) + ">\n"
+}
+
+func (d *Delivery) dtline() string {
+	return "Delivered-To: " + noNewline(d.Local+"@"+d.Host) + "\n"
+}
+
+func (d *Delivery) ufline() string {
+	s := d.Sender
+	if s == "" {
+		s = "MAILER-DAEMON"
+	}
+	return "From " + strings.Replace(noNewline(s), " ", "-", -1) + " " + time.Now().UTC().Format("Mon Jan _2 15:04:05 2006") + "\n"
+}
+
+// checkHome refuses homes others can write to, or being edited (sticky)
+func (d *Delivery) checkHome() error {
+	fi, err := os.Stat(d.Home)
+	if err != nil {
+		return tempError("Unable to switch to %s: %s. (#4.3.0)", d.Home, err)
+	}
+	if fi.Mode().Perm()&002 != 0 {
+		return tempError("Uh-oh: home directory is writable. (#4.7.0)")
+	}
+	if fi.Mode()&os.ModeSticky != 0 && !d.DryRun {
+		return tempError("Home directory is sticky: user is editing his .qmail file. (#4.2.1)")
+	}
+	return nil
+}
+
+// path returns the absolute path of a file of a delivery instruction
+func (d *Delivery) path(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(d.Home, name)
+}
+
+// exists tells if a file of home exists
+func (d *Delivery) exists(name string) bool {
+	_, err := os.Stat(filepath.Join(d.Home, name))
+	return err == nil
+}
+
+// instructions returns the delivery instructions of the .qmail file, or
+// the default delivery
+func (d *Delivery) instructions() ([]Instruction, error) {
+	name, def, err := FindDotQmail(d.Home, d.Dash, d.Ext)
+	if err != nil {
+		return nil, tempError("Unable to open %s: %s. (#4.3.0)", name, err)
+	}
+	if name == "" {
+		if d.Ext != "" {
+			return nil, permError("Sorry, no mailbox here by that name. (#5.1.1)")
+		}
+		return ParseDotQmail(strings.NewReader(d.DefaultDelivery))
+	}
+	d.def = def
+	f, err := os.Open(filepath.Join(d.Home, name))
+	if err != nil {
+		return nil, tempError("Unable to open %s: %s. (#4.3.0)", name, err)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, tempError("Unable to open %s: %s. (#4.3.0)", name, err)
+	}
+	if fi.Mode().Perm()&002 != 0 {
+		return nil, tempError("Uh-oh: .qmail file is writable. (#4.7.0)")
+	}
+	d.forwardOnly = fi.Mode().Perm()&0100 != 0
+	if fi.Size() == 0 {
+		return ParseDotQmail(strings.NewReader(d.DefaultDelivery))
+	}
+	ins, err := ParseDotQmail(f)
+	if err != nil {
+		return nil, tempError("Unable to read %s: %s. (#4.3.0)", name, err)
+	}
+	return ins, nil
+}
+
+// Run delivers the message
+func (d *Delivery) Run() error {
+	if d.UUID == "" {
+		d.UUID = "nouuid"
+	}
+	if err := d.checkHome(); err != nil {
+		return err
+	}
+	fi, err := d.Message.Stat()
+	if err != nil {
+		return tempError("Unable to read message. (#4.3.0)")
+	}
+	d.size = fi.Size()
+	msg, err := d.message()
+	if err != nil {
+		return tempError("Unable to rewind message. (#4.3.0)")
+	}
+	d.header, _ = textproto.NewReader(bufio.NewReader(msg)).ReadMIMEHeader()
+	if id := d.header.Get("X-QB-UUID"); id != "" {
+		d.UUID = id
+	}
+	ueo := d.Local + "@" + d.Host
+	for _, dt := range d.header["Delivered-To"] {
+		if strings.EqualFold(strings.TrimSpace(dt), ueo) {
+			return permError("This message is looping: it already has my Delivered-To line. (#5.4.6)")
+		}
+	}
+
+	// bounces of forwards go to the owner
+	d.newSender = d.Sender
+	owner := ".qmail" + d.Dash + strings.Replace(strings.ToLower(d.Ext), ".", ":", -1) + "-owner"
+	if d.Sender != "" && d.Sender != "#@[]" && d.exists(owner) {
+		d.newSender = d.Local + "-owner@" + d.Host
+		if d.exists(owner + "-default") {
+			d.newSender = d.Local + "-owner-@" + d.Host + "-@[]"
+		}
+	}
+
+	ins, err := d.instructions()
+	if err != nil {
+		return err
+	}
+	if d.DryRun {
+		for _, in := range ins {
+			fmt.Fprintf(d.Out, "%s: %s\n", in.Kind, in.Arg)
+		}
+		return nil
+	}
+	var forwards []string
+	for _, in := range ins {
+		if d.forwardOnly && in.Kind == Program {
+			return tempError("Uh-oh: .qmail has prog delivery but has x bit set. (#4.7.0)")
+		}
+		if d.forwardOnly && (in.Kind == Mbox || in.Kind == Maildir) {
+			return tempError("Uh-oh: .qmail has file delivery but has x bit set. (#4.7.0)")
+		}
+	}
+loop:
+	for _, in := range ins {
+		switch in.Kind {
+		case Forward:
+			forwards = append(forwards, in.Arg)
+			continue
+		case Program:
+			stop, err := d.program(in.Arg)
+			if err != nil {
+				return err
+			}
+			d.Programs++
+			if stop {
+				// 99 : ignore the next instructions, not the forwards before
+				break loop
+			}
+			continue
+		case Mbox:
+			err = d.mbox(d.path(in.Arg))
+		case Maildir:
+			err = d.maildir(d.path(in.Arg))
+		}
+		if err != nil {
+			return err
+		}
+		d.Files++
+	}
+	if len(forwards) > 0 {
+		return d.forward(forwards)
+	}
+	return nil
+}
+
+// environ returns the environment of programs
+func (d *Delivery) environ() []string {
+	env := []string{
+		"USER=" + d.User,
+		"HOME=" + d.Home,
+		"LOCAL=" + d.Local,
+		"HOST=" + d.Host,
+		"RECIPIENT=" + d.Local + "@" + d.Host,
+		"SENDER=" + d.Sender,
+		"NEWSENDER=" + d.newSender,
+		"DTLINE=" + d.dtline(),
+		"RPLINE=" + d.rpline(),
+		"UFLINE=" + d.ufline(),
+		"EXT=" + d.Ext,
+		"QB_UUID=" + d.UUID,
+	}
+	// HOST2 is HOST without its last part, EXT2 is EXT without its first
+	// part...
+	host := d.Host
+	ext := d.Ext
+	for i := 2; i <= 4; i++ {
+		if j := strings.LastIndexByte(host, '.'); j >= 0 {
+			host = host[:j]
+		} else {
+			host = ""
+		}
+		if j := strings.IndexByte(ext, '-'); j >= 0 {
+			ext = ext[j+1:]
+		} else {
+			ext = ""
+		}
+		env = append(env, fmt.Sprintf("HOST%d=%s", i, host), fmt.Sprintf("EXT%d=%s", i, ext))
+	}
+	if d.def != "" {
+		env = append(env, "DEFAULT="+d.def)
+	}
+	for _, e := range os.Environ() {
+		switch strings.SplitN(e, "=", 2)[0] {
+		case "USER", "HOME", "LOCAL", "HOST", "HOST2", "HOST3", "HOST4", "RECIPIENT",
+			"SENDER", "NEWSENDER", "DTLINE", "RPLINE", "UFLINE", "EXT", "EXT2", "EXT3",
+			"EXT4", "DEFAULT", "QB_UUID":
+		default:
+			env = append(env, e)
+		}
+	}
+	return env
+}
+
+// program runs command with the message on its stdin. stop is true if
+// the program exits with 99.
+func (d *Delivery) program(command string) (stop bool, err error) {
+	msg, err := d.message()
+	if err != nil {
+		return false, tempError("Unable to rewind message. (#4.3.0)")
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = d.Home
+	cmd.Env = d.environ()
+	cmd.Stdin = msg
+	cmd.Stdout = d.Out
+	cmd.Stderr = d.Out
+	err = cmd.Run()
+	if err == nil {
+		return false, nil
+	}
+	ee, ok := err.(*exec.ExitError)
+	if !ok {
+		return false, tempError("Unable to run /bin/sh: %s. (#4.3.0)", err)
+	}
+	ws := ee.Sys().(syscall.WaitStatus)
+	if !ws.Exited() {
+		return false, tempError("Aack, child crashed. (#4.3.0)")
+	}
+	switch ws.ExitStatus() {
+	case 99:
+		return true, nil
+	case 64, 65, 70, 76, 77, 78, 100, 112:
+		return false, permError("Program failed with exit code %d. (#5.2.0)", ws.ExitStatus())
+	}
+	return false, tempError("Program failed with exit code %d. (#4.2.0)", ws.ExitStatus())
+}
+
+// mbox appends the message to an mbox file
+func (d *Delivery) mbox(name string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return tempError("Unable to open mailbox: %s. (#4.2.1)", err)
+	}
+	defer f.Close()
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return tempError("Unable to lock mailbox: %s. (#4.2.1)", err)
+	}
+	pos, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return tempError("Unable to seek mailbox: %s. (#4.2.1)", err)
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(d.ufline() + d.rpline() + d.dtline())
+	msg, err := d.message()
+	if err == nil {
+		r := bufio.NewReader(msg)
+		var line string
+		for {
+			line, err = r.ReadString('\n')
+			if strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+				w.WriteByte('>')
+			}
+			w.WriteString(line)
+			if err != nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			if line != "" {
+				w.WriteByte('\n')
+			}
+			w.WriteByte('\n')
+			err = w.Flush()
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(pos)
+		return tempError("Unable to write mailbox: %s. (#4.2.1)", err)
+	}
+	return nil
+}
+
+// forward sends the message to addresses through qmail-queue, with the
+// Delivered-To line so that loops are detected
+func (d *Delivery) forward(addresses []string) error {
+	msg, err := d.message()
+	if err != nil {
+		return tempError("Unable to rewind message. (#4.3.0)")
+	}
+	q, err := qmailqueue.Open()
+	if err != nil {
+		return tempError("Unable to fork: %s. (#4.3.0)", err)
+	}
+	if _, err = io.Copy(q, io.MultiReader(strings.NewReader(d.dtline()), msg)); err != nil {
+		q.Abort()
+		return tempError("Unable to forward message: %s. (#4.3.0)", err)
+	}
+	if err = q.Close(d.newSender, addresses); err != nil {
+		return tempError("Unable to forward message: %s", err)
+	}
+	d.Forwards += len(addresses)
+	d.logf("qp %d", q.Pid())
+	return nil
+}
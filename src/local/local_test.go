@@ -0,0 +1,191 @@
+package local
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+const testMessage = "X-QB-UUID: 1234\nFrom: joe@example.net\nSubject: test\nX-Spam-Score: 7.5\n\nFrom here\nbye\n"
+
+// setup returns a delivery of testMessage to joe, with home in a
+// temporary directory
+func setup(t *testing.T, files map[string]string) (*Delivery, func()) {
+	dir, err := ioutil.TempDir("", "local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "control"), 0755)
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	msg, _ := os.Create(filepath.Join(dir, "message"))
+	msg.WriteString(testMessage)
+	old := control.QmailHome
+	control.QmailHome = dir
+	d := &Delivery{
+		User:    "joe",
+		Home:    dir,
+		Local:   "joe",
+		Host:    "example.com",
+		Sender:  "bob@example.net",
+		Message: msg,
+		Out:     &bytes.Buffer{},
+	}
+	return d, func() {
+		control.QmailHome = old
+		msg.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestFindDotQmail(t *testing.T) {
+	d, cleanup := setup(t, map[string]string{".qmail-list-default": "", ".qmail-a:b": ""})
+	defer cleanup()
+	for ext, want := range map[string][2]string{
+		"":             {"", ""},
+		"list-golang":  {".qmail-list-default", "golang"},
+		"List-Go-Nuts": {".qmail-list-default", "go-nuts"},
+		"a.b":          {".qmail-a:b", ""},
+		"other":        {"", ""},
+	} {
+		name, def, err := FindDotQmail(d.Home, "-", ext)
+		if name != want[0] || def != want[1] || err != nil {
+			t.Errorf("FindDotQmail(%s): got %s, %s, %v, want %s, %s", ext, name, def, err, want[0], want[1])
+		}
+	}
+}
+
+func TestMaildir(t *testing.T) {
+	d, cleanup := setup(t, map[string]string{
+		".qmail":                     "./Maildir/\n",
+		"Maildir/tmp/.keep":          "",
+		"Maildir/new/.keep":          "",
+		"Maildir/cur/.keep":          "",
+		"Maildir/qb-rules":           "# spam\nscore;X-Spam-Score;5;Spam\n",
+		"Maildir/maildirsize":        "1000S\n100 1\n",
+		"control/localrules":         "match;Subject;*;All\n",
+		"Maildir/cur/1.M1P1.h,S=100": "",
+	})
+	defer cleanup()
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	names, _ := readNames(filepath.Join(d.Home, "Maildir/.Spam/new"))
+	if len(names) != 1 || d.Files != 1 || d.UUID != "1234" {
+		t.Fatalf("got %v, %d files, uuid %s", names, d.Files, d.UUID)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(d.Home, "Maildir/.Spam/new", names[0]))
+	want := "Return-Path: <bob@example.net>\nDelivered-To: joe@example.com\n" + testMessage
+	if string(b) != want {
+		t.Errorf("got %q, want %q", b, want)
+	}
+	if !strings.Contains(d.Out.(*bytes.Buffer).String(), "1234:filed in") {
+		t.Errorf("got output %q", d.Out)
+	}
+	q, _ := readQuota(filepath.Join(d.Home, "Maildir"))
+	if q.usedCount != 2 || q.usedBytes != 100+int64(len(want)) {
+		t.Errorf("got quota %+v", q)
+	}
+
+	// over quota
+	ioutil.WriteFile(filepath.Join(d.Home, "Maildir/maildirsize"), []byte("1000S\n950 1\n"), 0644)
+	if err, ok := d.Run().(*Error); !ok || err.Permanent || !strings.Contains(err.Msg, "over quota") {
+		t.Errorf("over quota: got %v", err)
+	}
+}
+
+func TestMbox(t *testing.T) {
+	d, cleanup := setup(t, map[string]string{".qmail-box": "./mbox\n"})
+	defer cleanup()
+	d.Dash, d.Ext = "-", "box"
+	d.Sender = ""
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadFile(filepath.Join(d.Home, "mbox"))
+	lines := strings.SplitN(string(b), "\n", 2)
+	want := "Return-Path: <>\nDelivered-To: joe@example.com\n" + strings.Replace(testMessage, "\nFrom here", "\n>From here", 1) + "\n"
+	if !strings.HasPrefix(lines[0], "From MAILER-DAEMON ") || lines[1] != want {
+		t.Errorf("got %q", b)
+	}
+}
+
+func TestProgram(t *testing.T) {
+	d, cleanup := setup(t, map[string]string{
+		".qmail-default": "|cat > out; echo \"$SENDER $DEFAULT $EXT2 $HOST2 $QB_UUID\" > env\n|exit 99\n./mbox\n",
+	})
+	defer cleanup()
+	d.Dash, d.Ext = "-", "x-y"
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(d.Home, "out")); string(b) != testMessage {
+		t.Errorf("got message %q", b)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(d.Home, "env")); string(b) != "bob@example.net x-y y example 1234\n" {
+		t.Errorf("got environment %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(d.Home, "mbox")); err == nil || d.Programs != 2 {
+		t.Errorf("delivered after exit 99")
+	}
+
+	ioutil.WriteFile(filepath.Join(d.Home, ".qmail-default"), []byte("|exit 100\n"), 0644)
+	if err, ok := d.Run().(*Error); !ok || !err.Permanent {
+		t.Errorf("exit 100: got %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(d.Home, ".qmail-default"), []byte("|exit 1\n"), 0644)
+	if err, ok := d.Run().(*Error); !ok || err.Permanent {
+		t.Errorf("exit 1: got %v", err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	d, cleanup := setup(t, map[string]string{
+		".qmail-fw":       "&alice@example.org\nbob@example.org\n",
+		".qmail-fw-owner": "",
+		"fake-queue":      "#!/bin/sh\ncat > queued\ncat <&1 > envelope\n",
+	})
+	defer cleanup()
+	os.Chmod(filepath.Join(d.Home, "fake-queue"), 0755)
+	os.Setenv("QMAILQUEUE", filepath.Join(d.Home, "fake-queue"))
+	defer os.Unsetenv("QMAILQUEUE")
+	d.Dash, d.Ext = "-", "fw"
+	d.Local = "joe-fw"
+	wd, _ := os.Getwd()
+	os.Chdir(d.Home)
+	defer os.Chdir(wd)
+	if err := d.Run(); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(d.Home, "queued")); string(b) != "Delivered-To: joe-fw@example.com\n"+testMessage {
+		t.Errorf("got message %q", b)
+	}
+	if b, _ := ioutil.ReadFile(filepath.Join(d.Home, "envelope")); string(b) != "Fjoe-fw-owner@example.com\x00Talice@example.org\x00Tbob@example.org\x00\x00" {
+		t.Errorf("got envelope %q", b)
+	}
+	if d.Forwards != 2 {
+		t.Errorf("got %d forwards", d.Forwards)
+	}
+}
+
+func TestReject(t *testing.T) {
+	d, cleanup := setup(t, map[string]string{".qmail": "./mbox\n"})
+	defer cleanup()
+	d.Dash, d.Ext = "-", "unknown"
+	if err, ok := d.Run().(*Error); !ok || !err.Permanent || !strings.Contains(err.Msg, "#5.1.1") {
+		t.Errorf("no mailbox: got %v", err)
+	}
+	d.Dash, d.Ext = "", ""
+	d.Message.Seek(0, 0)
+	d.Message.WriteString("Delivered-To: joe@example.com\n" + testMessage)
+	if err, ok := d.Run().(*Error); !ok || !err.Permanent || !strings.Contains(err.Msg, "#5.4.6") {
+		t.Errorf("loop: got %v", err)
+	}
+}
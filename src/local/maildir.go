@@ -0,0 +1,283 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package local
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Maildir++ quotas (http://www.courier-mta.org/imap/README.maildirquota.html)
+const (
+	maxSizeFile = 5120             // maildirsize is recalculated above
+	staleSize   = 15 * time.Minute // maildirsize is recalculated if over quota and older
+)
+
+// quota is the maildirsize file of a maildir
+type quota struct {
+	def          string // "10000000S,1000C"
+	bytes, count int64  // limits, 0 : none
+	usedBytes    int64
+	usedCount    int64
+}
+
+// parseQuota parses a quota definition
+func parseQuota(def string) *quota {
+	q := &quota{def: def}
+	for _, f := range strings.Split(def, ",") {
+		if len(f) < 2 {
+			continue
+		}
+		n, err := strconv.ParseInt(f[:len(f)-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch f[len(f)-1] {
+		case 'S':
+			q.bytes = n
+		case 'C':
+			q.count = n
+		}
+	}
+	return q
+}
+
+// over tells if a message of size bytes would exceed the quota
+func (q *quota) over(size int64) bool {
+	return (q.bytes > 0 && q.usedBytes+size > q.bytes) || (q.count > 0 && q.usedCount+1 > q.count)
+}
+
+// readQuota reads the maildirsize file of root, nil if there is none
+func readQuota(root string) (*quota, error) {
+	f, err := os.Open(filepath.Join(root, "maildirsize"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		return nil, s.Err()
+	}
+	q := parseQuota(s.Text())
+	for s.Scan() {
+		var b, c int64
+		if _, err := fmt.Sscan(s.Text(), &b, &c); err == nil {
+			q.usedBytes += b
+			q.usedCount += c
+		}
+	}
+	if err = s.Err(); err != nil {
+		return nil, err
+	}
+	if fi.Size() >= maxSizeFile || (q.over(0) && time.Since(fi.ModTime()) > staleSize) {
+		err = q.recalculate(root)
+	}
+	return q, err
+}
+
+// messageSize returns the size of a maildir message, from its ",S=" name
+// if it has one
+func messageSize(dir, name string) int64 {
+	if i := strings.Index(name, ",S="); i >= 0 {
+		n := name[i+3:]
+		if j := strings.IndexAny(n, ",:"); j >= 0 {
+			n = n[:j]
+		}
+		if size, err := strconv.ParseInt(n, 10, 64); err == nil {
+			return size
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dir, name)); err == nil {
+		return fi.Size()
+	}
+	return 0
+}
+
+// recalculate counts the messages of root and its folders and rewrites
+// maildirsize
+func (q *quota) recalculate(root string) error {
+	q.usedBytes, q.usedCount = 0, 0
+	folders := []string{root}
+	fis, err := ioutil.ReadDir(root)
+	if err != nil {
+		return err
+	}
+	for _, fi := range fis {
+		if fi.IsDir() && strings.HasPrefix(fi.Name(), ".") && fi.Name() != "." && fi.Name() != ".." {
+			folders = append(folders, filepath.Join(root, fi.Name()))
+		}
+	}
+	for _, folder := range folders {
+		for _, sub := range []string{"new", "cur"} {
+			dir := filepath.Join(folder, sub)
+			names, err := readNames(dir)
+			if err != nil {
+				continue
+			}
+			for _, n := range names {
+				q.usedBytes += messageSize(dir, n)
+				q.usedCount++
+			}
+		}
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(root, "tmp"), "maildirsize")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(tmp, "%s\n%d %d\n", q.def, q.usedBytes, q.usedCount)
+	if err = tmp.Close(); err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(root, "maildirsize"))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func readNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
+
+// add records a delivered message in maildirsize, in one write
+func (q *quota) add(root string, size int64) error {
+	f, err := os.OpenFile(filepath.Join(root, "maildirsize"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d 1\n", size)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// hostname is the host part of maildir file names, "/" and ":" escaped
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil {
+		h = "localhost"
+	}
+	return strings.NewReplacer("/", `\057`, ":", `\072`).Replace(h)
+}
+
+// makeFolder creates a Maildir++ folder if it doesn't exist
+func makeFolder(dir string) error {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "maildirfolder"), os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// maildir delivers the message in the maildir root, or in the folder a
+// rule chooses
+func (d *Delivery) maildir(root string) error {
+	root = filepath.Clean(root)
+	dir := root
+	folder, err := d.folder(root)
+	if err != nil {
+		return tempError("Unable to read maildir rules: %s. (#4.3.0)", err)
+	}
+	if folder != "" {
+		dir = filepath.Join(root, "."+folder)
+		if err = makeFolder(dir); err != nil {
+			return tempError("Unable to create maildir folder %s: %s. (#4.2.1)", folder, err)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(dir, "tmp")); err != nil {
+		return tempError("Unable to chdir to maildir. (#4.2.1)")
+	}
+
+	prefix := d.rpline() + d.dtline()
+	size := int64(len(prefix)) + d.size
+	q, err := readQuota(root)
+	if err != nil {
+		return tempError("Unable to read maildirsize: %s. (#4.3.0)", err)
+	}
+	if q != nil && q.over(size) {
+		return tempError("Sorry, the mailbox is over quota. (#4.2.2)")
+	}
+
+	var f *os.File
+	var name string
+	for i := 0; i < 3 && f == nil; i++ {
+		now := time.Now()
+		name = fmt.Sprintf("%d.M%dP%d.%s,S=%d", now.Unix(), now.Nanosecond()/1000, os.Getpid(), hostname(), size)
+		f, err = os.OpenFile(filepath.Join(dir, "tmp", name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	}
+	if f == nil {
+		return tempError("Unable to open tmp/ file: %s. (#4.3.0)", err)
+	}
+	tmp := f.Name()
+	w := bufio.NewWriter(f)
+	w.WriteString(prefix)
+	msg, err := d.message()
+	if err == nil {
+		if _, err = io.Copy(w, msg); err == nil {
+			err = w.Flush()
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return tempError("Temporary error on maildir delivery: %s. (#4.3.0)", err)
+	}
+	err = os.Link(tmp, filepath.Join(dir, "new", name))
+	os.Remove(tmp)
+	if err != nil {
+		return tempError("Unable to link tmp/ file to new/. (#4.3.0)")
+	}
+	if q != nil {
+		// the message is delivered, maildirsize will be recalculated
+		q.add(root, size)
+	}
+	if folder != "" {
+		d.logf("filed in %s/.%s/", root, folder)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package local
+
+import (
+	"bufio"
+	"fmt"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+// rule files a message in a maildir folder. Rules are lines of qb-rules
+// in the maildir, or of control/localrules for all maildirs :
+//
+//	# match;header;pattern;folder
+//	match;List-Id;*<golang-nuts.googlegroups.com>;Lists.golang
+//	# score;header;threshold;folder
+//	score;X-Spam-Score;5;Spam
+//
+// match compares the header field with a pattern ("*" and "?" wildcards,
+// case is ignored), score compares the first number of the field with
+// the threshold. The first matching rule wins.
+type rule struct {
+	header    string
+	pattern   *regexp.Regexp // match
+	threshold float64        // score
+	folder    string
+}
+
+var numberRe = regexp.MustCompile(`-?[0-9]+(\.[0-9]+)?`)
+
+// glob returns the regexp of a wildcard pattern
+func glob(pattern string) *regexp.Regexp {
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, `\*`, ".*", -1)
+	re = strings.Replace(re, `\?`, ".", -1)
+	return regexp.MustCompile("(?is)^" + re + "$")
+}
+
+// validFolder tells if a folder name stays in its maildir
+func validFolder(f string) bool {
+	if f == "" || strings.ContainsAny(f, "/\x00") {
+		return false
+	}
+	for _, p := range strings.Split(f, ".") {
+		if p == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// readRules reads a rules file, nil if it doesn't exist
+func readRules(file string) ([]rule, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var rules []rule
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || l[0] == '#' {
+			continue
+		}
+		t := strings.Split(l, ";")
+		if len(t) != 4 || t[1] == "" || !validFolder(t[3]) {
+			return nil, fmt.Errorf("bad rule %s", l)
+		}
+		r := rule{header: t[1], folder: t[3]}
+		switch t[0] {
+		case "match":
+			r.pattern = glob(t[2])
+		case "score":
+			if r.threshold, err = strconv.ParseFloat(t[2], 64); err != nil {
+				return nil, fmt.Errorf("bad rule %s", l)
+			}
+		default:
+			return nil, fmt.Errorf("bad rule %s", l)
+		}
+		rules = append(rules, r)
+	}
+	return rules, s.Err()
+}
+
+// matches tells if a header field value matches r
+func (r *rule) matches(v string) bool {
+	if r.pattern != nil {
+		return r.pattern.MatchString(v)
+	}
+	n, err := strconv.ParseFloat(numberRe.FindString(v), 64)
+	return err == nil && n >= r.threshold
+}
+
+// folder returns the folder where the rules of the maildir root file the
+// message, "" for the maildir itself
+func (d *Delivery) folder(root string) (string, error) {
+	rules, err := readRules(filepath.Join(root, "qb-rules"))
+	if err == nil && rules == nil {
+		rules, err = readRules(control.Path("control/localrules"))
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, r := range rules {
+		for _, v := range d.header[textproto.CanonicalMIMEHeaderKey(r.header)] {
+			if r.matches(v) {
+				return r.folder, nil
+			}
+		}
+	}
+	return "", nil
+}
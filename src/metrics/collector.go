@@ -0,0 +1,197 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets are the upper bounds (seconds) of the phase latency histograms
+var Buckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// family is a metric and its values by label set
+type family struct {
+	name   string
+	help   string
+	labels []string
+	values map[string]float64 // encoded label values -> value
+}
+
+func newFamily(name, help string, labels ...string) *family {
+	return &family{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (f *family) add(v float64, labelValues ...string) {
+	f.values[strings.Join(labelValues, "\x00")] += v
+}
+
+// labelEscaper escapes label values as the exposition format does
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// quote returns a quoted label value
+func quote(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+// labelString returns {l1="v1",l2="v2"} for encoded label values
+func (f *family) labelString(key string, extra ...string) string {
+	var pairs []string
+	if len(f.labels) > 0 {
+		for i, v := range strings.Split(key, "\x00") {
+			pairs = append(pairs, fmt.Sprintf("%s=%s", f.labels[i], quote(v)))
+		}
+	}
+	pairs = append(pairs, extra...)
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (f *family) keys() []string {
+	keys := make([]string, 0, len(f.values))
+	for k := range f.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// histogram is a latency histogram by phase
+type histogram struct {
+	counts map[string][]uint64 // phase -> count per bucket
+	sums   map[string]float64
+	totals map[string]uint64
+}
+
+// Collector aggregates events
+type Collector struct {
+	sync.Mutex
+	deliveries     *family
+	recipients     *family
+	replies        *family
+	attempts       *family
+	connectFailure *family
+	tls            *family
+	authFailures   *family
+	phases         histogram
+}
+
+// NewCollector returns an empty Collector
+func NewCollector() *Collector {
+	return &Collector{
+		deliveries:     newFamily("qmail_remote_deliveries_total", "Messages by route and final status (K, Z, D).", "route", "result"),
+		recipients:     newFamily("qmail_remote_recipients_total", "Recipients by route and final status (r, h, s).", "route", "result"),
+		replies:        newFamily("qmail_remote_smtp_replies_total", "SMTP reply codes received from remote hosts.", "code"),
+		attempts:       newFamily("qmail_remote_attempts_total", "Delivery attempts by route and remote IP.", "route", "remote_ip"),
+		connectFailure: newFamily("qmail_remote_connect_failures_total", "Failed connections by local IP.", "local_ip"),
+		tls:            newFamily("qmail_remote_tls_sessions_total", "Sessions by TLS version (none if STARTTLS was not used).", "version"),
+		authFailures:   newFamily("qmail_remote_auth_failures_total", "SMTP AUTH failures by route.", "route"),
+		phases: histogram{
+			counts: make(map[string][]uint64),
+			sums:   make(map[string]float64),
+			totals: make(map[string]uint64),
+		},
+	}
+}
+
+// Add accounts ev
+func (c *Collector) Add(ev *Event) {
+	c.Lock()
+	defer c.Unlock()
+	if ev.Final {
+		c.deliveries.add(1, ev.Route, ev.Status)
+		for _, r := range ev.Recipients {
+			if r.Status != "" {
+				c.recipients.add(1, ev.Route, r.Status)
+			}
+		}
+		return
+	}
+	c.attempts.add(1, ev.Route, ev.RemoteIP)
+	if !ev.Connected {
+		c.connectFailure.add(1, ev.LocalIP)
+		return
+	}
+	if ev.TLS != nil {
+		c.tls.add(1, ev.TLS.Version)
+	} else {
+		c.tls.add(1, "none")
+	}
+	if ev.AuthFailed {
+		c.authFailures.add(1, ev.Route)
+	}
+	if ev.Code != 0 {
+		c.replies.add(1, strconv.Itoa(ev.Code))
+	}
+	for _, r := range ev.Recipients {
+		if r.Code != 0 {
+			c.replies.add(1, strconv.Itoa(r.Code))
+		}
+	}
+	for phase, d := range ev.Phases {
+		if _, ok := c.phases.counts[phase]; !ok {
+			c.phases.counts[phase] = make([]uint64, len(Buckets))
+		}
+		for i, le := range Buckets {
+			if d <= le {
+				c.phases.counts[phase][i]++
+			}
+		}
+		c.phases.sums[phase] += d
+		c.phases.totals[phase]++
+	}
+}
+
+// WriteTo writes all metrics to w in the Prometheus text format
+func (c *Collector) WriteTo(w io.Writer) (n int64, err error) {
+	c.Lock()
+	defer c.Unlock()
+	var b strings.Builder
+	for _, f := range []*family{c.deliveries, c.recipients, c.replies, c.attempts, c.connectFailure, c.tls, c.authFailures} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s counter\n", f.name, f.help, f.name)
+		for _, k := range f.keys() {
+			fmt.Fprintf(&b, "%s%s %s\n", f.name, f.labelString(k), strconv.FormatFloat(f.values[k], 'g', -1, 64))
+		}
+	}
+
+	name := "qmail_remote_phase_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time spent in each SMTP phase.\n# TYPE %s histogram\n", name, name)
+	phases := make([]string, 0, len(c.phases.counts))
+	for phase := range c.phases.counts {
+		phases = append(phases, phase)
+	}
+	sort.Strings(phases)
+	for _, phase := range phases {
+		p := quote(phase)
+		for i, le := range Buckets {
+			fmt.Fprintf(&b, "%s_bucket{phase=%s,le=\"%s\"} %d\n", name, p, strconv.FormatFloat(le, 'g', -1, 64), c.phases.counts[phase][i])
+		}
+		fmt.Fprintf(&b, "%s_bucket{phase=%s,le=\"+Inf\"} %d\n", name, p, c.phases.totals[phase])
+		fmt.Fprintf(&b, "%s_sum{phase=%s} %s\n", name, p, strconv.FormatFloat(c.phases.sums[phase], 'g', -1, 64))
+		fmt.Fprintf(&b, "%s_count{phase=%s} %d\n", name, p, c.phases.totals[phase])
+	}
+	written, err := io.WriteString(w, b.String())
+	return int64(written), err
+}
@@ -0,0 +1,60 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/toorop/qmail-boosters/src/deliverylog"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector()
+	c.Add(&Event{Record: deliverylog.Record{Route: "r1", LocalIP: "1.1.1.1", RemoteIP: "2.2.2.2"}})
+	c.Add(&Event{
+		Record: deliverylog.Record{
+			Route:      "r1",
+			RemoteIP:   "3.3.3.3",
+			Status:     "K",
+			Code:       250,
+			Recipients: []deliverylog.Recipient{{Address: "a@b.c", Status: "r", Code: 250}, {Address: "d@b.c", Status: "h", Code: 550}},
+			TLS:        &deliverylog.TLS{Version: "TLS 1.3"},
+			Phases:     map[string]float64{"MAIL": 0.02},
+		},
+		Connected: true,
+	})
+	c.Add(&Event{
+		Record: deliverylog.Record{
+			Route:      "r1",
+			Status:     "K",
+			Recipients: []deliverylog.Recipient{{Address: "a@b.c", Status: "r"}, {Address: "d@b.c", Status: "h"}},
+		},
+		Final: true,
+	})
+	// no attempt connected
+	c.Add(&Event{Record: deliverylog.Record{Route: "r1", LocalIP: "1.1.1.1", RemoteIP: "2.2.2.2"}})
+	c.Add(&Event{Record: deliverylog.Record{Route: "r1", Status: "Z", Recipients: []deliverylog.Recipient{{Address: "a@b.c"}}}, Final: true})
+	// no attempt at all
+	c.Add(&Event{Record: deliverylog.Record{Route: "we\\ird \"route\"\n", Status: "Z"}, Final: true})
+	var b bytes.Buffer
+	c.WriteTo(&b)
+	for _, want := range []string{
+		`qmail_remote_deliveries_total{route="r1",result="K"} 1`,
+		`qmail_remote_recipients_total{route="r1",result="h"} 1`,
+		`qmail_remote_recipients_total{route="r1",result="r"} 1`,
+		`qmail_remote_smtp_replies_total{code="250"} 2`,
+		`qmail_remote_smtp_replies_total{code="550"} 1`,
+		`qmail_remote_deliveries_total{route="r1",result="Z"} 1`,
+		`qmail_remote_deliveries_total{route="we\\ird \"route\"\n",result="Z"} 1`,
+		`qmail_remote_connect_failures_total{local_ip="1.1.1.1"} 2`,
+		`qmail_remote_attempts_total{route="r1",remote_ip="2.2.2.2"} 2`,
+		`qmail_remote_tls_sessions_total{version="TLS 1.3"} 1`,
+		`qmail_remote_phase_duration_seconds_bucket{phase="MAIL",le="0.01"} 0`,
+		`qmail_remote_phase_duration_seconds_bucket{phase="MAIL",le="0.025"} 1`,
+		`qmail_remote_phase_duration_seconds_count{phase="MAIL"} 1`,
+	} {
+		if !strings.Contains(b.String(), want+"\n") {
+			t.Errorf("missing %q in:\n%s", want, b.String())
+		}
+	}
+}
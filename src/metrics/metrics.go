@@ -0,0 +1,73 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package metrics carries delivery events from qmail-remote processes to
+// the qmail-boosters-metrics collector, which aggregates them and exposes
+// them in the Prometheus text format.
+//
+// Each qmail-remote process sends one JSON datagram per delivery attempt on
+// an Unix datagram socket, then one for the delivery as a whole.
+package metrics
+
+import (
+	"encoding/json"
+	"net"
+
+	"github.com/toorop/qmail-boosters/src/deliverylog"
+)
+
+// Event is a delivery attempt as seen by the collector
+type Event struct {
+	deliverylog.Record
+	// Connected is false if the connection (or greeting) failed
+	Connected bool `json:"connected"`
+	// Final is true for the event of the delivery as a whole, sent after
+	// its attempts, with the status sent to qmail-rspawn
+	Final bool `json:"final"`
+	// AuthFailed is true if the remote host refused our credentials
+	AuthFailed bool `json:"auth_failed"`
+}
+
+// Sender sends events to the collector
+type Sender struct {
+	conn net.Conn
+}
+
+// Dial returns a Sender for the collector listening on socket
+func Dial(socket string) (*Sender, error) {
+	conn, err := net.Dial("unixgram", socket)
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{conn}, nil
+}
+
+// Send sends ev as a single datagram
+func (s *Sender) Send(ev *Event) error {
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.Write(b)
+	return err
+}
+
+// Close closes the socket
+func (s *Sender) Close() error {
+	return s.conn.Close()
+}
@@ -0,0 +1,565 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package milter is the MTA side of the Sendmail milter protocol
+// (version 6, as in libmilter's mfdef.h) : a message is sent to a filter
+// which tells whether to accept, reject or modify it.
+package milter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const version = 6
+
+// Actions we apply (SMFIF_*)
+const (
+	actAddHeaders    = 0x01
+	actChangeHeaders = 0x10
+)
+
+// Protocol flags (SMFIP_*) : steps the filter doesn't want (no*) and
+// steps it doesn't reply to (nr*)
+const (
+	noConnect    = 0x1
+	noHelo       = 0x2
+	noMail       = 0x4
+	noRcpt       = 0x8
+	noBody       = 0x10
+	noHeaders    = 0x20
+	noEOH        = 0x40
+	nrHeader     = 0x80
+	noUnknown    = 0x100
+	noData       = 0x200
+	skip         = 0x400
+	nrConnect    = 0x1000
+	nrHelo       = 0x2000
+	nrMail       = 0x4000
+	nrRcpt       = 0x8000
+	nrData       = 0x10000
+	nrUnknown    = 0x20000
+	nrEOH        = 0x40000
+	nrBody       = 0x80000
+	leadingSpace = 0x100000
+
+	// all but SMFIP_RCPT_REJ, we only send accepted recipients
+	offered = 0x1ff7ff
+)
+
+// flags of the steps : not sent, not replied
+var stepFlags = map[byte][2]uint32{
+	'C': {noConnect, nrConnect},
+	'H': {noHelo, nrHelo},
+	'M': {noMail, nrMail},
+	'R': {noRcpt, nrRcpt},
+	'T': {noData, nrData},
+	'L': {noHeaders, nrHeader},
+	'N': {noEOH, nrEOH},
+	'B': {noBody, nrBody},
+}
+
+// chunkSize is the max size of a body chunk (MILTER_CHUNK_SIZE)
+const chunkSize = 65535
+
+// maxPacket is the max size of a packet we read
+const maxPacket = 1 << 20
+
+// Action is the verdict of a filter
+type Action int
+
+// Actions
+const (
+	Continue Action = iota
+	Accept          // no more checks by this filter
+	Reject
+	TempFail
+	Discard
+)
+
+// Result is the verdict of a filter, with its SMTP reply if it gave one
+// (ex: "554 5.7.1 Spam message rejected")
+type Result struct {
+	Action Action
+	Reply  string
+}
+
+// Refusal is a recipient refused by a filter at RCPT
+type Refusal struct {
+	Recipient string
+	Result
+}
+
+// Message is a message and its SMTP session
+type Message struct {
+	Me         string // j macro
+	QueueID    string // i macro
+	Host       string // name of the client, "[ip]" if unknown
+	IP         net.IP // nil if it didn't come from the network
+	Port       int
+	Helo       string
+	Sender     string
+	Recipients []string
+	Header     []Field
+	Refused    []Refusal // recipients refused by Check, removed from Recipients
+}
+
+// Client is a connection to a filter
+type Client struct {
+	conn     net.Conn
+	r        *bufio.Reader
+	timeout  time.Duration
+	protocol uint32 // negotiated flags
+	skipBody bool   // the filter replied skip to a body chunk
+}
+
+// Dial connects to the filter at addr, given as in sendmail.cf :
+// "unix:/path", "inet:port@host" or "inet6:port@host"
+func Dial(addr string, timeout time.Duration) (*Client, error) {
+	network, address := "unix", addr
+	if i := strings.IndexByte(addr, ':'); i >= 0 {
+		network, address = addr[:i], addr[i+1:]
+	}
+	switch network {
+	case "unix", "local":
+		network = "unix"
+	case "inet", "inet6":
+		i := strings.IndexByte(address, '@')
+		if i < 0 {
+			return nil, fmt.Errorf("bad milter address %s", addr)
+		}
+		if network == "inet" {
+			network = "tcp4"
+		} else {
+			network = "tcp6"
+		}
+		address = net.JoinHostPort(address[i+1:], address[:i])
+	default:
+		return nil, fmt.Errorf("bad milter address %s", addr)
+	}
+	conn, err := net.DialTimeout(network, address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{conn: conn, r: bufio.NewReader(conn), timeout: timeout}
+	if err = c.negotiate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close ends the session
+func (c *Client) Close() error {
+	c.send('Q', nil)
+	return c.conn.Close()
+}
+
+func (c *Client) send(cmd byte, data []byte) error {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	b := make([]byte, 5, 5+len(data))
+	binary.BigEndian.PutUint32(b, uint32(len(data)+1))
+	b[4] = cmd
+	_, err := c.conn.Write(append(b, data...))
+	return err
+}
+
+func (c *Client) read() (byte, []byte, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	var h [4]byte
+	if _, err := io.ReadFull(c.r, h[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(h[:])
+	if n == 0 || n > maxPacket {
+		return 0, nil, fmt.Errorf("bad packet length %d", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return 0, nil, err
+	}
+	return b[0], b[1:], nil
+}
+
+// negotiate agrees on the protocol (SMFIC_OPTNEG)
+func (c *Client) negotiate() error {
+	b := make([]byte, 12)
+	binary.BigEndian.PutUint32(b, version)
+	binary.BigEndian.PutUint32(b[4:], actAddHeaders|actChangeHeaders)
+	binary.BigEndian.PutUint32(b[8:], offered)
+	if err := c.send('O', b); err != nil {
+		return err
+	}
+	cmd, b, err := c.read()
+	if err != nil {
+		return err
+	}
+	if cmd != 'O' || len(b) < 12 {
+		return fmt.Errorf("unexpected reply %q to option negotiation", cmd)
+	}
+	v := binary.BigEndian.Uint32(b)
+	if v < 2 {
+		return fmt.Errorf("unsupported milter protocol version %d", v)
+	}
+	c.protocol = binary.BigEndian.Uint32(b[8:]) & offered
+	if v < 4 {
+		// no DATA before version 4
+		c.protocol |= noData
+	}
+	return nil
+}
+
+// strs returns NUL terminated strings
+func strs(s ...string) []byte {
+	var b []byte
+	for _, v := range s {
+		b = append(append(b, v...), 0)
+	}
+	return b
+}
+
+// step sends a command and its macros and returns the reply of the
+// filter, Continue if the filter doesn't want the command or doesn't
+// reply to it
+func (c *Client) step(cmd byte, data []byte, macros ...string) (Result, error) {
+	f := stepFlags[cmd]
+	if c.protocol&f[0] != 0 {
+		return Result{}, nil
+	}
+	if len(macros) > 0 {
+		if err := c.send('D', append([]byte{cmd}, strs(macros...)...)); err != nil {
+			return Result{}, err
+		}
+	}
+	if err := c.send(cmd, data); err != nil {
+		return Result{}, err
+	}
+	if c.protocol&f[1] != 0 {
+		return Result{}, nil
+	}
+	return c.reply(cmd, nil)
+}
+
+// reply reads the reply of the filter to cmd. Header changes are applied
+// to header, at the end of the message only.
+func (c *Client) reply(cmd byte, header *[]Field) (Result, error) {
+	for {
+		code, b, err := c.read()
+		if err != nil {
+			return Result{}, err
+		}
+		switch code {
+		case 'p': // progress
+			continue
+		case 'c':
+			return Result{Action: Continue}, nil
+		case 'a':
+			return Result{Action: Accept}, nil
+		case 'r':
+			return Result{Action: Reject}, nil
+		case 't':
+			return Result{Action: TempFail}, nil
+		case 'd':
+			return Result{Action: Discard}, nil
+		case 'y':
+			text := strings.TrimRight(string(b), "\x00")
+			if strings.HasPrefix(text, "4") {
+				return Result{TempFail, text}, nil
+			}
+			return Result{Reject, text}, nil
+		case 's':
+			if cmd == 'B' {
+				c.skipBody = true
+				return Result{Action: Continue}, nil
+			}
+		case 'h', 'i', 'm':
+			if header != nil {
+				if err = c.modify(code, b, header); err != nil {
+					return Result{}, err
+				}
+				continue
+			}
+		}
+		return Result{}, fmt.Errorf("unexpected reply %q to %q", code, cmd)
+	}
+}
+
+var errModification = errors.New("bad header modification")
+
+// modify applies an add header, insert header or change header request
+func (c *Client) modify(code byte, b []byte, header *[]Field) error {
+	index := 0
+	if code != 'h' {
+		if len(b) < 4 {
+			return errModification
+		}
+		index = int(binary.BigEndian.Uint32(b))
+		b = b[4:]
+	}
+	t := strings.SplitN(string(b), "\x00", 3)
+	if len(t) < 3 || t[0] == "" {
+		return errModification
+	}
+	f := Field{Name: t[0], Value: strings.Replace(t[1], "\r\n", "\n", -1)}
+	if c.protocol&leadingSpace == 0 {
+		f.Value = " " + f.Value
+	}
+	h := *header
+	switch code {
+	case 'h':
+		h = append(h, f)
+	case 'i':
+		if index > len(h) {
+			index = len(h)
+		}
+		h = append(h[:index], append([]Field{f}, h[index:]...)...)
+	case 'm':
+		// index is the occurrence of the name, from 1
+		n := 0
+		i := 0
+		for ; i < len(h); i++ {
+			if strings.EqualFold(h[i].Name, f.Name) {
+				if n++; n == index {
+					break
+				}
+			}
+		}
+		switch {
+		case i < len(h) && strings.TrimSpace(t[1]) == "":
+			h = append(h[:i], h[i+1:]...)
+		case i < len(h):
+			h[i].Value = f.Value
+		case strings.TrimSpace(t[1]) != "":
+			h = append(h, f)
+		}
+	}
+	*header = h
+	return nil
+}
+
+// Check sends m to the filter, with its body read from body (lines
+// ending with LF). Header changes are applied to m.Header if the result
+// is Continue or Accept. Recipients refused at RCPT are moved from
+// m.Recipients to m.Refused.
+func (c *Client) Check(m *Message, body io.Reader) (Result, error) {
+	// connection
+	data := strs(m.Host)
+	macros := []string{"j", m.Me, "{daemon_name}", m.Me, "{client_name}", m.Host}
+	if m.IP == nil {
+		data = append(data, 'U')
+	} else {
+		family := byte('4')
+		if m.IP.To4() == nil {
+			family = '6'
+		}
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(m.Port))
+		data = append(append(data, family), port[:]...)
+		data = append(data, strs(m.IP.String())...)
+		macros = append(macros, "{client_addr}", m.IP.String(), "_", m.Host+" ["+m.IP.String()+"]")
+	}
+	if res, err := c.step('C', data, macros...); err != nil || res.Action != Continue {
+		return res, err
+	}
+	if m.Helo != "" {
+		if res, err := c.step('H', strs(m.Helo)); err != nil || res.Action != Continue {
+			return res, err
+		}
+	}
+
+	// envelope
+	res, err := c.step('M', strs("<"+m.Sender+">"), "i", m.QueueID, "{mail_addr}", m.Sender)
+	if err != nil || res.Action != Continue {
+		return res, err
+	}
+	// a refusal at RCPT only concerns the recipient, the message is
+	// refused if none is left (TempFail if one was deferred)
+	var kept []string
+	var refused Result
+	for _, r := range m.Recipients {
+		if res, err = c.step('R', strs("<"+r+">"), "{rcpt_addr}", r); err != nil {
+			return res, err
+		}
+		switch res.Action {
+		case Continue:
+			kept = append(kept, r)
+		case Reject, TempFail:
+			m.Refused = append(m.Refused, Refusal{r, res})
+			if refused.Action != TempFail {
+				refused = res
+			}
+		default:
+			return res, err
+		}
+	}
+	if kept == nil {
+		return refused, nil
+	}
+	m.Recipients = kept
+	if res, err = c.step('T', nil); err != nil || res.Action != Continue {
+		return res, err
+	}
+
+	// header
+	for _, f := range m.Header {
+		v := f.Value
+		if c.protocol&leadingSpace == 0 {
+			v = strings.TrimLeft(v, " \t")
+		}
+		if res, err = c.step('L', strs(f.Name, v)); err != nil || res.Action != Continue {
+			return res, err
+		}
+	}
+	if res, err = c.step('N', nil); err != nil || res.Action != Continue {
+		return res, err
+	}
+
+	// body, with CRLF line endings
+	if c.protocol&noBody == 0 {
+		r := &crlfReader{r: bufio.NewReader(body)}
+		chunk := make([]byte, chunkSize)
+		for !c.skipBody {
+			n, err := io.ReadFull(r, chunk)
+			if n > 0 {
+				if res, err := c.step('B', chunk[:n]); err != nil || res.Action != Continue {
+					return res, err
+				}
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				return Result{}, err
+			}
+		}
+	}
+
+	// end of message, header changes come before the verdict
+	if err = c.send('E', nil); err != nil {
+		return Result{}, err
+	}
+	header := append([]Field(nil), m.Header...)
+	if res, err = c.reply('E', &header); err == nil && (res.Action == Continue || res.Action == Accept) {
+		m.Header = header
+	}
+	return res, err
+}
+
+// crlfReader turns LF line endings into CRLF
+type crlfReader struct {
+	r  *bufio.Reader
+	lf bool // a LF is pending
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if c.lf {
+			p[n] = '\n'
+			n++
+			c.lf = false
+			continue
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, err
+		}
+		if b == '\n' {
+			p[n] = '\r'
+			c.lf = true
+		} else {
+			p[n] = b
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Field is a header field. Value is what follows the colon, continuation
+// lines included ("\n\t...") but not the final LF.
+type Field struct {
+	Name, Value string
+}
+
+// ReadHeader reads the header section of a message and returns its
+// fields and its size, the empty line after it included
+func ReadHeader(r *bufio.Reader) (header []Field, size int64, err error) {
+	for {
+		l, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		if l == "" {
+			return header, size, nil
+		}
+		if (l[0] == ' ' || l[0] == '\t') && len(header) > 0 {
+			header[len(header)-1].Value += "\n" + strings.TrimSuffix(l, "\n")
+			size += int64(len(l))
+			continue
+		}
+		i := strings.IndexByte(l, ':')
+		if l == "\n" {
+			size++
+		}
+		if i <= 0 || strings.ContainsAny(l[:i], " \t") {
+			// end of header section, or a body without empty line
+			return header, size, nil
+		}
+		header = append(header, Field{l[:i], strings.TrimSuffix(l[i+1:], "\n")})
+		size += int64(len(l))
+		if err == io.EOF {
+			return header, size, nil
+		}
+	}
+}
+
+// WriteHeader writes header fields, lines ending with LF
+func WriteHeader(w io.Writer, header []Field) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range header {
+		bw.WriteString(f.Name + ":" + f.Value + "\n")
+	}
+	return bw.Flush()
+}
+
+// String returns the name of a, for logs
+func (a Action) String() string {
+	switch a {
+	case Continue:
+		return "continue"
+	case Accept:
+		return "accept"
+	case Reject:
+		return "reject"
+	case TempFail:
+		return "tempfail"
+	case Discard:
+		return "discard"
+	}
+	return strconv.Itoa(int(a))
+}
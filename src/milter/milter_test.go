@@ -0,0 +1,210 @@
+package milter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type packet struct {
+	cmd  byte
+	data string
+}
+
+// fakeMilter accepts a connection on a unix socket, negotiates protocol
+// and answers commands with replies[cmd], "c" if there is none. RCPT
+// commands get one packet each, in order. Received packets are sent on
+// the returned channel.
+func fakeMilter(t *testing.T, protocol uint32, replies map[byte][]packet) (addr string, received chan []packet, cleanup func()) {
+	dir, err := ioutil.TempDir("", "milter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received = make(chan []packet, 1)
+	go func() {
+		var got []packet
+		defer func() { received <- got }()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		rcpt := 0
+		write := func(p packet) {
+			b := make([]byte, 5)
+			binary.BigEndian.PutUint32(b, uint32(len(p.data)+1))
+			b[4] = p.cmd
+			conn.Write(append(b, p.data...))
+		}
+		for {
+			var h [4]byte
+			if _, err := io.ReadFull(r, h[:]); err != nil {
+				return
+			}
+			b := make([]byte, binary.BigEndian.Uint32(h[:]))
+			if _, err := io.ReadFull(r, b); err != nil {
+				return
+			}
+			p := packet{b[0], string(b[1:])}
+			got = append(got, p)
+			switch {
+			case p.cmd == 'O':
+				o := make([]byte, 12)
+				binary.BigEndian.PutUint32(o, 6)
+				binary.BigEndian.PutUint32(o[4:], actAddHeaders|actChangeHeaders)
+				binary.BigEndian.PutUint32(o[8:], protocol)
+				write(packet{'O', string(o)})
+			case p.cmd == 'D' || p.cmd == 'Q':
+			case p.cmd == 'R' && replies['R'] != nil:
+				if rcpt < len(replies['R']) {
+					write(replies['R'][rcpt])
+				} else {
+					write(packet{'c', ""})
+				}
+				rcpt++
+			case replies[p.cmd] != nil:
+				for _, rp := range replies[p.cmd] {
+					write(rp)
+				}
+			case stepFlags[p.cmd][1]&protocol == 0:
+				write(packet{'c', ""})
+			}
+		}
+	}()
+	return "unix:" + sock, received, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func newMessage() *Message {
+	header, _, _ := ReadHeader(bufio.NewReader(strings.NewReader("Received: from client (192.0.2.1)\n  by mx; date\nSubject: test\n\nbody\n")))
+	return &Message{
+		Me:         "mx.example.com",
+		QueueID:    "uuid",
+		Host:       "client.example.org",
+		IP:         net.ParseIP("192.0.2.1"),
+		Port:       4242,
+		Helo:       "client",
+		Sender:     "a@example.org",
+		Recipients: []string{"b@example.com", "c@example.com"},
+		Header:     header,
+	}
+}
+
+func index(i int) string {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(i))
+	return string(b)
+}
+
+func TestCheck(t *testing.T) {
+	addr, received, cleanup := fakeMilter(t, nrHeader|noHelo, map[byte][]packet{
+		'E': {
+			{'p', ""},
+			{'h', "X-Spam\x00yes\x00"},
+			{'m', index(1) + "Subject\x00[SPAM] test\x00"},
+			{'i', index(0) + "X-First\x00one\n\ttwo\x00"},
+			{'m', index(1) + "Received\x00\x00"},
+			{'a', ""},
+		},
+	})
+	defer cleanup()
+	c, err := Dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMessage()
+	res, err := c.Check(m, strings.NewReader("line 1\nline 2\n"))
+	c.Close()
+	if err != nil || res.Action != Accept {
+		t.Fatalf("got %v %v", res, err)
+	}
+	want := []Field{{"X-First", " one\n\ttwo"}, {"Subject", " [SPAM] test"}, {"X-Spam", " yes"}}
+	if !reflect.DeepEqual(m.Header, want) {
+		t.Errorf("got header %q", m.Header)
+	}
+
+	var cmds []string
+	for _, p := range <-received {
+		switch p.cmd {
+		case 'O', 'D':
+			cmds = append(cmds, string(p.cmd))
+		case 'C':
+			cmds = append(cmds, "C"+strings.Replace(p.data, "\x00", "|", -1))
+		default:
+			cmds = append(cmds, string(p.cmd)+p.data)
+		}
+	}
+	wantCmds := []string{
+		"O", "D", "Cclient.example.org|4\x10\x92192.0.2.1|",
+		"D", "M<a@example.org>\x00", "D", "R<b@example.com>\x00", "D", "R<c@example.com>\x00", "T",
+		"LReceived\x00from client (192.0.2.1)\n  by mx; date\x00", "LSubject\x00test\x00", "N",
+		"Bline 1\r\nline 2\r\n", "E", "Q",
+	}
+	if !reflect.DeepEqual(cmds, wantCmds) {
+		t.Errorf("got commands\n%q\nwant\n%q", cmds, wantCmds)
+	}
+}
+
+func TestReject(t *testing.T) {
+	// only the recipient is refused
+	addr, _, cleanup := fakeMilter(t, 0, map[byte][]packet{
+		'R': {{'y', "451 4.7.1 try later\x00"}},
+	})
+	defer cleanup()
+	c, err := Dial(addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMessage()
+	res, err := c.Check(m, strings.NewReader("body\n"))
+	c.Close()
+	if err != nil || res.Action != Continue {
+		t.Errorf("got %v %v", res, err)
+	}
+	if !reflect.DeepEqual(m.Recipients, []string{"c@example.com"}) || !reflect.DeepEqual(m.Refused, []Refusal{{"b@example.com", Result{TempFail, "451 4.7.1 try later"}}}) {
+		t.Errorf("got recipients %q, refused %v", m.Recipients, m.Refused)
+	}
+
+	// the message if no recipient is left, deferred if one is
+	addr, _, cleanup = fakeMilter(t, 0, map[byte][]packet{
+		'R': {{'y', "451 4.7.1 try later\x00"}, {'r', ""}},
+	})
+	defer cleanup()
+	if c, err = Dial(addr, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	m = newMessage()
+	if res, err = c.Check(m, strings.NewReader("body\n")); err != nil || res != (Result{TempFail, "451 4.7.1 try later"}) {
+		t.Errorf("got %v %v", res, err)
+	}
+}
+
+func TestReadHeader(t *testing.T) {
+	msg := "A: 1\n  2\nB:3\n\nbody\n"
+	h, size, err := ReadHeader(bufio.NewReader(strings.NewReader(msg)))
+	if err != nil || size != int64(len(msg)-len("body\n")) || !reflect.DeepEqual(h, []Field{{"A", " 1\n  2"}, {"B", "3"}}) {
+		t.Errorf("got %q %d %v", h, size, err)
+	}
+	// no empty line
+	h, size, _ = ReadHeader(bufio.NewReader(strings.NewReader("A: 1\nbody line\n")))
+	if size != 5 || len(h) != 1 {
+		t.Errorf("got %q %d", h, size)
+	}
+}
@@ -0,0 +1,50 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package policy decides whether a message received by SMTP is queued :
+// SPF, DNS black and white lists, greylisting.
+package policy
+
+import (
+	"net"
+)
+
+// Resolver is the DNS, replaced by tests
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupAddr(addr string) ([]string, error)
+}
+
+// DNS is the system resolver
+var DNS Resolver = netResolver{}
+
+type netResolver struct{}
+
+func (netResolver) LookupTXT(name string) ([]string, error)  { return net.LookupTXT(name) }
+func (netResolver) LookupIP(host string) ([]net.IP, error)   { return net.LookupIP(host) }
+func (netResolver) LookupMX(name string) ([]*net.MX, error)  { return net.LookupMX(name) }
+func (netResolver) LookupAddr(addr string) ([]string, error) { return net.LookupAddr(addr) }
+
+// notFound tells if err means the name or the records don't exist, as
+// opposed to a temporary failure
+func notFound(err error) bool {
+	e, ok := err.(*net.DNSError)
+	return ok && e.IsNotFound
+}
@@ -0,0 +1,110 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// reverse returns the DNS list name of ip : 4.3.2.1 for 1.2.3.4, nibbles
+// for IPv6 (RFC 5782 section 2)
+func reverse(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return strconv.Itoa(int(ip4[3])) + "." + strconv.Itoa(int(ip4[2])) + "." + strconv.Itoa(int(ip4[1])) + "." + strconv.Itoa(int(ip4[0]))
+	}
+	ip = ip.To16()
+	nibbles := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		nibbles = append(nibbles, strconv.FormatInt(int64(ip[i]&15), 16), strconv.FormatInt(int64(ip[i]>>4), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// Zone is a DNS list and the answers which mean listed
+type Zone struct {
+	Name   string
+	Answer *net.IPNet // nil : 127.0.0.0/8
+}
+
+// ParseZone parses a line of control/dnsbl or control/dnswl : the zone,
+// then optionally ";" and the accepted answer (127.0.0.2) or network
+// (127.0.0.0/24)
+func ParseZone(line string) (Zone, error) {
+	t := strings.SplitN(line, ";", 2)
+	z := Zone{Name: strings.TrimSpace(t[0])}
+	if z.Name == "" {
+		return z, fmt.Errorf("bad zone %s", line)
+	}
+	if len(t) == 1 || strings.TrimSpace(t[1]) == "" {
+		return z, nil
+	}
+	a := strings.TrimSpace(t[1])
+	if !strings.Contains(a, "/") {
+		a += "/32"
+	}
+	_, n, err := net.ParseCIDR(a)
+	if err != nil || n.IP.To4() == nil {
+		return z, fmt.Errorf("bad zone %s", line)
+	}
+	z.Answer = n
+	return z, nil
+}
+
+// refused are the answers of lists refusing the query (Spamhaus through
+// public resolvers...), not listings
+var refused = &net.IPNet{IP: net.IPv4(127, 255, 255, 0).To4(), Mask: net.CIDRMask(24, 32)}
+
+// accepts tells if answer a means listed
+func (z *Zone) accepts(a net.IP) bool {
+	if z.Answer != nil {
+		return z.Answer.Contains(a)
+	}
+	return a[0] == 127
+}
+
+// Listed returns the first of zones listing ip and the answer of the
+// zone (127.0.0.x). Answers not accepted by the zone are ignored, as are
+// failing zones if none lists ip : err is then the last failure. Refused
+// queries (127.255.255.x) are failures.
+func Listed(r Resolver, ip net.IP, zones []Zone) (zone string, answer net.IP, err error) {
+	name := reverse(ip)
+	for _, z := range zones {
+		ips, e := r.LookupIP(name + "." + z.Name)
+		if e != nil {
+			if !notFound(e) {
+				err = e
+			}
+			continue
+		}
+		for _, a := range ips {
+			a4 := a.To4()
+			switch {
+			case a4 == nil:
+			case refused.Contains(a4):
+				err = fmt.Errorf("%s refused the query (%s)", z.Name, a4)
+			case z.accepts(a4):
+				return z.Name, a4, nil
+			}
+		}
+	}
+	return "", nil, err
+}
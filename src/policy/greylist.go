@@ -0,0 +1,212 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package policy
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Greylist delays the first message of each (network, sender, recipient)
+// triplet : legitimate servers retry, most spam engines don't.
+// Triplets are files of Dir (one per triplet, named after its hash) so
+// that concurrent qmail-queue runs don't need a lock. The modification
+// time of a file is the last time its triplet was seen.
+type Greylist struct {
+	Dir      string
+	Delay    time.Duration // before a retry is accepted
+	Expire   time.Duration // after which a triplet not retried is forgotten
+	Lifetime time.Duration // after which a passed triplet not seen is forgotten
+
+	now func() time.Time
+}
+
+// NewGreylist returns a Greylist storing triplets in dir, with the usual
+// delays : 5 minutes, 4 hours, 36 days
+func NewGreylist(dir string) *Greylist {
+	return &Greylist{
+		Dir:      dir,
+		Delay:    5 * time.Minute,
+		Expire:   4 * time.Hour,
+		Lifetime: 36 * 24 * time.Hour,
+		now:      time.Now,
+	}
+}
+
+// network returns the /24 (IPv4) or /64 (IPv6) of ip : pools of servers
+// retry from another address of the same network
+func network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// path returns the file of a triplet
+func (g *Greylist) path(ip net.IP, sender, recipient string) string {
+	h := sha1.Sum([]byte(network(ip) + "\x00" + strings.ToLower(sender) + "\x00" + strings.ToLower(recipient)))
+	k := hex.EncodeToString(h[:])
+	return filepath.Join(g.Dir, k[:2], k)
+}
+
+// write records a triplet seen first at first, passed or not
+func (g *Greylist) write(path string, first time.Time, passed bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%d %t\n", first.Unix(), passed)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		now := g.now()
+		if err = os.Chtimes(f.Name(), now, now); err == nil {
+			err = os.Rename(f.Name(), path)
+		}
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// Check records the triplet and tells if the message may be accepted
+func (g *Greylist) Check(ip net.IP, sender, recipient string) (bool, error) {
+	path := g.path(ip, sender, recipient)
+	now := g.now()
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, g.write(path, now, false)
+	}
+	if err != nil {
+		return false, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var first int64
+	var passed bool
+	if _, err = fmt.Sscanf(string(b), "%d %t", &first, &passed); err != nil {
+		// damaged, start again
+		return false, g.write(path, now, false)
+	}
+	age := now.Sub(time.Unix(first, 0))
+	switch {
+	case passed && now.Sub(fi.ModTime()) > g.Lifetime, !passed && age > g.Expire:
+		return false, g.write(path, now, false)
+	case passed:
+		return true, os.Chtimes(path, now, now)
+	case age < g.Delay:
+		return false, nil
+	}
+	return true, g.write(path, time.Unix(first, 0), true)
+}
+
+// PurgeEvery is the minimum interval between two purges by MaybePurge
+const PurgeEvery = time.Hour
+
+// forgotten tells if the triplet file path, last modified at mtime, is
+// forgotten : passed and not seen for Lifetime, or not retried in Expire.
+// Files not passed are modified only when their triplet is first seen.
+func (g *Greylist) forgotten(path string, mtime time.Time) bool {
+	age := g.now().Sub(mtime)
+	if age > g.Lifetime {
+		return true
+	}
+	if age <= g.Expire {
+		return false
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	var first int64
+	var passed bool
+	if _, err = fmt.Sscanf(string(b), "%d %t", &first, &passed); err != nil {
+		return true
+	}
+	return !passed
+}
+
+// Purge removes the files of forgotten triplets, and temporary files left
+// behind, and returns their number
+func (g *Greylist) Purge() (int, error) {
+	n := 0
+	err := filepath.Walk(g.Dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if fi.IsDir() || filepath.Dir(path) == filepath.Clean(g.Dir) {
+			return nil
+		}
+		tmp := strings.HasPrefix(fi.Name(), ".tmp") && g.now().Sub(fi.ModTime()) > g.Expire
+		if !tmp && !g.forgotten(path, fi.ModTime()) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// MaybePurge purges the forgotten triplets if the last purge is older than
+// PurgeEvery. The modification time of Dir/.purge is the time of the last
+// purge.
+func (g *Greylist) MaybePurge() error {
+	mark := filepath.Join(g.Dir, ".purge")
+	now := g.now()
+	fi, err := os.Stat(mark)
+	switch {
+	case err == nil && now.Sub(fi.ModTime()) < PurgeEvery:
+		return nil
+	case os.IsNotExist(err):
+		if err = os.MkdirAll(g.Dir, 0755); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(mark, nil, 0644); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+	// mark first : concurrent runs skip the purge
+	if err = os.Chtimes(mark, now, now); err != nil {
+		return err
+	}
+	_, err = g.Purge()
+	return err
+}
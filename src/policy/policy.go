@@ -0,0 +1,228 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package policy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+// Verdict tells what to do with a message
+type Verdict int
+
+// Verdicts
+const (
+	Accept Verdict = iota
+	TempFail
+	PermFail
+)
+
+// Message is the client and envelope of a message
+type Message struct {
+	IP         net.IP
+	Helo       string
+	Sender     string
+	Recipients []string
+}
+
+// Decision is the outcome of Check
+type Decision struct {
+	Verdict Verdict
+	Reason  string // why the message is rejected or whitelisted
+	SPF     SPFResult
+	Header  string  // Received-SPF and Authentication-Results fields
+	Errors  []error // lookups or greylist failures, ignored
+}
+
+// Policy is the configuration of the checks
+type Policy struct {
+	Me        string
+	SPFReject map[SPFResult]bool
+	DNSBL     []Zone
+	DNSWL     []Zone
+	Greylist  *Greylist // nil : no greylisting
+	Resolver  Resolver
+}
+
+// readOptional returns the lines of a control file, none if it doesn't
+// exist
+func readOptional(file string) ([]string, error) {
+	lines, err := control.ReadLines(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return lines, err
+}
+
+// readZones returns the zones of an optional control file
+func readZones(file string) ([]Zone, error) {
+	lines, err := readOptional(file)
+	if err != nil {
+		return nil, err
+	}
+	var zones []Zone
+	for _, l := range lines {
+		z, err := ParseZone(l)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+		zones = append(zones, z)
+	}
+	return zones, nil
+}
+
+// Load returns the policy defined in control files
+func Load() (*Policy, error) {
+	p := &Policy{SPFReject: make(map[SPFResult]bool), Resolver: DNS}
+	var err error
+	if p.Me, err = control.ReadFirstLine("control/me", "localhost"); err != nil {
+		return nil, err
+	}
+	spf, err := readOptional("control/spfreject")
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range spf {
+		p.SPFReject[SPFResult(strings.ToLower(r))] = true
+	}
+	if p.DNSBL, err = readZones("control/dnsbl"); err != nil {
+		return nil, err
+	}
+	if p.DNSWL, err = readZones("control/dnswl"); err != nil {
+		return nil, err
+	}
+	// delay;expire;lifetime in seconds
+	grey, err := control.ReadLines("control/greylist")
+	if os.IsNotExist(err) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.Greylist = NewGreylist(control.Path("greylist"))
+	if len(grey) > 0 {
+		durations := []*time.Duration{&p.Greylist.Delay, &p.Greylist.Expire, &p.Greylist.Lifetime}
+		for i, f := range strings.Split(grey[0], ";") {
+			if i == len(durations) || f == "" {
+				continue
+			}
+			n, err := strconv.Atoi(f)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("bad control/greylist: %s", grey[0])
+			}
+			*durations[i] = time.Duration(n) * time.Second
+		}
+	}
+	return p, nil
+}
+
+// spfComment explains a SPF result (RFC 7208 section 9.1)
+func spfComment(res SPFResult, identity, ip string) string {
+	switch res {
+	case SPFPass:
+		return "domain of " + identity + " designates " + ip + " as permitted sender"
+	case SPFFail:
+		return "domain of " + identity + " does not designate " + ip + " as permitted sender"
+	case SPFSoftFail:
+		return "transitioning domain of " + identity + " does not designate " + ip + " as permitted sender"
+	case SPFNeutral:
+		return ip + " is neither permitted nor denied by domain of " + identity
+	case SPFNone:
+		return "domain of " + identity + " does not designate permitted sender hosts"
+	case SPFTempError:
+		return "error in processing during lookup of " + identity
+	}
+	return "domain of " + identity + " has a malformed SPF record"
+}
+
+// header returns the Received-SPF and Authentication-Results fields
+func (p *Policy) header(m *Message, res SPFResult, wl string, wlAnswer net.IP) string {
+	ip := m.IP.String()
+	kind, identity := "mailfrom", m.Sender
+	if identity == "" {
+		kind, identity = "helo", m.Helo
+	}
+	var h strings.Builder
+	fmt.Fprintf(&h, "Received-SPF: %s (%s: %s)\n\tclient-ip=%s; envelope-from=\"%s\"; helo=%s; identity=%s;\n", res, p.Me, spfComment(res, identity, ip), ip, m.Sender, m.Helo, kind)
+	fmt.Fprintf(&h, "Authentication-Results: %s;\n\tspf=%s smtp.%s=%s", p.Me, res, kind, identity)
+	if wl != "" {
+		fmt.Fprintf(&h, ";\n\tdnswl=pass dns.zone=%s policy.ip=%s", wl, wlAnswer)
+	}
+	h.WriteString("\n")
+	return h.String()
+}
+
+// Check applies the policy to m. Hosts listed by a DNSWL zone are
+// trusted, others are rejected if their SPF result is in SPFReject
+// (temporarily for temperror), if a DNSBL zone lists them or if a
+// recipient is greylisted.
+func (p *Policy) Check(m *Message) Decision {
+	var d Decision
+	d.SPF = CheckSPF(p.Resolver, m.IP, m.Helo, m.Sender)
+	wl, wlAnswer, err := Listed(p.Resolver, m.IP, p.DNSWL)
+	if err != nil {
+		d.Errors = append(d.Errors, fmt.Errorf("dnswl: %s", err))
+	}
+	d.Header = p.header(m, d.SPF, wl, wlAnswer)
+	if wl != "" {
+		d.Reason = "whitelisted by " + wl
+		return d
+	}
+	if p.SPFReject[d.SPF] {
+		d.Verdict, d.Reason = PermFail, "SPF "+string(d.SPF)
+		if d.SPF == SPFTempError {
+			d.Verdict = TempFail
+		}
+		return d
+	}
+	bl, _, err := Listed(p.Resolver, m.IP, p.DNSBL)
+	if err != nil {
+		d.Errors = append(d.Errors, fmt.Errorf("dnsbl: %s", err))
+	}
+	if bl != "" {
+		d.Verdict, d.Reason = PermFail, "listed by "+bl
+		return d
+	}
+	if p.Greylist == nil {
+		return d
+	}
+	// every triplet is recorded, the message waits for the last one
+	greylisted := false
+	if err := p.Greylist.MaybePurge(); err != nil {
+		d.Errors = append(d.Errors, fmt.Errorf("greylist purge: %s", err))
+	}
+	for _, r := range m.Recipients {
+		ok, err := p.Greylist.Check(m.IP, m.Sender, r)
+		if err != nil {
+			d.Errors = append(d.Errors, fmt.Errorf("greylist: %s", err))
+			continue
+		}
+		greylisted = greylisted || !ok
+	}
+	if greylisted {
+		d.Verdict, d.Reason = TempFail, "greylisted"
+	}
+	return d
+}
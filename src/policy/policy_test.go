@@ -0,0 +1,292 @@
+package policy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeDNS answers from maps, names in fail give a temporary failure
+type fakeDNS struct {
+	txt  map[string][]string
+	ip   map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	fail map[string]bool
+}
+
+func (f *fakeDNS) answer(m map[string][]string, name string) ([]string, error) {
+	if f.fail[name] {
+		return nil, &net.DNSError{Err: "timeout", Name: name, IsTemporary: true}
+	}
+	if a, ok := m[name]; ok {
+		return a, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (f *fakeDNS) LookupTXT(name string) ([]string, error) { return f.answer(f.txt, name) }
+
+func (f *fakeDNS) LookupIP(host string) ([]net.IP, error) {
+	a, err := f.answer(f.ip, host)
+	var ips []net.IP
+	for _, s := range a {
+		ips = append(ips, net.ParseIP(s))
+	}
+	return ips, err
+}
+
+func (f *fakeDNS) LookupMX(name string) ([]*net.MX, error) {
+	a, err := f.answer(f.mx, name)
+	var mxs []*net.MX
+	for _, s := range a {
+		mxs = append(mxs, &net.MX{Host: s})
+	}
+	return mxs, err
+}
+
+func (f *fakeDNS) LookupAddr(addr string) ([]string, error) { return f.answer(f.ptr, addr) }
+
+var dns = &fakeDNS{
+	txt: map[string][]string{
+		"example.org":      {"v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 include:_spf.example.org mx:example.net/28 -all"},
+		"_spf.example.org": {"v=spf1 a:relay.example.org ~all"},
+		"soft.example":     {"some other record", "v=spf1 ~all"},
+		"redirect.example": {"v=spf1 redirect=example.org"},
+		"macro.example":    {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} ptr -all"},
+		"two.example":      {"v=spf1 -all", "v=spf1 +all"},
+		"bad.example":      {"v=spf1 foo:bar -all"},
+		"loop.example":     {"v=spf1 include:loop.example -all"},
+		"temp.example":     {"v=spf1 include:down.example -all"},
+		"helo.example":     {"v=spf1 a -all"},
+		"neutral.example":  {"v=spf1 ?ip4:192.0.2.1"},
+		"example.net":      {"v=spf1 mx -all"},
+	},
+	ip: map[string][]string{
+		"relay.example.org":                {"198.51.100.7"},
+		"mx.example.net":                   {"203.0.113.17"},
+		"helo.example":                     {"192.0.2.1"},
+		"9.2.0.192.joe._spf.macro.example": {"127.0.0.2"},
+		"host.macro.example":               {"192.0.2.10"},
+		"1.2.0.192.dnsbl.example":          {"127.0.0.2"},
+		"2.2.0.192.dnsbl.example":          {"198.51.100.1"},
+		"4.2.0.192.dnsbl.example":          {"127.255.255.254"},
+		"5.2.0.192.dnsbl.example":          {"127.0.0.10"},
+		"3.2.0.192.dnswl.example":          {"127.0.10.0"},
+	},
+	mx:   map[string][]string{"example.net": {"mx.example.net"}},
+	ptr:  map[string][]string{"192.0.2.10": {"host.macro.example."}},
+	fail: map[string]bool{"down.example": true},
+}
+
+func TestSPF(t *testing.T) {
+	for _, tc := range []struct {
+		ip, helo, sender string
+		want             SPFResult
+	}{
+		{"192.0.2.1", "h", "a@example.org", SPFPass},
+		{"2001:db8::1", "h", "a@example.org", SPFPass},
+		{"198.51.100.7", "h", "a@example.org", SPFPass},
+		{"203.0.113.30", "h", "a@example.org", SPFPass},
+		{"203.0.113.33", "h", "a@example.org", SPFFail},
+		{"198.51.100.8", "h", "a@Example.org", SPFFail},
+		{"192.0.2.1", "h", "a@soft.example", SPFSoftFail},
+		{"192.0.2.1", "h", "a@nothing.example", SPFNone},
+		{"192.0.2.1", "h", "a@localhost", SPFNone},
+		{"192.0.2.1", "h", "a@redirect.example", SPFPass},
+		{"192.0.2.9", "h", "joe+sales@macro.example", SPFPass},
+		{"192.0.2.9", "h", "bob@macro.example", SPFFail},
+		{"192.0.2.10", "h", "joe@macro.example", SPFPass},
+		{"192.0.2.1", "h", "a@two.example", SPFPermError},
+		{"192.0.2.1", "h", "a@bad.example", SPFPermError},
+		{"192.0.2.1", "h", "a@loop.example", SPFPermError},
+		{"192.0.2.1", "h", "a@temp.example", SPFTempError},
+		{"192.0.2.1", "h", "a@neutral.example", SPFNeutral},
+		{"192.0.2.2", "h", "a@neutral.example", SPFNeutral},
+		{"192.0.2.1", "helo.example", "", SPFPass},
+		{"192.0.2.2", "helo.example", "", SPFFail},
+	} {
+		if got := CheckSPF(dns, net.ParseIP(tc.ip), tc.helo, tc.sender); got != tc.want {
+			t.Errorf("CheckSPF(%s, %s, %s): got %s, want %s", tc.ip, tc.helo, tc.sender, got, tc.want)
+		}
+	}
+}
+
+func TestMacroEscape(t *testing.T) {
+	s := &spf{ip: net.ParseIP("192.0.2.1"), sender: "j d+x=y@example.org"}
+	if v, err := s.macro("L", "example.org"); v != "j%20d%2Bx%3Dy" || err != nil {
+		t.Errorf("got %q %v", v, err)
+	}
+}
+
+func TestParseZone(t *testing.T) {
+	for _, tc := range []struct {
+		line, name, answer string
+	}{
+		{"zen.spamhaus.org", "zen.spamhaus.org", "<nil>"},
+		{"zen.spamhaus.org;127.0.0.2", "zen.spamhaus.org", "127.0.0.2/32"},
+		{" bl.example ; 127.0.0.0/30", "bl.example", "127.0.0.0/30"},
+		{"bl.example;", "bl.example", "<nil>"},
+		{"bl.example;127.0.0", "", ""},
+		{";127.0.0.2", "", ""},
+	} {
+		z, err := ParseZone(tc.line)
+		if tc.name == "" {
+			if err == nil {
+				t.Errorf("%s: no error", tc.line)
+			}
+			continue
+		}
+		if err != nil || z.Name != tc.name || z.Answer.String() != tc.answer {
+			t.Errorf("%s: got %s %s %v", tc.line, z.Name, z.Answer, err)
+		}
+	}
+}
+
+func TestListed(t *testing.T) {
+	zones := []Zone{{Name: "down.example"}, {Name: "dnsbl.example"}}
+	if zone, a, err := Listed(dns, net.ParseIP("192.0.2.1"), zones); zone != "dnsbl.example" || !a.Equal(net.ParseIP("127.0.0.2")) || err != nil {
+		t.Errorf("got %s %s %v", zone, a, err)
+	}
+	// not a 127/8 answer
+	if zone, _, _ := Listed(dns, net.ParseIP("192.0.2.2"), zones); zone != "" {
+		t.Errorf("listed by %s", zone)
+	}
+	// query refused
+	if zone, _, err := Listed(dns, net.ParseIP("192.0.2.4"), zones); zone != "" || err == nil {
+		t.Errorf("refused: got %s %v", zone, err)
+	}
+	// answer not accepted by the zone
+	_, pbl, _ := net.ParseCIDR("127.0.0.10/31")
+	zones = []Zone{{Name: "dnsbl.example", Answer: pbl}}
+	if zone, _, _ := Listed(dns, net.ParseIP("192.0.2.1"), zones); zone != "" {
+		t.Errorf("listed by %s", zone)
+	}
+	if zone, _, err := Listed(dns, net.ParseIP("192.0.2.5"), zones); zone != "dnsbl.example" || err != nil {
+		t.Errorf("accepted answer: got %s %v", zone, err)
+	}
+	if r := reverse(net.ParseIP("2001:db8::1")); r != "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2" {
+		t.Errorf("got reverse %s", r)
+	}
+}
+
+func TestGreylist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "greylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := NewGreylist(dir)
+	now := time.Unix(1400000000, 0)
+	g.now = func() time.Time { return now }
+	ip := net.ParseIP("192.0.2.1")
+	check := func(ip net.IP, want bool) {
+		t.Helper()
+		if ok, err := g.Check(ip, "a@example.org", "b@example.com"); ok != want || err != nil {
+			t.Errorf("at %s: got %t, %v, want %t", now, ok, err, want)
+		}
+	}
+	check(ip, false)
+	now = now.Add(time.Minute)
+	check(ip, false)
+	now = now.Add(5 * time.Minute)
+	// same network
+	check(net.ParseIP("192.0.2.200"), true)
+	check(net.ParseIP("198.51.100.1"), false)
+	now = now.Add(30 * 24 * time.Hour)
+	check(ip, true)
+	now = now.Add(37 * 24 * time.Hour)
+	check(ip, false)
+	// not retried in time
+	now = now.Add(5 * time.Hour)
+	check(ip, false)
+}
+
+func TestGreylistPurge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "greylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g := NewGreylist(dir)
+	g.Delay = 0
+	now := time.Now()
+	g.now = func() time.Time { return now }
+	ip := net.ParseIP("192.0.2.1")
+	g.Check(ip, "a@example.org", "waiting@example.com")
+	g.Check(ip, "a@example.org", "passed@example.com")
+	g.Check(ip, "a@example.org", "passed@example.com")
+	if err = g.MaybePurge(); err != nil {
+		t.Fatal(err)
+	}
+	count := func(want int) {
+		t.Helper()
+		files, _ := filepath.Glob(filepath.Join(dir, "*", "*"))
+		if len(files) != want {
+			t.Errorf("at %s: got %d triplets, want %d", now, len(files), want)
+		}
+	}
+	count(2)
+	// purged less than PurgeEvery ago
+	now = now.Add(5 * time.Hour)
+	os.Chtimes(filepath.Join(dir, ".purge"), now, now)
+	g.MaybePurge()
+	count(2)
+	// the triplet not retried is forgotten, not the passed one
+	now = now.Add(PurgeEvery)
+	g.MaybePurge()
+	count(1)
+	now = now.Add(40 * 24 * time.Hour)
+	if n, err := g.Purge(); n != 1 || err != nil {
+		t.Errorf("got %d, %v", n, err)
+	}
+	count(0)
+}
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "greylist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	p := &Policy{
+		Me:        "mx.example.com",
+		SPFReject: map[SPFResult]bool{SPFFail: true, SPFTempError: true},
+		DNSBL:     []Zone{{Name: "dnsbl.example"}},
+		DNSWL:     []Zone{{Name: "dnswl.example"}},
+		Greylist:  NewGreylist(dir),
+		Resolver:  dns,
+	}
+	m := &Message{IP: net.ParseIP("192.0.2.3"), Helo: "client.example.org", Sender: "a@example.net", Recipients: []string{"b@example.com"}}
+	d := p.Check(m)
+	if d.Verdict != Accept || d.Reason != "whitelisted by dnswl.example" {
+		t.Errorf("whitelisted: got %d %s", d.Verdict, d.Reason)
+	}
+	want := "Received-SPF: fail (mx.example.com: domain of a@example.net does not designate 192.0.2.3 as permitted sender)\n\tclient-ip=192.0.2.3; envelope-from=\"a@example.net\"; helo=client.example.org; identity=mailfrom;\nAuthentication-Results: mx.example.com;\n\tspf=fail smtp.mailfrom=a@example.net;\n\tdnswl=pass dns.zone=dnswl.example policy.ip=127.0.10.0\n"
+	if d.Header != want {
+		t.Errorf("got header\n%s\nwant\n%s", d.Header, want)
+	}
+
+	for _, tc := range []struct {
+		ip, sender string
+		verdict    Verdict
+		reason     string
+	}{
+		{"192.0.2.4", "a@example.net", PermFail, "SPF fail"},
+		{"192.0.2.4", "a@temp.example", TempFail, "SPF temperror"},
+		{"192.0.2.1", "a@example.org", PermFail, "listed by dnsbl.example"},
+		{"192.0.2.4", "a@example.org", TempFail, "greylisted"},
+	} {
+		m.IP, m.Sender = net.ParseIP(tc.ip), tc.sender
+		if d = p.Check(m); d.Verdict != tc.verdict || d.Reason != tc.reason {
+			t.Errorf("%s %s: got %d %s", tc.ip, tc.sender, d.Verdict, d.Reason)
+		}
+	}
+	p.Greylist.Delay = 0
+	if d = p.Check(m); d.Verdict != Accept || d.SPF != SPFPass {
+		t.Errorf("retry: got %d %s", d.Verdict, d.Reason)
+	}
+}
@@ -0,0 +1,465 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SPFResult is the result of a SPF check (RFC 7208 section 2.6)
+type SPFResult string
+
+// SPF results
+const (
+	SPFNone      SPFResult = "none"
+	SPFNeutral   SPFResult = "neutral"
+	SPFPass      SPFResult = "pass"
+	SPFFail      SPFResult = "fail"
+	SPFSoftFail  SPFResult = "softfail"
+	SPFTempError SPFResult = "temperror"
+	SPFPermError SPFResult = "permerror"
+)
+
+// RFC 7208 section 4.6.4
+const (
+	maxLookups     = 10
+	maxVoidLookups = 2
+)
+
+var (
+	errTemp = errors.New("temporary DNS failure")
+	errPerm = errors.New("malformed SPF record")
+)
+
+type spf struct {
+	r       Resolver
+	ip      net.IP
+	helo    string
+	sender  string // local@domain
+	lookups int
+	voids   int
+}
+
+// CheckSPF checks that ip may send mail from sender, or for helo if
+// sender is empty (the null sender of bounces)
+func CheckSPF(r Resolver, ip net.IP, helo, sender string) SPFResult {
+	if sender == "" {
+		sender = "postmaster@" + helo
+	}
+	i := strings.LastIndexByte(sender, '@')
+	if i < 0 {
+		sender = "postmaster@" + sender
+		i = len("postmaster")
+	} else if i == 0 {
+		sender = "postmaster" + sender
+		i = len("postmaster")
+	}
+	s := &spf{r: r, ip: ip, helo: helo, sender: sender}
+	res, _ := s.check(strings.ToLower(sender[i+1:]))
+	return res
+}
+
+// validDomain is the domain check of RFC 7208 section 4.3
+func validDomain(d string) bool {
+	d = strings.TrimSuffix(d, ".")
+	if len(d) == 0 || len(d) > 253 || !strings.Contains(d, ".") {
+		return false
+	}
+	for _, l := range strings.Split(d, ".") {
+		if len(l) == 0 || len(l) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+// record returns the SPF record of domain, "" if there is none
+func (s *spf) record(domain string) (string, SPFResult) {
+	txts, err := s.r.LookupTXT(domain)
+	if err != nil && !notFound(err) {
+		return "", SPFTempError
+	}
+	var rec string
+	for _, t := range txts {
+		if strings.EqualFold(t, "v=spf1") || len(t) > 7 && strings.EqualFold(t[:7], "v=spf1 ") {
+			if rec != "" {
+				return "", SPFPermError
+			}
+			rec = t
+		}
+	}
+	if rec == "" {
+		return "", SPFNone
+	}
+	return rec, ""
+}
+
+var modifierRe = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9_.-]*=`)
+
+// check is the check_host() function
+func (s *spf) check(domain string) (SPFResult, error) {
+	if !validDomain(domain) {
+		return SPFNone, nil
+	}
+	rec, res := s.record(domain)
+	if rec == "" {
+		return res, nil
+	}
+	var redirect string
+	terms := strings.Fields(rec)[1:]
+	// modifiers first, they may be anywhere
+	for _, t := range terms {
+		if modifierRe.MatchString(t) && strings.HasPrefix(strings.ToLower(t), "redirect=") {
+			if redirect != "" {
+				return SPFPermError, errPerm
+			}
+			redirect = t[len("redirect="):]
+		}
+	}
+	for _, t := range terms {
+		if modifierRe.MatchString(t) {
+			continue
+		}
+		q := SPFPass
+		switch t[0] {
+		case '+':
+			t = t[1:]
+		case '-':
+			q, t = SPFFail, t[1:]
+		case '~':
+			q, t = SPFSoftFail, t[1:]
+		case '?':
+			q, t = SPFNeutral, t[1:]
+		}
+		match, err := s.mechanism(domain, t)
+		switch {
+		case err == errTemp:
+			return SPFTempError, err
+		case err != nil:
+			return SPFPermError, err
+		case match:
+			return q, nil
+		}
+	}
+	if redirect == "" {
+		return SPFNeutral, nil
+	}
+	if s.lookups++; s.lookups > maxLookups {
+		return SPFPermError, errPerm
+	}
+	target, err := s.expand(redirect, domain)
+	if err != nil {
+		return SPFPermError, err
+	}
+	if res, err = s.check(target); res == SPFNone {
+		return SPFPermError, errPerm
+	}
+	return res, err
+}
+
+var cidrRe = regexp.MustCompile(`(/(\d+))?(//(\d+))?$`)
+
+// mechanism tells if mechanism t matches
+func (s *spf) mechanism(domain, t string) (bool, error) {
+	name, arg := t, ""
+	if i := strings.IndexAny(t, ":/"); i >= 0 {
+		name, arg = t[:i], t[i:]
+	}
+	name = strings.ToLower(name)
+	switch name {
+	case "all":
+		if arg != "" {
+			return false, errPerm
+		}
+		return true, nil
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return false, errPerm
+		}
+		arg = arg[1:]
+		if !strings.Contains(arg, "/") {
+			if name == "ip4" {
+				arg += "/32"
+			} else {
+				arg += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(arg)
+		if err != nil || (name == "ip4") != (n.IP.To4() != nil) {
+			return false, errPerm
+		}
+		return n.Contains(s.ip), nil
+	case "a", "mx", "ptr", "include", "exists":
+	default:
+		return false, errPerm
+	}
+
+	if s.lookups++; s.lookups > maxLookups {
+		return false, errPerm
+	}
+	// domain-spec and dual-cidr-length
+	m := cidrRe.FindStringSubmatch(arg)
+	arg = arg[:len(arg)-len(m[0])]
+	ones4, ones6 := 32, 128
+	if m[2] != "" {
+		ones4, _ = strconv.Atoi(m[2])
+	}
+	if m[4] != "" {
+		ones6, _ = strconv.Atoi(m[4])
+	}
+	if ones4 > 32 || ones6 > 128 || (m[0] != "" && name != "a" && name != "mx") {
+		return false, errPerm
+	}
+	target := domain
+	if arg != "" {
+		if arg[0] != ':' || len(arg) == 1 {
+			return false, errPerm
+		}
+		var err error
+		if target, err = s.expand(arg[1:], domain); err != nil {
+			return false, err
+		}
+	} else if name == "include" || name == "exists" {
+		return false, errPerm
+	}
+
+	switch name {
+	case "include":
+		switch res, err := s.check(target); res {
+		case SPFPass:
+			return true, nil
+		case SPFTempError:
+			return false, errTemp
+		case SPFPermError, SPFNone:
+			if err == nil {
+				err = errPerm
+			}
+			return false, err
+		}
+		return false, nil
+	case "exists":
+		ips, err := s.lookupIP(target)
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, err
+	case "a":
+		return s.matchHost(target, ones4, ones6)
+	case "mx":
+		mxs, err := s.r.LookupMX(target)
+		if err = s.void(len(mxs), err); err != nil {
+			return false, err
+		}
+		if len(mxs) > maxLookups {
+			return false, errPerm
+		}
+		for _, mx := range mxs {
+			if ok, err := s.matchHost(mx.Host, ones4, ones6); ok || err != nil {
+				return ok, err
+			}
+		}
+		return false, nil
+	}
+	// ptr
+	names, err := s.r.LookupAddr(s.ip.String())
+	if err != nil {
+		return false, nil
+	}
+	target = strings.ToLower(strings.TrimSuffix(target, "."))
+	for i, n := range names {
+		if i == maxLookups {
+			break
+		}
+		n = strings.ToLower(strings.TrimSuffix(n, "."))
+		if n != target && !strings.HasSuffix(n, "."+target) {
+			continue
+		}
+		if ok, _ := s.matchHost(n, 32, 128); ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// void counts lookups without answer
+func (s *spf) void(n int, err error) error {
+	if err != nil && !notFound(err) {
+		return errTemp
+	}
+	if n == 0 {
+		if s.voids++; s.voids > maxVoidLookups {
+			return errPerm
+		}
+	}
+	return nil
+}
+
+func (s *spf) lookupIP(host string) ([]net.IP, error) {
+	ips, err := s.r.LookupIP(host)
+	return ips, s.void(len(ips), err)
+}
+
+// matchHost tells if the address of host is in the network of the ip
+func (s *spf) matchHost(host string, ones4, ones6 int) (bool, error) {
+	ips, err := s.lookupIP(host)
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		mask := net.CIDRMask(ones6, 128)
+		if ip.To4() != nil {
+			ip, mask = ip.To4(), net.CIDRMask(ones4, 32)
+		}
+		if (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).Contains(s.ip) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// expand expands the macros of a domain-spec (RFC 7208 section 7)
+func (s *spf) expand(spec, domain string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			b.WriteByte(spec[i])
+			continue
+		}
+		if i++; i == len(spec) {
+			return "", errPerm
+		}
+		switch spec[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", errPerm
+		}
+		end := strings.IndexByte(spec[i:], '}')
+		if end < 2 {
+			return "", errPerm
+		}
+		macro := spec[i+1 : i+end]
+		i += end
+		v, err := s.macro(macro, domain)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(v)
+	}
+	return b.String(), nil
+}
+
+var macroRe = regexp.MustCompile(`^([slodiphcrtvSLODIPHCRTV])(\d*)(r?)([.+,/_=-]*)$`)
+
+// macro returns the value of a macro ("d", "ir", "l1r-"...)
+func (s *spf) macro(macro, domain string) (string, error) {
+	m := macroRe.FindStringSubmatch(macro)
+	if m == nil {
+		return "", errPerm
+	}
+	at := strings.LastIndexByte(s.sender, '@')
+	var v string
+	switch strings.ToLower(m[1]) {
+	case "s":
+		v = s.sender
+	case "l":
+		v = s.sender[:at]
+	case "o":
+		v = s.sender[at+1:]
+	case "d":
+		v = domain
+	case "i":
+		if ip4 := s.ip.To4(); ip4 != nil {
+			v = ip4.String()
+		} else {
+			nibbles := make([]string, 0, 32)
+			for _, b := range s.ip.To16() {
+				nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&15), 16))
+			}
+			v = strings.Join(nibbles, ".")
+		}
+	case "p":
+		// validating PTR costs lookups, RFC 7208 allows "unknown"
+		v = "unknown"
+	case "v":
+		v = "ip6"
+		if s.ip.To4() != nil {
+			v = "in-addr"
+		}
+	case "h":
+		v = s.helo
+	default:
+		// c, r and t are for exp only
+		return "", errPerm
+	}
+	delims := m[4]
+	if delims == "" {
+		delims = "."
+	}
+	parts := strings.FieldsFunc(v, func(r rune) bool { return strings.ContainsRune(delims, r) })
+	if m[3] == "r" {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if m[2] != "" {
+		n, _ := strconv.Atoi(m[2])
+		if n == 0 {
+			return "", errPerm
+		}
+		if n < len(parts) {
+			parts = parts[len(parts)-n:]
+		}
+	}
+	v = strings.Join(parts, ".")
+	if m[1][0] >= 'A' && m[1][0] <= 'Z' {
+		v = escape(v)
+	}
+	return v, nil
+}
+
+// escape URL-encodes v for an uppercase macro : all but the unreserved
+// characters of RFC 3986, a space is %20 (RFC 7208 section 7.3)
+func escape(v string) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-._~", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
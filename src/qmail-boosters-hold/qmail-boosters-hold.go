@@ -0,0 +1,113 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+
+	SYNOPSIS
+          qmail-boosters-hold list
+          qmail-boosters-hold add [-for duration] [-reason text] name [name ...]
+          qmail-boosters-hold remove name [name ...]
+
+	Holds and releases deliveries to recipient domains or routes without
+	stopping qmail-send : qmail-remote defers held deliveries at once,
+	without connecting. name is a domain, .domain for its subdomains, or
+	route:name for a route of control/routes. Holds are kept in
+	/var/qmail/control/holddomains, -for makes them expire (ex: 2h).
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/hold"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: qmail-boosters-hold list | add [-for duration] [-reason text] name... | remove name...")
+	os.Exit(100)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "qmail-boosters-hold: %s\n", err)
+	os.Exit(111)
+}
+
+func list(now time.Time) {
+	holds, err := hold.Load()
+	if _, ok := err.(hold.BadLines); ok {
+		fmt.Fprintf(os.Stderr, "qmail-boosters-hold: warning: %s\n", err)
+	} else if err != nil {
+		fatal(err)
+	}
+	for _, h := range holds {
+		if h.Expired(now) {
+			continue
+		}
+		until := "-"
+		if !h.Until.IsZero() {
+			until = h.Until.Format("2006-01-02 15:04:05")
+		}
+		fmt.Printf("%s\t%s\t%s\n", h.Name, until, h.Reason)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	now := time.Now()
+	switch os.Args[1] {
+	case "list":
+		list(now)
+	case "add":
+		fs := flag.NewFlagSet("add", flag.ExitOnError)
+		d := fs.Duration("for", 0, "hold duration, none for a hold until removed")
+		reason := fs.String("reason", "", "reason, shown in the deferral message")
+		fs.Parse(os.Args[2:])
+		if fs.NArg() == 0 || *d < 0 {
+			usage()
+		}
+		for _, name := range fs.Args() {
+			h := hold.Hold{Name: name, Reason: *reason}
+			if *d > 0 {
+				h.Until = now.Add(*d)
+			}
+			if err := hold.CheckName(name); err != nil {
+				fatal(err)
+			}
+			if err := hold.Add(h, now); err != nil {
+				fatal(err)
+			}
+		}
+	case "remove":
+		if len(os.Args) < 3 {
+			usage()
+		}
+		for _, name := range os.Args[2:] {
+			found, err := hold.Remove(name, now)
+			if err != nil {
+				fatal(err)
+			}
+			if !found {
+				fmt.Fprintf(os.Stderr, "qmail-boosters-hold: %s is not held\n", name)
+			}
+		}
+	default:
+		usage()
+	}
+}
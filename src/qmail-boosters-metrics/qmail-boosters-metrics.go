@@ -0,0 +1,111 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+	SYNOPSIS
+          qmail-boosters-metrics [-socket path] [-listen addr] [-user qmailr]
+
+	Collects delivery events sent by qmail-remote processes on an Unix
+	datagram socket and exposes them on http://addr/metrics for Prometheus.
+
+	qmail-remote sends its events to the socket named in
+	/var/qmail/control/metricssocket. Only the owner of the socket (qmailr)
+	may send : events are trusted, their labels become series.
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/metrics"
+)
+
+// chown gives file to the user name
+func chown(file, name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	return os.Chown(file, uid, -1)
+}
+
+func main() {
+	socket := flag.String("socket", "/var/run/qmail-boosters/metrics.sock", "Unix datagram socket fed by qmail-remote")
+	listen := flag.String("listen", "127.0.0.1:9366", "HTTP address of the /metrics endpoint")
+	owner := flag.String("user", "qmailr", "owner of the socket, the only user allowed to send events")
+	flag.Parse()
+
+	// remove stale socket
+	os.Remove(*socket)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: *socket, Net: "unixgram"})
+	if err != nil {
+		log.Fatalf("unable to listen on %s: %s", *socket, err)
+	}
+	// qmail-remote runs as qmailr
+	if err = chown(*socket, *owner); err != nil {
+		log.Fatalf("unable to give %s to %s: %s", *socket, *owner, err)
+	}
+	if err = os.Chmod(*socket, 0600); err != nil {
+		log.Fatalf("unable to chmod %s: %s", *socket, err)
+	}
+
+	collector := metrics.NewCollector()
+	go func() {
+		buf := make([]byte, 65536)
+		var delay time.Duration
+		for {
+			n, _, err := conn.ReadFromUnix(buf)
+			if errors.Is(err, net.ErrClosed) {
+				log.Fatalf("read error on %s: %s", *socket, err)
+			}
+			if err != nil {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				log.Printf("read error on %s: %s, retrying in %s", *socket, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			delay = 0
+			var ev metrics.Event
+			if err = json.Unmarshal(buf[:n], &ev); err != nil {
+				log.Printf("bad event: %s", err)
+				continue
+			}
+			collector.Add(&ev)
+		}
+	}()
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		collector.WriteTo(w)
+	})
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
@@ -0,0 +1,213 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+
+	SYNOPSIS
+          QMAILQUEUE=/usr/local/bin/qmail-boosters-milter qmail-smtpd
+          qmail-boosters-milter [qmail-queue [args]]
+
+	qmail-queue wrapper which sends messages to the Sendmail milters
+	(rspamd, clamav-milter, opendkim...) listed in control/milters, one
+	after the other :
+
+		# address;open|closed;timeout in seconds
+		inet:11332@127.0.0.1;closed;60
+		unix:/var/run/clamav/clamav-milter.ctl;open
+
+	A message rejected by a milter makes it exit with the qmail-queue
+	code 31 (permanent) or 71 (temporary), a discarded one isn't queued.
+	A recipient refused at RCPT is removed, the message goes on with the
+	others.
+	Header changes are applied, each milter sees the changes of the
+	previous ones, then the message is given to /var/qmail/bin/qmail-queue.
+
+	When a milter can't be reached or fails, the message goes on without
+	it if it is "open" (default), gets a temporary failure if it is
+	"closed".
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/milter"
+	"github.com/toorop/qmail-boosters/src/qmailqueue"
+	"github.com/toorop/qmail-boosters/src/smtpd"
+)
+
+var logger = log.New(os.Stderr, "qmail-boosters-milter: ", 0)
+
+// die exits with a qmail-queue code
+func die(code int, format string, v ...interface{}) {
+	logger.Printf(format, v...)
+	os.Exit(code)
+}
+
+// filter is a line of control/milters
+type filter struct {
+	addr     string
+	failOpen bool
+	timeout  time.Duration
+}
+
+// readFilters reads control/milters
+func readFilters() ([]filter, error) {
+	lines, err := control.ReadLines("control/milters")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var filters []filter
+	for _, l := range lines {
+		t := strings.Split(l, ";")
+		f := filter{addr: t[0], failOpen: true, timeout: 30 * time.Second}
+		if len(t) > 1 {
+			switch t[1] {
+			case "", "open":
+			case "closed":
+				f.failOpen = false
+			default:
+				return nil, fmt.Errorf("bad milter line %s", l)
+			}
+		}
+		if len(t) > 2 && t[2] != "" {
+			n, err := strconv.Atoi(t[2])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("bad milter line %s", l)
+			}
+			f.timeout = time.Duration(n) * time.Second
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// check sends m to the milter of f
+func check(f filter, m *milter.Message, body io.Reader) (milter.Result, error) {
+	c, err := milter.Dial(f.addr, f.timeout)
+	if err != nil {
+		return milter.Result{}, err
+	}
+	defer c.Close()
+	return c.Check(m, body)
+}
+
+// queue gives the message to qmail-queue and exits with its code
+func queue(msg io.Reader, sender string, recipients []string) {
+	prog, args := control.Path("bin/qmail-queue"), []string(nil)
+	if len(os.Args) > 1 {
+		prog, args = os.Args[1], os.Args[2:]
+	}
+	err := qmailqueue.Pass(msg, sender, recipients, prog, args...)
+	if err != nil {
+		logger.Printf("%s: %s", prog, err)
+	}
+	os.Exit(qmailqueue.ExitCode(err))
+}
+
+// newMessage returns the milter view of a message
+func newMessage(header []milter.Field, sender string, recipients []string) (*milter.Message, error) {
+	me, err := control.ReadFirstLine("control/me", "localhost")
+	if err != nil {
+		return nil, err
+	}
+	m := &milter.Message{Me: me, Sender: sender, Recipients: recipients, Header: header, Host: "localhost"}
+	var b bytes.Buffer
+	milter.WriteHeader(&b, header)
+	m.Helo = smtpd.ReceivedHelo(&b)
+	for _, f := range header {
+		if strings.EqualFold(f.Name, "X-QB-UUID") {
+			m.QueueID = strings.TrimSpace(f.Value)
+			break
+		}
+	}
+	if m.IP = net.ParseIP(os.Getenv("TCPREMOTEIP")); m.IP != nil {
+		m.Host = os.Getenv("TCPREMOTEHOST")
+		if m.Host == "" {
+			m.Host = "[" + m.IP.String() + "]"
+		}
+		m.Port, _ = strconv.Atoi(os.Getenv("TCPREMOTEPORT"))
+	}
+	return m, nil
+}
+
+func main() {
+	msg, sender, recipients, err := qmailqueue.ReadInput()
+	if err != nil {
+		die(qmailqueue.ExitCode(err), "%s", err)
+	}
+	filters, err := readFilters()
+	if err != nil {
+		die(55, "unable to read controls: %s", err)
+	}
+	if len(filters) == 0 {
+		queue(msg, sender, recipients)
+	}
+
+	header, size, err := milter.ReadHeader(bufio.NewReader(msg))
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = msg.Stat()
+	}
+	if err != nil {
+		die(54, "unable to read message: %s", err)
+	}
+	body := func() io.Reader { return io.NewSectionReader(msg, size, fi.Size()-size) }
+	m, err := newMessage(header, sender, recipients)
+	if err != nil {
+		die(55, "unable to read controls: %s", err)
+	}
+	for _, f := range filters {
+		res, err := check(f, m, body())
+		if err != nil {
+			if f.failOpen {
+				logger.Printf("warning: %s: %s", f.addr, err)
+				continue
+			}
+			die(71, "%s: %s", f.addr, err)
+		}
+		for _, r := range m.Refused {
+			logger.Printf("%s: <%s> to <%s> refused %s", f.addr, sender, r.Recipient, r.Reply)
+		}
+		m.Refused = nil
+		switch res.Action {
+		case milter.Reject:
+			die(31, "%s: <%s> rejected %s", f.addr, sender, res.Reply)
+		case milter.TempFail:
+			die(71, "%s: <%s> deferred %s", f.addr, sender, res.Reply)
+		case milter.Discard:
+			logger.Printf("%s: <%s> discarded", f.addr, sender)
+			os.Exit(0)
+		}
+	}
+
+	var b bytes.Buffer
+	milter.WriteHeader(&b, m.Header)
+	b.WriteString("\n")
+	queue(io.MultiReader(&b, body()), sender, m.Recipients)
+}
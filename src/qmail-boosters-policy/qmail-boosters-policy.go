@@ -0,0 +1,100 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+
+	SYNOPSIS
+          QMAILQUEUE=/usr/local/bin/qmail-boosters-policy qmail-smtpd
+          qmail-boosters-policy [qmail-queue [args]]
+
+	qmail-queue wrapper which checks messages received by SMTP : SPF of
+	the sender, DNS black and white lists and greylisting (see package
+	policy). Rejected messages make it exit with the qmail-queue codes 31
+	(permanent) or 71 (temporary), accepted ones get Received-SPF and
+	Authentication-Results header fields and are given to
+	/var/qmail/bin/qmail-queue.
+
+	Messages of clients with RELAYCLIENT set, or not received by SMTP (no
+	TCPREMOTEIP), are queued unchanged.
+*/
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/policy"
+	"github.com/toorop/qmail-boosters/src/qmailqueue"
+	"github.com/toorop/qmail-boosters/src/smtpd"
+)
+
+var logger = log.New(os.Stderr, "qmail-boosters-policy: ", 0)
+
+// die exits with a qmail-queue code
+func die(code int, format string, v ...interface{}) {
+	logger.Printf(format, v...)
+	os.Exit(code)
+}
+
+// queue gives the message to qmail-queue and exits with its code
+func queue(header string, msg io.Reader, sender string, recipients []string) {
+	prog, args := control.Path("bin/qmail-queue"), []string(nil)
+	if len(os.Args) > 1 {
+		prog, args = os.Args[1], os.Args[2:]
+	}
+	err := qmailqueue.Pass(io.MultiReader(strings.NewReader(header), msg), sender, recipients, prog, args...)
+	if err != nil {
+		logger.Printf("%s: %s", prog, err)
+	}
+	os.Exit(qmailqueue.ExitCode(err))
+}
+
+func main() {
+	msg, sender, recipients, err := qmailqueue.ReadInput()
+	if err != nil {
+		die(qmailqueue.ExitCode(err), "%s", err)
+	}
+
+	ip := net.ParseIP(os.Getenv("TCPREMOTEIP"))
+	if _, relay := os.LookupEnv("RELAYCLIENT"); ip == nil || relay {
+		queue("", msg, sender, recipients)
+	}
+	p, err := policy.Load()
+	if err != nil {
+		die(55, "unable to read controls: %s", err)
+	}
+	m := &policy.Message{IP: ip, Helo: smtpd.ReceivedHelo(msg), Sender: sender, Recipients: recipients}
+	if _, err = msg.Seek(0, io.SeekStart); err != nil {
+		die(54, "unable to read message: %s", err)
+	}
+	d := p.Check(m)
+	for _, e := range d.Errors {
+		logger.Printf("warning: %s %s: %s", ip, sender, e)
+	}
+	switch d.Verdict {
+	case policy.PermFail:
+		die(31, "%s <%s>: rejected, %s", ip, sender, d.Reason)
+	case policy.TempFail:
+		die(71, "%s <%s>: deferred, %s", ip, sender, d.Reason)
+	}
+	if d.Reason != "" {
+		logger.Printf("%s <%s>: %s", ip, sender, d.Reason)
+	}
+	queue(d.Header, msg, sender, recipients)
+}
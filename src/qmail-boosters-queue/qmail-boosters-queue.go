@@ -0,0 +1,118 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+
+	SYNOPSIS
+          qmail-boosters-queue [-route name] [-domain domain] [queuedir]
+
+	Lists the messages of the qmail queue (/var/qmail/queue by default)
+	like qmail-qread, with their X-QB-UUID, their age and, for each remote
+	recipient not delivered yet, the route qmail-remote would take
+	according to control/routemap, control/routes and control/smtproutes.
+
+	-route and -domain only show the recipients of a route or of a
+	recipient domain.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/queue"
+	"github.com/toorop/qmail-boosters/src/remote"
+)
+
+// router returns the routes of remote recipients, control files are
+// read once per sender domain and recipient domain
+type router map[string]string
+
+// route returns the route description of a recipient
+func (r router) route(sender, host string) string {
+	key := sender + "\x00" + host
+	if s, ok := r[key]; ok {
+		return s
+	}
+	route, err := remote.LookupRoute(sender, host)
+	s := route.Name + " " + route.RemoteAddr
+	if route.RemoteAddr == "" {
+		s = route.Name + " mx"
+	}
+	if err != nil {
+		s = "? " + err.Error()
+	}
+	r[key] = s
+	return s
+}
+
+// domain returns the domain of an address, as qmail-send gives it to
+// qmail-remote
+func domain(addr string) string {
+	return strings.ToLower(addr[strings.LastIndexByte(addr, '@')+1:])
+}
+
+// show writes the messages with remote recipients of route routeName and
+// domain dom ("" for all)
+func show(w io.Writer, entries []*queue.Entry, routeName, dom string, now time.Time) {
+	r := make(router)
+	for _, e := range entries {
+		var lines []string
+		sender := strings.ToLower(e.Sender)
+		for _, rcpt := range e.Remote {
+			host := domain(rcpt)
+			if dom != "" && host != strings.ToLower(dom) {
+				continue
+			}
+			route := r.route(sender, host)
+			if routeName != "" && strings.SplitN(route, " ", 2)[0] != routeName {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("\tremote\t%s\t%s\n", rcpt, route))
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		uuid := e.UUID
+		if uuid == "" {
+			uuid = "nouuid"
+		}
+		fmt.Fprintf(w, "%s  #%d  %d  <%s>  %s  %s\n", e.Time.UTC().Format("2 Jan 2006 15:04:05 GMT"), e.ID, e.Size, e.Sender, uuid, now.Sub(e.Time).Truncate(time.Second))
+		for _, l := range lines {
+			io.WriteString(w, l)
+		}
+	}
+}
+
+func main() {
+	routeName := flag.String("route", "", "only show recipients of this route")
+	dom := flag.String("domain", "", "only show recipients of this domain")
+	flag.Parse()
+	dir := control.Path("queue")
+	if flag.NArg() > 0 {
+		dir = flag.Arg(0)
+	}
+	entries, err := queue.OpenDir(dir).List()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "qmail-boosters-queue: unable to read queue %s: %s\n", dir, err)
+		os.Exit(111)
+	}
+	show(os.Stdout, entries, *routeName, *dom, time.Now())
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/queue"
+)
+
+func TestShow(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qmail-boosters-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "control"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "control/routemap"), []byte("*;protecmail.com;pm\nbounce;*;bounces\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "control/routes"), []byte("pm;1.2.3.4;mx5.protecmail.com:25;;\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "control/smtproutes"), nil, 0644)
+	old := control.QmailHome
+	control.QmailHome = dir
+	defer func() { control.QmailHome = old }()
+
+	now := time.Unix(1400003600, 0)
+	entries := []*queue.Entry{
+		{ID: 10, Time: time.Unix(1400000000, 0), Size: 100, Sender: "a@example.org", UUID: "1234",
+			Remote: []string{"b@protecmail.com", "c@Example.com"}},
+		{ID: 12, Time: time.Unix(1400003000, 0), Size: 50, Remote: []string{"d@example.com"}},
+		{ID: 14, Time: time.Unix(1400003000, 0), Size: 50, Sender: "a@example.org", Local: []string{"joe@example.net"}},
+	}
+	for _, test := range []struct {
+		route, domain, want string
+	}{
+		{"", "", "13 May 2014 16:53:20 GMT  #10  100  <a@example.org>  1234  1h0m0s\n" +
+			"\tremote\tb@protecmail.com\tpm mx5.protecmail.com:25\n" +
+			"\tremote\tc@Example.com\tdefault mx\n" +
+			"13 May 2014 17:43:20 GMT  #12  50  <>  nouuid  10m0s\n" +
+			"\tremote\td@example.com\tbounces mx\n"},
+		{"pm", "", "13 May 2014 16:53:20 GMT  #10  100  <a@example.org>  1234  1h0m0s\n" +
+			"\tremote\tb@protecmail.com\tpm mx5.protecmail.com:25\n"},
+		{"", "example.com", "13 May 2014 16:53:20 GMT  #10  100  <a@example.org>  1234  1h0m0s\n" +
+			"\tremote\tc@Example.com\tdefault mx\n" +
+			"13 May 2014 17:43:20 GMT  #12  50  <>  nouuid  10m0s\n" +
+			"\tremote\td@example.com\tbounces mx\n"},
+		{"default", "example.com", "13 May 2014 16:53:20 GMT  #10  100  <a@example.org>  1234  1h0m0s\n" +
+			"\tremote\tc@Example.com\tdefault mx\n"},
+	} {
+		var b bytes.Buffer
+		show(&b, entries, test.route, test.domain, now)
+		if b.String() != test.want {
+			t.Errorf("route %q domain %q: got\n%s\nwant\n%s", test.route, test.domain, b.String(), test.want)
+		}
+	}
+}
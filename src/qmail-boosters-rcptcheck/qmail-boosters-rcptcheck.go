@@ -0,0 +1,282 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+	SYNOPSIS
+          tcpserver 0 smtp qmail-boosters-rcptcheck qmail-smtpd [args]
+
+	Front end of qmail-smtpd which rejects unknown local recipients at
+	RCPT time (550 5.1.1) instead of accepting them and bouncing later.
+	Everything else goes to qmail-smtpd unchanged, one command at a time,
+	so replies keep the order of pipelined commands.
+
+	Recipients are checked if their domain is in control/rcpthosts (or
+	morercpthosts.cdb) and is delivered here (control/locals,
+	control/virtualdomains), against users/assign, the passwd file and
+	~alias, or the lookup defined in control/rcptcheck.
+
+	STARTTLS is handled here with control/servercert.pem, qmail-smtpd
+	sees the session in clear. Without it, a qmail-smtpd offering
+	STARTTLS is refused rather than downgraded.
+*/
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/rcptcheck"
+	"github.com/toorop/qmail-boosters/src/rcpthosts"
+	"github.com/toorop/qmail-boosters/src/smtp"
+	"github.com/toorop/qmail-boosters/src/smtpd"
+)
+
+// proxy relays a session between the client and qmail-smtpd
+type proxy struct {
+	client  *smtp.ServerConn
+	conn    net.Conn    // client connection, for STARTTLS
+	tls     *tls.Config // STARTTLS is offered if set
+	inTLS   bool
+	server  *textproto.Reader // qmail-smtpd replies
+	serverW *bufio.Writer     // qmail-smtpd commands
+	hosts   *rcpthosts.Hosts
+	checker *rcptcheck.Checker
+	log     *log.Logger
+	inMail  bool // MAIL accepted by qmail-smtpd
+}
+
+// errTLS ends sessions when qmail-smtpd offers STARTTLS and we can't :
+// removing it would downgrade the session to plaintext
+var errTLS = errors.New("qmail-smtpd offers STARTTLS but control/servercert.pem is missing")
+
+// relay reads a reply of qmail-smtpd and sends it to the client. We have
+// to see recipients : STARTTLS is ours, not the one of qmail-smtpd.
+func (p *proxy) relay(ehlo bool) (int, error) {
+	code, msg, err := p.server.ReadResponse(0)
+	if err != nil {
+		return 0, err
+	}
+	if ehlo && code == 250 {
+		var lines []string
+		starttls := false
+		for _, l := range strings.Split(msg, "\n") {
+			if strings.EqualFold(l, "STARTTLS") {
+				starttls = true
+			} else {
+				lines = append(lines, l)
+			}
+		}
+		if starttls && p.tls == nil {
+			p.client.Reply(421, "unable to offer STARTTLS (#4.3.0)")
+			return 0, errTLS
+		}
+		if p.tls != nil && !p.inTLS {
+			lines = append(lines, "STARTTLS")
+		}
+		msg = strings.Join(lines, "\n")
+	}
+	return code, p.client.Reply(code, msg)
+}
+
+// startTLS handles STARTTLS. The session starts again (RFC 3207 section
+// 4.2) : qmail-smtpd forgets the previous commands.
+func (p *proxy) startTLS() error {
+	if p.tls == nil {
+		return p.client.Reply(502, "unimplemented (#5.5.1)")
+	}
+	if p.inTLS {
+		return p.client.Reply(503, "already in TLS (#5.5.1)")
+	}
+	p.client.Reply(220, "ready for tls")
+	if err := p.client.Flush(); err != nil {
+		return err
+	}
+	c := tls.Server(p.conn, p.tls)
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	p.client.Reset(c, c)
+	p.inTLS, p.inMail = true, false
+	p.serverW.WriteString("RSET\r\n")
+	if err := p.serverW.Flush(); err != nil {
+		return err
+	}
+	_, _, err := p.server.ReadResponse(0)
+	return err
+}
+
+// forward sends a line to qmail-smtpd and relays its reply
+func (p *proxy) forward(line string, ehlo bool) (int, error) {
+	p.serverW.WriteString(line + "\r\n")
+	if err := p.serverW.Flush(); err != nil {
+		return 0, err
+	}
+	return p.relay(ehlo)
+}
+
+// unknown tells if the recipient of a RCPT command is to be rejected
+func (p *proxy) unknown(arg string) bool {
+	addr, _, err := smtp.ParsePath(arg, "TO")
+	if err != nil || !p.hosts.Allowed(addr) {
+		return false
+	}
+	res, err := p.checker.Check(addr)
+	if err != nil {
+		p.log.Printf("warning: unable to check %s: %s", addr, err)
+	}
+	if res == rcptcheck.Unknown {
+		p.log.Printf("%s: unknown recipient <%s>", os.Getenv("TCPREMOTEIP"), addr)
+		return true
+	}
+	return false
+}
+
+// run relays the session until QUIT or the end of one of the connections
+func (p *proxy) run() error {
+	defer p.client.Flush()
+	if _, err := p.relay(false); err != nil {
+		return err
+	}
+	for {
+		line, err := p.client.ReadLine()
+		if err != nil {
+			return err
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		if verb == "STARTTLS" {
+			if err = p.startTLS(); err != nil {
+				return err
+			}
+			continue
+		}
+		if verb == "RCPT" && p.inMail && p.unknown(strings.TrimLeft(line[4:], " ")) {
+			p.client.Reply(550, "5.1.1 sorry, no mailbox here by that name (#5.1.1)")
+			continue
+		}
+		code, err := p.forward(line, verb == "EHLO")
+		if err != nil {
+			return err
+		}
+		switch verb {
+		case "MAIL":
+			p.inMail = code == 250
+		case "HELO", "EHLO", "RSET":
+			p.inMail = false
+		case "DATA":
+			p.inMail = false
+			if code != 354 {
+				continue
+			}
+			if _, err = io.Copy(p.serverW, p.client.RawDataReader()); err != nil {
+				return err
+			}
+			if err = p.serverW.Flush(); err != nil {
+				return err
+			}
+			code, err = p.relay(false)
+		case "QUIT":
+			return nil
+		}
+		// AUTH exchange
+		for err == nil && code == 334 {
+			if line, err = p.client.ReadLine(); err == nil {
+				code, err = p.forward(line, false)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// start runs qmail-smtpd with pipes on its stdin and stdout
+func start(args []string) (cmd *exec.Cmd, in io.WriteCloser, out io.Reader, err error) {
+	cmd = exec.Command(args[0], args[1:]...)
+	cmd.Stderr = os.Stderr
+	if in, err = cmd.StdinPipe(); err != nil {
+		return
+	}
+	if out, err = cmd.StdoutPipe(); err != nil {
+		return
+	}
+	err = cmd.Start()
+	return
+}
+
+// timeout returns control/timeoutsmtpd
+func timeout() time.Duration {
+	s, _ := control.ReadFirstLine("control/timeoutsmtpd", "")
+	if n, err := strconv.Atoi(s); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 1200 * time.Second
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		os.Stdout.WriteString("421 qmail-boosters-rcptcheck was invoked improperly (#4.3.0)\r\n")
+		os.Exit(100)
+	}
+	logger := log.New(os.Stderr, "qmail-boosters-rcptcheck: ", 0)
+	hosts, err := rcpthosts.Load()
+	var checker *rcptcheck.Checker
+	if err == nil {
+		checker, err = rcptcheck.Load()
+	}
+	var tlsConfig *tls.Config
+	if err == nil {
+		tlsConfig, err = smtpd.ReadTLSConfig()
+	}
+	if err != nil {
+		// don't check anything
+		logger.Printf("warning: unable to read controls: %s", err)
+		err = syscall.Exec(os.Args[1], os.Args[1:], os.Environ())
+		logger.Fatalf("unable to run %s: %s", os.Args[1], err)
+	}
+
+	cmd, in, out, err := start(os.Args[1:])
+	if err != nil {
+		os.Stdout.WriteString("421 unable to run qmail-smtpd (#4.3.0)\r\n")
+		logger.Fatalf("unable to run %s: %s", os.Args[1], err)
+	}
+	conn := &smtpd.StdioConn{R: &smtpd.TimeoutReader{R: os.Stdin, Timeout: timeout()}, W: os.Stdout}
+	p := &proxy{
+		client:  smtp.NewServerConn(conn, conn),
+		conn:    conn,
+		tls:     tlsConfig,
+		server:  textproto.NewReader(bufio.NewReader(out)),
+		serverW: bufio.NewWriter(in),
+		hosts:   hosts,
+		checker: checker,
+		log:     logger,
+	}
+	if err = p.run(); err == errTLS {
+		logger.Print(err)
+	}
+	in.Close()
+	cmd.Wait()
+}
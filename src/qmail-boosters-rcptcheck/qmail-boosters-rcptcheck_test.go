@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/rcptcheck"
+	"github.com/toorop/qmail-boosters/src/rcpthosts"
+	"github.com/toorop/qmail-boosters/src/smtp"
+	"github.com/toorop/qmail-boosters/src/smtp/smtptest"
+	"github.com/toorop/qmail-boosters/src/smtpd"
+)
+
+// setup installs the control files, a recipient check refusing bad@ and a
+// qmail-queue saving the message and the envelope in dir
+func setup(t *testing.T) (dir string, checker *rcptcheck.Checker, cleanup func()) {
+	dir, err := ioutil.TempDir("", "rcptcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "control"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "check"), []byte("#!/bin/sh\ncase \"$1\" in bad@*) exit 100;; esac\nexit 0\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "control/locals"), []byte("example.com\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "control/rcptcheck"), []byte("program:"+dir+"/check\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "qmail-queue"), []byte("#!/bin/sh\ncat > "+dir+"/msg\ncat <&1 > "+dir+"/env\n"), 0755)
+	old, oldQueue := control.QmailHome, os.Getenv("QMAILQUEUE")
+	control.QmailHome = dir
+	os.Setenv("QMAILQUEUE", filepath.Join(dir, "qmail-queue"))
+	cleanup = func() {
+		control.QmailHome = old
+		os.Setenv("QMAILQUEUE", oldQueue)
+		os.RemoveAll(dir)
+	}
+	if checker, err = rcptcheck.Load(); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return dir, checker, cleanup
+}
+
+// qmailSmtpd runs a qmail-smtpd session, cmdW is its stdin and replyR its
+// stdout
+func qmailSmtpd(hosts *rcpthosts.Hosts) (cmdW io.WriteCloser, replyR io.Reader) {
+	cmdR, cmdW := io.Pipe()
+	replyR, replyW := io.Pipe()
+	go func() {
+		smtpd.NewSession(&smtpd.Config{
+			Me:          "mx.example.com",
+			Greeting:    "mx.example.com",
+			LocalIPHost: "mx.example.com",
+			RcptHosts:   hosts,
+			LocalHost:   "mx.example.com",
+			RemoteIP:    "192.0.2.1",
+			Timeout:     10 * time.Second,
+		}, cmdR, replyW).Serve()
+		replyW.Close()
+	}()
+	return cmdW, replyR
+}
+
+func TestProxy(t *testing.T) {
+	dir, checker, cleanup := setup(t)
+	defer cleanup()
+	hosts := rcpthosts.New([]string{"example.com"}, nil)
+	cmdW, replyR := qmailSmtpd(hosts)
+
+	client := "EHLO client.example.org\r\nMAIL FROM:<a@example.org>\r\nRCPT TO:<ok@example.com>\r\nRCPT TO:<bad@example.com>\r\nRCPT TO:<bad@elsewhere.example>\r\nDATA\r\nSubject: test\r\n\r\n..dot\r\n.\r\nQUIT\r\n"
+	var out bytes.Buffer
+	p := &proxy{
+		client:  smtp.NewServerConn(strings.NewReader(client), &out),
+		server:  textproto.NewReader(bufio.NewReader(replyR)),
+		serverW: bufio.NewWriter(cmdW),
+		hosts:   hosts,
+		checker: checker,
+		log:     log.New(ioutil.Discard, "", 0),
+	}
+	if err := p.run(); err != nil {
+		t.Fatal(err)
+	}
+	cmdW.Close()
+
+	want := "220 mx.example.com ESMTP\r\n250-mx.example.com\r\n250-PIPELINING\r\n250 8BITMIME\r\n250 ok\r\n250 ok\r\n550 5.1.1 sorry, no mailbox here by that name (#5.1.1)\r\n553 sorry, that domain isn't in my list of allowed rcpthosts (#5.7.1)\r\n354 go ahead\r\n250 ok T qp P\r\n221 mx.example.com\r\n"
+	if got := regexp.MustCompile(`ok \d+ qp \d+`).ReplaceAllString(out.String(), "ok T qp P"); got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+	if env, _ := ioutil.ReadFile(filepath.Join(dir, "env")); string(env) != "Fa@example.org\x00Tok@example.com\x00\x00" {
+		t.Errorf("got envelope %q", env)
+	}
+	if msg, _ := ioutil.ReadFile(filepath.Join(dir, "msg")); !bytes.HasSuffix(msg, []byte("\nSubject: test\n\n.dot\n")) {
+		t.Errorf("got message %q", msg)
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	_, checker, cleanup := setup(t)
+	defer cleanup()
+	hosts := rcpthosts.New([]string{"example.com"}, nil)
+
+	// qmail-smtpd offers STARTTLS, we can't
+	var out bytes.Buffer
+	p := &proxy{
+		client:  smtp.NewServerConn(strings.NewReader("EHLO client.example.org\r\n"), &out),
+		server:  textproto.NewReader(bufio.NewReader(strings.NewReader("220 mx.example.com ESMTP\r\n250-mx.example.com\r\n250 STARTTLS\r\n"))),
+		serverW: bufio.NewWriter(ioutil.Discard),
+		hosts:   hosts,
+		checker: checker,
+		log:     log.New(ioutil.Discard, "", 0),
+	}
+	if err := p.run(); err != errTLS || !strings.HasSuffix(out.String(), "421 unable to offer STARTTLS (#4.3.0)\r\n") {
+		t.Errorf("got %v\n%s", err, out.String())
+	}
+
+	cert, err := smtptest.GenerateCert("mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdW, replyR := qmailSmtpd(hosts)
+	defer cmdW.Close()
+	server, client := net.Pipe()
+	p = &proxy{
+		client:  smtp.NewServerConn(server, server),
+		conn:    server,
+		tls:     &tls.Config{Certificates: []tls.Certificate{cert}},
+		server:  textproto.NewReader(bufio.NewReader(replyR)),
+		serverW: bufio.NewWriter(cmdW),
+		hosts:   hosts,
+		checker: checker,
+		log:     log.New(ioutil.Discard, "", 0),
+	}
+	go func() {
+		p.run()
+		server.Close()
+	}()
+	c, err := smtp.NewClient(client, "mx.example.com", "client.example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if ok, _ := c.Extension("STARTTLS"); !ok {
+		t.Fatal("STARTTLS not offered")
+	}
+	c.Mail("a@example.org")
+	if err = c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		t.Error("STARTTLS offered in TLS")
+	}
+	// MAIL before STARTTLS is forgotten
+	if _, err = c.Rcpt("ok@example.com"); err == nil {
+		t.Error("RCPT without MAIL accepted")
+	}
+	c.Mail("a@example.org")
+	if _, err = c.Rcpt("bad@example.com"); err == nil || !strings.Contains(err.Error(), "5.1.1") {
+		t.Errorf("unknown recipient: got %v", err)
+	}
+	if _, err = c.Rcpt("ok@example.com"); err != nil {
+		t.Error(err)
+	}
+	c.Quit()
+}
@@ -0,0 +1,77 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+	SYNOPSIS
+          qmail-boosters-srs [address ...]
+
+	Decodes SRS addresses made by qmail-remote (control/senderrewrite).
+
+	With addresses, prints the address each one stands for.
+
+	Without argument, runs as a qmail-command in a .qmail-default file of
+	the SRS domain : the recipient ($DEFAULT@$HOST) is decoded and the
+	message (a bounce) is forwarded to the original sender with
+	/var/qmail/bin/forward. Forged or expired addresses are bounced.
+*/
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/srs"
+)
+
+func main() {
+	flag.Parse()
+	s, err := srs.Load("")
+	if err != nil {
+		fmt.Printf("Unable to load SRS settings: %s (#4.3.0)\n", err)
+		os.Exit(111)
+	}
+
+	if flag.NArg() > 0 {
+		status := 0
+		for _, address := range flag.Args() {
+			orig, err := s.Reverse(address)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", address, err)
+				status = 100
+				continue
+			}
+			fmt.Println(orig)
+		}
+		os.Exit(status)
+	}
+
+	host := os.Getenv("HOST")
+	if host == "" {
+		fmt.Println("qmail-boosters-srs was invoked improperly. (#5.3.5)")
+		os.Exit(100)
+	}
+	orig, err := s.Reverse(os.Getenv("DEFAULT") + "@" + host)
+	if err != nil {
+		fmt.Printf("Sorry, %s. (#5.1.1)\n", err)
+		os.Exit(100)
+	}
+	forward := control.Path("bin/forward")
+	err = syscall.Exec(forward, []string{"forward", orig}, os.Environ())
+	fmt.Printf("Unable to run %s: %s (#4.3.0)\n", forward, err)
+	os.Exit(111)
+}
@@ -0,0 +1,98 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+
+	SYNOPSIS
+          qmail-local [ -nN ] user homedir local dash ext domain sender defaultdelivery
+
+    More details : http://www.qmail.org/man/man8/qmail-local.html
+
+	Drop-in replacement of qmail-local (same arguments, same exit codes,
+	same .qmail files) which also enforces Maildir++ quotas (maildirsize),
+	files messages in maildir folders according to rules (qb-rules of the
+	maildir, control/localrules) and logs deliveries with the X-QB-UUID
+	of the message.
+
+	-n prints the delivery instructions instead of delivering.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/toorop/qmail-boosters/src/local"
+)
+
+func usage() {
+	fmt.Println("qmail-local: usage: qmail-local [ -nN ] user homedir local dash ext domain sender aliasempty")
+	os.Exit(100)
+}
+
+func main() {
+	args := os.Args[1:]
+	dryRun := false
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		for _, c := range args[0][1:] {
+			switch c {
+			case 'n':
+				dryRun = true
+			case 'N':
+				dryRun = false
+			default:
+				usage()
+			}
+		}
+		args = args[1:]
+	}
+	if len(args) != 8 {
+		usage()
+	}
+	if !filepath.IsAbs(args[1]) {
+		fmt.Println("Home directory is not absolute. (#4.3.0)")
+		os.Exit(111)
+	}
+	if err := os.Chdir(args[1]); err != nil {
+		fmt.Printf("Unable to switch to %s: %s. (#4.3.0)\n", args[1], err)
+		os.Exit(111)
+	}
+	d := &local.Delivery{
+		User:            args[0],
+		Home:            args[1],
+		Local:           args[2],
+		Dash:            args[3],
+		Ext:             args[4],
+		Host:            args[5],
+		Sender:          args[6],
+		DefaultDelivery: args[7],
+		Message:         os.Stdin,
+		Out:             os.Stdout,
+		DryRun:          dryRun,
+	}
+	err := d.Run()
+	if err == nil {
+		if !dryRun {
+			fmt.Printf("%s:did %d+%d+%d\n", d.UUID, d.Files, d.Forwards, d.Programs)
+		}
+		os.Exit(0)
+	}
+	fmt.Printf("%s:%s\n", d.UUID, err)
+	if e, ok := err.(*local.Error); ok && e.Permanent {
+		os.Exit(100)
+	}
+	os.Exit(111)
+}
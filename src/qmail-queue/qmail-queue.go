@@ -0,0 +1,142 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+
+	SYNOPSIS
+          qmail-queue
+
+    More details : http://www.qmail.org/man/man8/qmail-queue.html
+
+	Drop-in replacement of qmail-queue (same queue, same exit codes) which
+	adds a X-QB-UUID header field to every message, whatever the way it
+	was injected (qmail-smtpd, qmail-inject, sendmail, forwards...).
+	Messages stamped by the qmail-smtpd or qmail-submission of
+	qmail-boosters keep their X-QB-UUID : it is in $QBUUID and qmail-queue
+	runs as qmaild (or root). Other X-QB-UUID fields are dropped, anyone
+	can write them.
+
+	Install it as /var/qmail/bin/qmail-queue, owned by qmailq and setuid,
+	like the original.
+*/
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/qmailqueue"
+	"github.com/toorop/qmail-boosters/src/queue"
+	"github.com/toorop/qmail-boosters/src/uuid"
+)
+
+// death is the time qmail-queue gives up after (DEATH of qmail-queue.c)
+const death = 24 * time.Hour
+
+// invoked returns how qmail-queue was invoked, for its Received field
+func invoked(uid int) string {
+	for _, u := range []struct{ name, text string }{
+		{"alias", "by alias"},
+		{"qmaild", "from network"},
+		{"qmails", "for bounce"},
+	} {
+		if pw, err := user.Lookup(u.name); err == nil && pw.Uid == strconv.Itoa(uid) {
+			return u.text
+		}
+	}
+	return "by uid " + strconv.Itoa(uid)
+}
+
+// received returns the Received field of qmail-queue
+func received(pid, uid int, now time.Time) string {
+	return fmt.Sprintf("Received: (qmail %d invoked %s); %s\n", pid, invoked(uid), now.UTC().Format("2 Jan 2006 15:04:05 -0000"))
+}
+
+// trusted tells if uid runs qmail-smtpd or qmail-submission, whose
+// $QBUUID is the X-QB-UUID they stamped
+func trusted(uid int) bool {
+	if uid == 0 {
+		return true
+	}
+	pw, err := user.Lookup("qmaild")
+	return err == nil && pw.Uid == strconv.Itoa(uid)
+}
+
+// readHeader reads the header of msg, up to the empty line included, and
+// returns it without its X-QB-UUID fields and the value of the first one.
+// A line which isn't a field ends the header.
+func readHeader(msg *bufio.Reader) (header, id string, err error) {
+	var b strings.Builder
+	skip := false
+	for {
+		l, e := msg.ReadString('\n')
+		if e != nil && e != io.EOF {
+			return "", "", e
+		}
+		switch {
+		case l == "":
+		case l[0] == ' ' || l[0] == '\t':
+			if !skip {
+				b.WriteString(l)
+			}
+		case len(l) >= len("X-QB-UUID:") && strings.EqualFold(l[:len("X-QB-UUID:")], "X-QB-UUID:"):
+			if !skip && id == "" {
+				id = strings.TrimSpace(l[len("X-QB-UUID:"):])
+			}
+			skip = true
+		case strings.TrimRight(l, "\r\n") == "", !strings.Contains(l, ":"):
+			b.WriteString(l)
+			return b.String(), id, nil
+		default:
+			skip = false
+			b.WriteString(l)
+		}
+		if e == io.EOF {
+			return b.String(), id, nil
+		}
+	}
+}
+
+func main() {
+	signal.Ignore(syscall.SIGPIPE, syscall.SIGHUP, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGXCPU, syscall.SIGXFSZ)
+	syscall.Umask(033)
+	// files left behind are removed by qmail-send
+	time.AfterFunc(death, func() { os.Exit(52) })
+
+	pid, uid, now := os.Getpid(), os.Getuid(), time.Now()
+	msg := bufio.NewReader(os.Stdin)
+	fields, stamped, err := readHeader(msg)
+	if err != nil {
+		os.Exit(54)
+	}
+	id := os.Getenv(qmailqueue.UUIDEnv)
+	if id == "" || id != stamped || !trusted(uid) {
+		if id, err = uuid.New(); err != nil {
+			os.Exit(51)
+		}
+	}
+	header := "X-QB-UUID: " + id + "\n" + received(pid, uid, now)
+	if _, err := queue.Open().Inject(header, io.MultiReader(strings.NewReader(fields), msg), os.Stdout, uid, pid, now); err != nil {
+		os.Exit(err.(*queue.Error).Code)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"bufio"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestReadHeader(t *testing.T) {
+	for _, tc := range []struct {
+		msg, header, id, body string
+	}{
+		{"X-QB-UUID: 42\nReceived: x\n\nbody\n", "Received: x\n\n", "42", "body\n"},
+		// below the fields of a qmail-queue wrapper
+		{"Received-SPF: pass\n\tclient-ip=192.0.2.1\nX-QB-UUID: 42\nReceived: x\n\nbody\n", "Received-SPF: pass\n\tclient-ip=192.0.2.1\nReceived: x\n\n", "42", "body\n"},
+		{"x-qb-uuid: 42\n\t43\nX-QB-UUID: 44\nSubject: s\n\n", "Subject: s\n\n", "42", ""},
+		{"Subject: s\n", "Subject: s\n", "", ""},
+		{"not a header\nX-QB-UUID: 42\n", "not a header\n", "", "X-QB-UUID: 42\n"},
+	} {
+		r := bufio.NewReader(strings.NewReader(tc.msg))
+		header, id, err := readHeader(r)
+		body, _ := ioutil.ReadAll(r)
+		if header != tc.header || id != tc.id || string(body) != tc.body || err != nil {
+			t.Errorf("%q: got %q %q %q %v", tc.msg, header, id, body, err)
+		}
+	}
+}
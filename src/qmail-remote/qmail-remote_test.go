@@ -1,6 +1,302 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/deliverylog"
+	"github.com/toorop/qmail-boosters/src/smtp/smtptest"
 )
+
+// TestMain runs qmail-remote itself when the test binary is started as a
+// helper process by runQmailRemote (qmail-remote exits on every outcome)
+func TestMain(m *testing.M) {
+	if os.Getenv("QR_TEST_HELPER") == "1" {
+		control.QmailHome = os.Getenv("QR_TEST_QMAILDIR")
+		os.Args = append([]string{"qmail-remote"}, strings.Split(os.Getenv("QR_TEST_ARGS"), " ")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// qmailHome creates a qmail home with the given control files
+func qmailHome(t *testing.T, control map[string]string) string {
+	dir, err := ioutil.TempDir("", "qmail-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(filepath.Join(dir, "control"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"me":         "qmail.test.example",
+		"routemap":   "*;*;r1",
+		"smtproutes": "",
+	}
+	for name, content := range control {
+		files[name] = content
+	}
+	for name, content := range files {
+		if err = ioutil.WriteFile(filepath.Join(dir, "control", name), []byte(content+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+// runQmailRemote runs qmail-remote host sender recip... with msg on stdin and
+// returns its output
+func runQmailRemote(t *testing.T, home string, msg io.Reader, args ...string) string {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), "QR_TEST_HELPER=1", "QR_TEST_QMAILDIR="+home, "QR_TEST_ARGS="+strings.Join(args, " "))
+	cmd.Stdin = msg
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("qmail-remote failed: %v", err)
+	}
+	return out.String()
+}
+
+// local ports are random
+var localAddrRe = regexp.MustCompile(`127\.0\.0\.1:[0-9]+->`)
+
+const testMsg = "X-QB-UUID: 2a7c\r\nFrom: a@sender.example\r\nSubject: test\r\n\r\nhello\r\n.dot\r\n"
+
+func TestSendmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		servers []map[string][]string // scripted replies, one server each
+		control map[string]string
+		rcpts   []string
+		want    string // {0}, {1}... are the servers addresses
+	}{
+		{
+			name:    "accepted",
+			servers: []map[string][]string{nil},
+			rcpts:   []string{"u1@example.com", "u2@example.com"},
+			want: "r2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:recipient accepted. (#2.1.5)\x00" +
+				"r2a7c:127.0.0.1->{0}:a@sender.example:u2@example.com:recipient accepted. (#2.1.5)\x00" +
+				"K accepted message: Ok: queued as 42 (#2.0.0)\n\x00",
+		},
+		{
+			name:    "partially rejected",
+			servers: []map[string][]string{{"RCPT": {"250 2.1.5 Ok", "550 5.1.1 No such user", "450 4.2.0 Greylisted", "250 2.1.5 Ok"}}},
+			rcpts:   []string{"u1@example.com", "u2@example.com", "u3@example.com", "u4@example.com"},
+			want: "r2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:recipient accepted. (#2.1.5)\x00" +
+				"h2a7c:127.0.0.1->{0}:a@sender.example:u2@example.com: does not like recipient. No such user (#5.1.1)\x00" +
+				"s2a7c:127.0.0.1->{0}:a@sender.example:u3@example.com: does not like recipient. Greylisted (#4.2.0)\x00" +
+				"r2a7c:127.0.0.1->{0}:a@sender.example:u4@example.com:recipient accepted. (#2.1.5)\x00" +
+				"K accepted message: Ok: queued as 42 (#2.0.0)\n\x00",
+		},
+		{
+			name:    "all recipients rejected",
+			servers: []map[string][]string{{"RCPT": {"550 5.1.1 No such user", "452 4.2.2 Mailbox full"}}},
+			rcpts:   []string{"u1@example.com", "u2@example.com"},
+			want: "h2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com: does not like recipient. No such user (#5.1.1)\x00" +
+				"s2a7c:127.0.0.1->{0}:a@sender.example:u2@example.com: does not like recipient. Mailbox full (#4.2.2)\x00" +
+				"DGiving up on {0} (#4.2.2)\n\x00",
+		},
+		{
+			name:    "deferred on MAIL",
+			servers: []map[string][]string{{"MAIL": {"451 4.3.0 Try again later"}}},
+			rcpts:   []string{"u1@example.com"},
+			want:    "Z2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:Connected to remote host but sender was rejected. Try again later (#4.3.0)\n\x00",
+		},
+		{
+			name:    "bounced on MAIL",
+			servers: []map[string][]string{{"MAIL": {"550 5.7.1 Sender rejected"}}},
+			rcpts:   []string{"u1@example.com"},
+			want:    "D2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:Connected to remote host but sender was rejected. Sender rejected (#5.7.1)\n\x00",
+		},
+		{
+			name:    "deferred on final dot",
+			servers: []map[string][]string{{".": {"452 4.3.1 Insufficient system storage"}}},
+			rcpts:   []string{"u1@example.com"},
+			want: "r2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:recipient accepted. (#2.1.5)\x00" +
+				"Z failed after I sent the message: Insufficient system storage (#4.3.1)\n\x00",
+		},
+		{
+			name:    "bounced on final dot",
+			servers: []map[string][]string{{".": {"554 5.6.0 Message content rejected"}}},
+			rcpts:   []string{"u1@example.com"},
+			want: "r2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:recipient accepted. (#2.1.5)\x00" +
+				"D failed after I sent the message: Message content rejected (#5.6.0)\n\x00",
+		},
+		{
+			name:    "temporary enhanced code downgrades a 5xx",
+			servers: []map[string][]string{{"MAIL": {"550 4.7.1 Temporary policy failure"}}},
+			rcpts:   []string{"u1@example.com"},
+			want:    "Z2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:Connected to remote host but sender was rejected. Temporary policy failure (#4.7.1)\n\x00",
+		},
+		{
+			name:    "basic code wins over a permanent enhanced code",
+			servers: []map[string][]string{{"MAIL": {"450 5.1.1 Mailbox busy"}}},
+			rcpts:   []string{"u1@example.com"},
+			want:    "Z2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:Connected to remote host but sender was rejected. Mailbox busy (#5.1.1)\n\x00",
+		},
+		{
+			name:    "failover on greeting",
+			servers: []map[string][]string{{"GREETING": {"421 4.3.2 Service not available"}}, nil},
+			rcpts:   []string{"u1@example.com"},
+			want: "r2a7c:127.0.0.1->{1}:a@sender.example:u1@example.com:recipient accepted. (#2.1.5)\x00" +
+				"K accepted message: Ok: queued as 42 (#2.0.0)\n\x00",
+		},
+		{
+			name:    "failover on temporary RCPT",
+			servers: []map[string][]string{{"RCPT": {"451 4.3.0 Local error"}}, nil},
+			rcpts:   []string{"u1@example.com"},
+			want: "r2a7c:127.0.0.1->{1}:a@sender.example:u1@example.com:recipient accepted. (#2.1.5)\x00" +
+				"K accepted message: Ok: queued as 42 (#2.0.0)\n\x00",
+		},
+		{
+			name:    "no failover on permanent failure",
+			servers: []map[string][]string{{"MAIL": {"554 5.7.1 Blocked"}}, nil},
+			rcpts:   []string{"u1@example.com"},
+			want:    "D2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:Connected to remote host but sender was rejected. Blocked (#5.7.1)\n\x00",
+		},
+		{
+			name:    "all hosts temporary",
+			servers: []map[string][]string{{"MAIL": {"421 4.3.2 Busy"}}, {"MAIL": {"451 4.3.0 Busy too"}}},
+			rcpts:   []string{"u1@example.com"},
+			want:    "Z2a7c:127.0.0.1->{1}:a@sender.example:u1@example.com:Connected to remote host but sender was rejected. Busy too (#4.3.0)\n\x00",
+		},
+		{
+			name:    "connection dropped",
+			servers: []map[string][]string{{"RCPT": {smtptest.Drop}}},
+			rcpts:   []string{"u1@example.com"},
+			want:    "Z2a7c:a@sender.example:u1@example.com:Connection to {0} died. EOF during RCPT (#4.4.2)\n\x00",
+		},
+		{
+			name:    "timeout on final dot",
+			servers: []map[string][]string{{".": {smtptest.Stall}}},
+			control: map[string]string{"timeouts": "datadone;1"},
+			rcpts:   []string{"u1@example.com"},
+			want: "r2a7c:127.0.0.1->{0}:a@sender.example:u1@example.com:recipient accepted. (#2.1.5)\x00" +
+				"Z2a7c:a@sender.example:u1@example.com:Sorry, timeout occured during final dot while speaking to {0}. (#4.4.2)\n\x00",
+		},
+	}
+	for _, tt := range tests {
+		var addrs []string
+		for _, replies := range tt.servers {
+			srv := smtptest.NewUnstartedServer()
+			for k, v := range replies {
+				srv.Replies[k] = v
+			}
+			srv.Start()
+			defer srv.Close()
+			addrs = append(addrs, srv.Addr)
+		}
+		control := map[string]string{"routes": "r1;127.0.0.1;" + strings.Join(addrs, "&") + ";;;test.example"}
+		for k, v := range tt.control {
+			control[k] = v
+		}
+		home := qmailHome(t, control)
+		defer os.RemoveAll(home)
+
+		got := runQmailRemote(t, home, strings.NewReader(testMsg), append([]string{"example.com", "a@sender.example"}, tt.rcpts...)...)
+		got = localAddrRe.ReplaceAllString(got, "127.0.0.1->")
+		want := tt.want
+		for i, a := range addrs {
+			want = strings.Replace(want, "{"+strconv.Itoa(i)+"}", a, -1)
+		}
+		if got != want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, want)
+		}
+	}
+}
+
+func TestSendmailTLSAuth(t *testing.T) {
+	for _, mech := range []string{"PLAIN", "CRAM-MD5"} {
+		srv := smtptest.NewUnstartedServer()
+		srv.EnableTLS()
+		srv.Users = map[string]string{"relay": "secret"}
+		srv.Mechanisms = []string{mech}
+		srv.Start()
+		defer srv.Close()
+
+		home := qmailHome(t, map[string]string{"routes": "r1;127.0.0.1;" + srv.Addr + ";relay;secret;test.example"})
+		defer os.RemoveAll(home)
+		got := runQmailRemote(t, home, strings.NewReader(testMsg), "example.com", "a@sender.example", "u1@example.com")
+		if !strings.HasSuffix(got, "K accepted message: Ok: queued as 42 (#2.0.0)\n\x00") {
+			t.Errorf("%s: got %q", mech, got)
+		}
+		sessions := srv.Sessions()
+		if len(sessions) != 1 {
+			t.Fatalf("%s: got %d sessions, want 1", mech, len(sessions))
+		}
+		sess := sessions[0]
+		if !sess.TLS || sess.AuthUser != "relay" || sess.Helo != "test.example" {
+			t.Errorf("%s: got TLS %v, AUTH %q, HELO %q", mech, sess.TLS, sess.AuthUser, sess.Helo)
+		}
+		if string(sess.Data) != testMsg {
+			t.Errorf("%s: got data %q, want %q", mech, sess.Data, testMsg)
+		}
+	}
+}
+
+// qmail-rspawn gives the queue file as stdin, it is read again for each host
+func TestSendmailFileStdin(t *testing.T) {
+	first := smtptest.NewUnstartedServer()
+	first.Replies[smtptest.EndOfData] = []string{"452 4.3.1 Insufficient system storage"}
+	first.Start()
+	defer first.Close()
+	second := smtptest.NewServer()
+	defer second.Close()
+
+	f, err := ioutil.TempFile("", "qmail-remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err = f.WriteString(testMsg); err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(0, io.SeekStart)
+
+	home := qmailHome(t, map[string]string{"routes": "r1;127.0.0.1;" + first.Addr + "&" + second.Addr + ";;;test.example"})
+	defer os.RemoveAll(home)
+	got := runQmailRemote(t, home, f, "example.com", "a@sender.example", "u1@example.com")
+	if !strings.HasPrefix(got, "r2a7c:") || !strings.HasSuffix(got, "K accepted message: Ok: queued as 42 (#2.0.0)\n\x00") {
+		t.Errorf("got %q", got)
+	}
+	for _, srv := range []*smtptest.Server{first, second} {
+		if sessions := srv.Sessions(); len(sessions) != 1 || string(sessions[0].Data) != testMsg {
+			t.Errorf("%s: got sessions %+v", srv.Addr, sessions)
+		}
+	}
+}
+
+// deliveries failing before any attempt are logged too
+func TestDeliveryLogNoAttempt(t *testing.T) {
+	home := qmailHome(t, nil)
+	defer os.RemoveAll(home)
+	logFile := filepath.Join(home, "deliveries.json")
+	ioutil.WriteFile(filepath.Join(home, "control", "deliverylog"), []byte("file:"+logFile+"\n"), 0644)
+	// no control/routes
+	got := runQmailRemote(t, home, strings.NewReader(testMsg), "example.com", "a@sender.example", "u1@example.com")
+	if !strings.HasPrefix(got, "Z2a7c:") {
+		t.Fatalf("got %q", got)
+	}
+	b, _ := ioutil.ReadFile(logFile)
+	var rec deliverylog.Record
+	if err := json.Unmarshal(b, &rec); err != nil {
+		t.Fatalf("got log %q: %s", b, err)
+	}
+	if rec.UUID != "2a7c" || rec.Status != "Z" || rec.Attempt != 0 || !strings.Contains(rec.Message, "routes") ||
+		len(rec.Recipients) != 1 || rec.Recipients[0].Address != "u1@example.com" {
+		t.Errorf("got record %+v", rec)
+	}
+}
@@ -0,0 +1,52 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+	SYNOPSIS
+          tcpserver 0 smtp qmail-smtpd
+
+    Replacement of qmail-smtpd which stamps each message with a X-QB-UUID
+    header field, used by qmail-remote in its logs.
+
+    Environment (tcpserver)
+		TCPLOCALHOST, TCPREMOTEIP, TCPREMOTEHOST, TCPREMOTEINFO
+		RELAYCLIENT : relaying allowed, appended to each recipient
+		DATABYTES : overrides control/databytes
+		QMAILQUEUE : queueing program, default /var/qmail/bin/qmail-queue
+
+    Config files (/var/qmail/control)
+		me, smtpgreeting, localiphost, rcpthosts, morercpthosts.cdb,
+		badmailfrom, databytes, timeoutsmtpd : as with qmail-smtpd
+*/
+package main
+
+import (
+	"log"
+	"os"
+
+	"github.com/toorop/qmail-boosters/src/smtp"
+	"github.com/toorop/qmail-boosters/src/smtpd"
+)
+
+func main() {
+	cfg, err := smtpd.ReadConfig()
+	if err != nil {
+		smtp.NewServerConn(os.Stdin, os.Stdout).Reply(421, "unable to read controls (#4.3.0)")
+		os.Exit(1)
+	}
+	s := smtpd.NewSession(cfg, &smtpd.TimeoutReader{R: os.Stdin, Timeout: cfg.Timeout}, os.Stdout)
+	s.Log = log.New(os.Stderr, "qmail-smtpd: ", 0)
+	s.Serve()
+}
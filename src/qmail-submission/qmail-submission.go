@@ -0,0 +1,175 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+	SYNOPSIS
+          qmail-submission [-listen addr] [-listentls addr] [-cert file] [-key file] [-c max] [-u user] checkpassword subprogram
+
+	Message submission server (RFC 6409) : listens on 587 (STARTTLS) and
+	465 (implicit TLS). AUTH PLAIN, LOGIN and CRAM-MD5 are only offered
+	over TLS and are required before MAIL. Credentials are checked with a
+	checkpassword compatible program. Messages are stamped with X-QB-UUID
+	and a Received header field naming the user, then given to qmail-queue.
+	Started as root, it runs as qmaild once its ports are bound. Sessions
+	end after 3 failed AUTH, each answered later than the previous one.
+
+	Config files (/var/qmail/control)
+		servercert.pem : certificate and private key
+		me, smtpgreeting, localiphost, badmailfrom, databytes, timeoutsmtpd
+*/
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/smtpd"
+)
+
+// serve runs a session on c, cfg is copied
+func serve(cfg smtpd.Config, c net.Conn, logger *log.Logger) {
+	defer c.Close()
+	cfg.RemoteIP, _, _ = net.SplitHostPort(c.RemoteAddr().String())
+	cfg.RemoteHost = "unknown"
+	if names, err := net.LookupAddr(cfg.RemoteIP); err == nil && len(names) > 0 {
+		cfg.RemoteHost = strings.TrimSuffix(names[0], ".")
+	}
+	cfg.LocalHost = cfg.Me
+	s := smtpd.NewConnSession(&cfg, c)
+	s.Log = logger
+	s.Serve()
+}
+
+// listen accepts connections on ln, at most max at a time. Accept errors
+// (too many open files...) are logged and retried after a delay, as
+// net/http does.
+func listen(ln net.Listener, cfg *smtpd.Config, sem chan struct{}, logger *log.Logger) {
+	var delay time.Duration
+	for {
+		c, err := ln.Accept()
+		if err != nil {
+			if delay == 0 {
+				delay = 5 * time.Millisecond
+			} else if delay *= 2; delay > time.Second {
+				delay = time.Second
+			}
+			logger.Printf("warning: accept on %s: %s, retrying in %s", ln.Addr(), err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		sem <- struct{}{}
+		go func() {
+			serve(*cfg, c, logger)
+			<-sem
+		}()
+	}
+}
+
+// setUser makes the process run as the user name, with its group
+func setUser(name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	if err = syscall.Setgroups([]int{gid}); err != nil {
+		return err
+	}
+	if err = syscall.Setgid(gid); err != nil {
+		return err
+	}
+	return syscall.Setuid(uid)
+}
+
+func main() {
+	addr := flag.String("listen", ":587", "submission address (STARTTLS), empty to disable")
+	addrTLS := flag.String("listentls", ":465", "submission address with implicit TLS, empty to disable")
+	cert := flag.String("cert", control.Path("control/servercert.pem"), "certificate (PEM)")
+	key := flag.String("key", "", "private key (PEM), default in the certificate file")
+	maxSessions := flag.Int("c", 40, "max simultaneous sessions")
+	runAs := flag.String("u", "qmaild", "user to run sessions as when started as root, empty to keep root")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: qmail-submission [options] checkpassword subprogram\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 1 {
+		flag.Usage()
+		os.Exit(100)
+	}
+	logger := log.New(os.Stderr, "qmail-submission: ", 0)
+
+	cfg, err := smtpd.ReadConfig()
+	if err != nil {
+		logger.Fatalf("unable to read controls: %s", err)
+	}
+	if *key == "" {
+		*key = *cert
+	}
+	pair, err := tls.LoadX509KeyPair(*cert, *key)
+	if err != nil {
+		logger.Fatalf("unable to load certificate %s: %s", *cert, err)
+	}
+	cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{pair}}
+	cfg.Checkpassword = flag.Args()
+	cfg.AuthRequired = true
+	// relaying is for authenticated users only
+	cfg.RelayClient = nil
+
+	var listeners []net.Listener
+	if *addr != "" {
+		ln, err := net.Listen("tcp", *addr)
+		if err != nil {
+			logger.Fatalf("unable to listen on %s: %s", *addr, err)
+		}
+		listeners = append(listeners, ln)
+	}
+	if *addrTLS != "" {
+		ln, err := net.Listen("tcp", *addrTLS)
+		if err != nil {
+			logger.Fatalf("unable to listen on %s: %s", *addrTLS, err)
+		}
+		listeners = append(listeners, tls.NewListener(ln, cfg.TLSConfig))
+	}
+	// ports are bound and the certificate read, sessions don't need root
+	if os.Geteuid() == 0 && *runAs != "" {
+		if err = setUser(*runAs); err != nil {
+			logger.Fatalf("unable to run as %s: %s", *runAs, err)
+		}
+	}
+	sem := make(chan struct{}, *maxSessions)
+	for _, ln := range listeners {
+		go listen(ln, cfg, sem, logger)
+	}
+	select {}
+}
@@ -0,0 +1,305 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package qmailqueue injects messages in the qmail queue with qmail-queue,
+// or the program named in $QMAILQUEUE (as with the qmail-queue patch).
+// The message is written on fd 0 of qmail-queue, the envelope on fd 1.
+package qmailqueue
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+// Error is a qmail-queue failure, as reported by qmail-smtpd
+type Error struct {
+	Code      int // exit code of qmail-queue, -1 if it crashed
+	Permanent bool
+	Msg       string // ex: "qq write error or disk full (#4.3.0)"
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+// exitError returns the error for a qmail-queue exit code, nil for
+// success (same messages as qmail.c)
+func exitError(code int) *Error {
+	perm := func(msg string) *Error { return &Error{code, true, msg} }
+	temp := func(msg string) *Error { return &Error{code, false, msg} }
+	switch code {
+	case 0:
+		return nil
+	case -1:
+		return temp("qq crashed (#4.3.0)")
+	case 11, 115:
+		return perm("envelope address too long for qq (#5.1.3)")
+	case 31:
+		return perm("mail server permanently rejected message (#5.3.0)")
+	case 51:
+		return temp("qq out of memory (#4.3.0)")
+	case 52:
+		return temp("qq timeout (#4.3.0)")
+	case 53:
+		return temp("qq write error or disk full (#4.3.0)")
+	case 54:
+		return temp("qq read error (#4.3.0)")
+	case 55:
+		return temp("qq unable to read configuration (#4.3.0)")
+	case 56:
+		return temp("qq trouble making network connection (#4.3.0)")
+	case 61:
+		return temp("qq trouble in home directory (#4.3.0)")
+	case 62, 63, 64, 65, 66:
+		return temp("qq trouble creating files in queue (#4.3.0)")
+	case 71:
+		return temp("mail server temporarily rejected message (#4.3.0)")
+	case 72:
+		return temp("connection to mail server timed out (#4.4.1)")
+	case 73:
+		return temp("connection to mail server rejected (#4.4.1)")
+	case 74:
+		return temp("communication with mail server failed (#4.4.2)")
+	case 81, 91:
+		return temp("qq internal bug (#4.3.0)")
+	case 120:
+		return temp("unable to exec qq (#4.3.0)")
+	}
+	if code >= 11 && code <= 40 {
+		return perm("qq permanent problem (#5.3.0)")
+	}
+	return temp("qq temporary problem (#4.3.0)")
+}
+
+// Program returns the path of the queueing program
+func Program() string {
+	if p := os.Getenv("QMAILQUEUE"); p != "" {
+		return p
+	}
+	return control.Path("bin/qmail-queue")
+}
+
+// Queue is a running qmail-queue
+type Queue struct {
+	cmd      *exec.Cmd
+	msg, env *os.File // our ends of fd 0 and fd 1
+	err      error    // write error
+}
+
+// UUIDEnv is the environment variable with which qmail-smtpd and
+// qmail-submission give qmail-queue the X-QB-UUID they stamped : wrappers
+// (policy, milter) may add fields above it. qmail-queue only trusts it
+// from qmaild or root.
+const UUIDEnv = "QBUUID"
+
+// Open starts qmail-queue
+func Open() (*Queue, error) {
+	return OpenProgram(Program())
+}
+
+// OpenUUID starts qmail-queue for a message stamped with X-QB-UUID id
+func OpenUUID(id string) (*Queue, error) {
+	return open(Program(), []string{UUIDEnv + "=" + id})
+}
+
+// OpenProgram starts name as qmail-queue, for wrappers which can't use
+// $QMAILQUEUE (themselves)
+func OpenProgram(name string, args ...string) (*Queue, error) {
+	return open(name, nil, args...)
+}
+
+// open starts name with env added to the environment
+func open(name string, env []string, args ...string) (*Queue, error) {
+	msgR, msgW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	envR, envW, err := os.Pipe()
+	if err != nil {
+		msgR.Close()
+		msgW.Close()
+		return nil, err
+	}
+	q := &Queue{cmd: exec.Command(name, args...), msg: msgW, env: envW}
+	q.cmd.Stdin, q.cmd.Stdout, q.cmd.Stderr = msgR, envR, os.Stderr
+	if env != nil {
+		q.cmd.Env = append(os.Environ(), env...)
+	}
+	err = q.cmd.Start()
+	msgR.Close()
+	envR.Close()
+	if err != nil {
+		msgW.Close()
+		envW.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+// Pid returns the pid of qmail-queue (the qp of qmail-smtpd replies)
+func (q *Queue) Pid() int {
+	return q.cmd.Process.Pid
+}
+
+// Write writes a part of the message, lines ending with LF. After an
+// error the message won't be queued.
+func (q *Queue) Write(p []byte) (int, error) {
+	if q.err != nil {
+		return 0, q.err
+	}
+	n, err := q.msg.Write(p)
+	q.err = err
+	return n, err
+}
+
+// Close sends the envelope and waits for qmail-queue. A message which
+// wasn't queued gives an *Error.
+func (q *Queue) Close(sender string, recipients []string) error {
+	q.msg.Close()
+	if q.err == nil {
+		var env strings.Builder
+		env.WriteString("F" + sender + "\x00")
+		for _, r := range recipients {
+			env.WriteString("T" + r + "\x00")
+		}
+		env.WriteString("\x00")
+		_, q.err = q.env.WriteString(env.String())
+	}
+	return q.wait()
+}
+
+// Abort makes qmail-queue exit without queueing the message : it gets no
+// envelope
+func (q *Queue) Abort() {
+	if q.err == nil {
+		q.err = &Error{Code: 54, Msg: "qq read error (#4.3.0)"}
+	}
+	q.msg.Close()
+	q.wait()
+}
+
+func (q *Queue) wait() error {
+	q.env.Close()
+	code := 0
+	if err := q.cmd.Wait(); err != nil {
+		ee, ok := err.(*exec.ExitError)
+		if !ok {
+			return &Error{Code: -1, Msg: "qq crashed (#4.3.0)"}
+		}
+		code = ee.ExitCode()
+	}
+	if e := exitError(code); e != nil {
+		return e
+	}
+	if q.err != nil {
+		// qmail-queue didn't get the whole message
+		return exitError(54)
+	}
+	return nil
+}
+
+// ErrEnvelope is a malformed envelope
+var ErrEnvelope = errors.New("bad envelope")
+
+// ReadEnvelope reads an envelope as qmail-queue gets it on fd 1 :
+// "Fsender\0Trecipient\0...\0"
+func ReadEnvelope(r io.Reader) (sender string, recipients []string, err error) {
+	br := bufio.NewReader(r)
+	for {
+		f, err := br.ReadString(0)
+		if err != nil {
+			if err == io.EOF {
+				err = ErrEnvelope
+			}
+			return "", nil, err
+		}
+		f = f[:len(f)-1]
+		switch {
+		case f == "" && sender != "":
+			return sender[1:], recipients, nil
+		case f != "" && f[0] == 'F' && sender == "":
+			sender = f
+		case f != "" && f[0] == 'T' && sender != "":
+			recipients = append(recipients, f[1:])
+		default:
+			return "", nil, ErrEnvelope
+		}
+	}
+}
+
+// ReadInput reads what a qmail-queue wrapper gets : the message on fd 0,
+// spooled to an unlinked temporary file since the envelope only comes
+// after it, on fd 1. Failures are *Error with the code to exit with.
+func ReadInput() (msg *os.File, sender string, recipients []string, err error) {
+	if msg, err = ioutil.TempFile("", "qmail-queue"); err != nil {
+		return nil, "", nil, &Error{Code: 53, Msg: "unable to create temporary file: " + err.Error()}
+	}
+	os.Remove(msg.Name())
+	if _, err = io.Copy(msg, os.Stdin); err == nil {
+		_, err = msg.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		msg.Close()
+		return nil, "", nil, &Error{Code: 54, Msg: "unable to read message: " + err.Error()}
+	}
+	if sender, recipients, err = ReadEnvelope(os.Stdout); err != nil {
+		msg.Close()
+		if err == ErrEnvelope {
+			return nil, "", nil, &Error{Code: 91, Permanent: true, Msg: "bad envelope"}
+		}
+		return nil, "", nil, &Error{Code: 54, Msg: "unable to read envelope: " + err.Error()}
+	}
+	return msg, sender, recipients, nil
+}
+
+// Pass gives a message to the qmail-queue program name, for wrappers
+func Pass(msg io.Reader, sender string, recipients []string, name string, args ...string) error {
+	q, err := OpenProgram(name, args...)
+	if err != nil {
+		return exitError(120)
+	}
+	if _, err = io.Copy(q, msg); err != nil && q.err == nil {
+		// read error
+		q.Abort()
+		return &Error{Code: 54, Msg: "unable to read message: " + err.Error()}
+	}
+	return q.Close(sender, recipients)
+}
+
+// ExitCode returns the code a wrapper exits with after err : 0 for
+// success, the code of qmail-queue otherwise
+func ExitCode(err error) int {
+	e, ok := err.(*Error)
+	switch {
+	case err == nil:
+		return 0
+	case !ok:
+		return 81
+	case e.Code < 0:
+		// crashed
+		return 81
+	}
+	return e.Code
+}
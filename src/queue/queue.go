@@ -0,0 +1,230 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package queue writes messages in the qmail queue (/var/qmail/queue) as
+// qmail-queue does : the message is written in pid/ then linked in mess/
+// (its inode is its number), the envelope is written in intd/ and linked
+// in todo/, then qmail-send is triggered. Each file is synced before the
+// next step, a message in todo/ is safe. It also reads the messages
+// preprocessed by qmail-send (info/, local/, remote/).
+package queue
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+// maxAddr is ADDR of qmail-queue.c, NUL included
+const maxAddr = 1003
+
+// defaultSplit is conf-split of qmail
+const defaultSplit = 23
+
+// Error is a failure, Code is the exit code of qmail-queue for it
+type Error struct {
+	Code int
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s (%d)", e.Err, e.Code)
+}
+
+// Queue is a qmail queue
+type Queue struct {
+	Dir   string
+	Split int // conf-split, the number of subdirectories of mess/
+}
+
+// Open returns the queue of the qmail installation. Split is compiled in
+// qmail, it is read from the number of subdirectories of mess/.
+func Open() *Queue {
+	return OpenDir(control.Path("queue"))
+}
+
+// OpenDir returns the queue in dir
+func OpenDir(dir string) *Queue {
+	q := &Queue{Dir: dir, Split: defaultSplit}
+	if fis, err := ioutil.ReadDir(filepath.Join(q.Dir, "mess")); err == nil && len(fis) > 0 {
+		q.Split = len(fis)
+	}
+	return q
+}
+
+// Path returns the file of message id in sub ("mess", "info", "todo"...).
+// intd/ and todo/ are not split.
+func (q *Queue) Path(sub string, id uint64) string {
+	n := strconv.FormatUint(id, 10)
+	if sub == "intd" || sub == "todo" {
+		return filepath.Join(q.Dir, sub, n)
+	}
+	return filepath.Join(q.Dir, sub, strconv.FormatUint(id%uint64(q.Split), 10), n)
+}
+
+// readErr marks read errors of the message, to tell them from write
+// errors
+type readErr struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readErr) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return n, err
+}
+
+// injection is a message being queued, its files are removed if it fails
+type injection struct {
+	pid, mess, intd string
+}
+
+func (i *injection) fail(code int, err error) *Error {
+	for _, f := range []string{i.intd, i.mess, i.pid} {
+		if f != "" {
+			os.Remove(f)
+		}
+	}
+	return &Error{code, err}
+}
+
+// Inject queues header and the message read on msg (lines ending with
+// LF) with the envelope read on env ("Fsender\0Trecipient\0...\0"), as
+// user uid and process pid, and returns the message number
+func (q *Queue) Inject(header string, msg, env io.Reader, uid, pid int, now time.Time) (uint64, error) {
+	if _, err := os.Stat(q.Dir); err != nil {
+		return 0, &Error{62, err}
+	}
+	var inj injection
+	var f *os.File
+	var err error
+	for seq := 1; seq < 10 && f == nil; seq++ {
+		inj.pid = filepath.Join(q.Dir, "pid", fmt.Sprintf("%d.%d.%d", pid, now.Unix(), seq))
+		f, err = os.OpenFile(inj.pid, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if f == nil {
+		inj.pid = ""
+		return 0, &Error{63, err}
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, inj.fail(63, err)
+	}
+	id := fi.Sys().(*syscall.Stat_t).Ino
+	if err = os.Link(inj.pid, q.Path("mess", id)); err != nil {
+		return 0, inj.fail(64, err)
+	}
+	inj.mess = q.Path("mess", id)
+	if err = os.Remove(inj.pid); err != nil {
+		return 0, inj.fail(63, err)
+	}
+	inj.pid = ""
+
+	// message
+	w := bufio.NewWriter(f)
+	w.WriteString(header)
+	r := &readErr{r: msg}
+	if _, err = io.Copy(w, r); r.err != nil {
+		return 0, inj.fail(54, r.err)
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		return 0, inj.fail(53, err)
+	}
+
+	// envelope
+	intd, err := os.OpenFile(q.Path("intd", id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, inj.fail(65, err)
+	}
+	inj.intd = intd.Name()
+	defer intd.Close()
+	w = bufio.NewWriter(intd)
+	fmt.Fprintf(w, "u%d\x00p%d\x00", uid, pid)
+	if code, err := copyEnvelope(w, bufio.NewReader(env)); err != nil {
+		return 0, inj.fail(code, err)
+	}
+	if err = w.Flush(); err == nil {
+		err = intd.Sync()
+	}
+	if err != nil {
+		return 0, inj.fail(53, err)
+	}
+	if err = os.Link(inj.intd, q.Path("todo", id)); err != nil {
+		return 0, inj.fail(66, err)
+	}
+	q.trigger()
+	return id, nil
+}
+
+// copyEnvelope checks and copies the envelope, without its final NUL
+func copyEnvelope(w *bufio.Writer, r *bufio.Reader) (code int, err error) {
+	for first := true; ; first = false {
+		c, err := r.ReadByte()
+		if err != nil {
+			return 54, err
+		}
+		if c == 0 && !first {
+			return 0, nil
+		}
+		if (first && c != 'F') || (!first && c != 'T') {
+			return 91, fmt.Errorf("bad envelope")
+		}
+		w.WriteByte(c)
+		for n := 0; ; n++ {
+			if n == maxAddr {
+				return 11, fmt.Errorf("address too long")
+			}
+			c, err = r.ReadByte()
+			if err != nil {
+				return 54, err
+			}
+			w.WriteByte(c)
+			if c == 0 {
+				break
+			}
+		}
+	}
+}
+
+// trigger wakes up qmail-send, if it is running
+func (q *Queue) trigger() {
+	f, err := os.OpenFile(filepath.Join(q.Dir, "lock", "trigger"), os.O_WRONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return
+	}
+	f.Write([]byte{0})
+	f.Close()
+}
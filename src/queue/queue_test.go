@@ -0,0 +1,134 @@
+package queue
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func newQueue(t *testing.T) *Queue {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"pid", "intd", "todo", "lock"} {
+		os.MkdirAll(filepath.Join(dir, d), 0755)
+	}
+	for i := 0; i < 3; i++ {
+		os.MkdirAll(filepath.Join(dir, "mess", strconv.Itoa(i)), 0755)
+	}
+	return &Queue{Dir: dir, Split: 3}
+}
+
+// files returns the files of a queue directory
+func files(q *Queue, sub string) []string {
+	var names []string
+	filepath.Walk(filepath.Join(q.Dir, sub), func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			names = append(names, path)
+		}
+		return nil
+	})
+	return names
+}
+
+func TestInject(t *testing.T) {
+	q := newQueue(t)
+	defer os.RemoveAll(q.Dir)
+	trigger := filepath.Join(q.Dir, "lock", "trigger")
+	if err := syscall.Mkfifo(trigger, 0622); err != nil {
+		t.Fatal(err)
+	}
+	fifo, err := os.OpenFile(trigger, os.O_RDONLY|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fifo.Close()
+
+	now := time.Unix(1400000000, 0)
+	id, err := q.Inject("Received: test\n", strings.NewReader("Subject: hi\n\nbody\n"), strings.NewReader("Fa@example.org\x00Tb@example.com\x00Tc@example.com\x00\x00"), 1000, 42, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mess, _ := ioutil.ReadFile(q.Path("mess", id)); string(mess) != "Received: test\nSubject: hi\n\nbody\n" {
+		t.Errorf("got message %q", mess)
+	}
+	if todo, _ := ioutil.ReadFile(q.Path("todo", id)); string(todo) != "u1000\x00p42\x00Fa@example.org\x00Tb@example.com\x00Tc@example.com\x00" {
+		t.Errorf("got envelope %q", todo)
+	}
+	if _, err = os.Stat(q.Path("intd", id)); err != nil {
+		t.Error(err)
+	}
+	if pid := files(q, "pid"); len(pid) != 0 {
+		t.Errorf("pid files left: %v", pid)
+	}
+	b := make([]byte, 2)
+	if n, _ := fifo.Read(b); n != 1 {
+		t.Errorf("qmail-send not triggered")
+	}
+}
+
+func TestInjectErrors(t *testing.T) {
+	q := newQueue(t)
+	defer os.RemoveAll(q.Dir)
+	for env, code := range map[string]int{
+		"Ta@example.org\x00\x00":                        91,
+		"Fa@example.org\x00Xb@example.com\x00\x00":      91,
+		"Fa@example.org\x00Tb@example.com\x00":          54,
+		"F" + strings.Repeat("a", maxAddr) + "\x00\x00": 11,
+	} {
+		_, err := q.Inject("", strings.NewReader("body\n"), strings.NewReader(env), 0, 1, time.Now())
+		if e, ok := err.(*Error); !ok || e.Code != code {
+			t.Errorf("%q: got %v, want code %d", env, err, code)
+		}
+	}
+	for _, sub := range []string{"pid", "mess", "intd", "todo"} {
+		if f := files(q, sub); len(f) != 0 {
+			t.Errorf("%s files left: %v", sub, f)
+		}
+	}
+	// the longest address
+	if _, err := q.Inject("", strings.NewReader("body\n"), strings.NewReader("F"+strings.Repeat("a", maxAddr-1)+"\x00\x00"), 0, 1, time.Now()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestList(t *testing.T) {
+	q := newQueue(t)
+	defer os.RemoveAll(q.Dir)
+	write := func(sub string, id uint64, content string, mtime int64) {
+		os.MkdirAll(filepath.Dir(q.Path(sub, id)), 0755)
+		ioutil.WriteFile(q.Path(sub, id), []byte(content), 0644)
+		os.Chtimes(q.Path(sub, id), time.Unix(mtime, 0), time.Unix(mtime, 0))
+	}
+	write("mess", 10, "X-QB-UUID: 1234\nSubject: hi\n\nbody\n", 0)
+	write("info", 10, "Fa@example.org\x00", 1400000100)
+	write("remote", 10, "Db@example.com\x00Tc@example.com\x00", 0)
+	write("local", 10, "Tjoe@example.net\x00", 0)
+	write("mess", 4, "Subject: bounce\n\n", 0)
+	write("info", 4, "F\x00", 1400000000)
+	write("remote", 4, "Td@example.com\x00", 0)
+	// not preprocessed yet
+	write("mess", 7, "Subject: new\n\n", 0)
+
+	entries, err := q.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries", len(entries))
+	}
+	e := entries[1]
+	if e.ID != 10 || e.Sender != "a@example.org" || e.UUID != "1234" || e.Size != 34 || e.Time.Unix() != 1400000100 ||
+		strings.Join(e.Remote, ",") != "c@example.com" || strings.Join(e.Local, ",") != "joe@example.net" {
+		t.Errorf("got %+v", e)
+	}
+	if e = entries[0]; e.ID != 4 || e.Sender != "" || e.UUID != "" || len(e.Local) != 0 {
+		t.Errorf("got %+v", e)
+	}
+}
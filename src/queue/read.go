@@ -0,0 +1,132 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package queue
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Entry is a message of the queue, as qmail-send sees it
+type Entry struct {
+	ID     uint64
+	Time   time.Time // arrival, mtime of info/ as qmail-qread shows it
+	Size   int64
+	Sender string
+	UUID   string   // X-QB-UUID of the message, "" if none
+	Remote []string // remote recipients not done yet
+	Local  []string // local recipients not done yet
+}
+
+// recipients returns the recipients of a local/ or remote/ file not
+// done yet : "Taddr\0" lines, qmail-send marks done ones with D
+func recipients(file string) ([]string, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	var rcpts []string
+	for _, r := range bytes.Split(b, []byte{0}) {
+		if len(r) > 1 && r[0] == 'T' {
+			rcpts = append(rcpts, string(r[1:]))
+		}
+	}
+	return rcpts, err
+}
+
+// Read returns the message id, preprocessed by qmail-send (it has an
+// info/ file)
+func (q *Queue) Read(id uint64) (*Entry, error) {
+	e := &Entry{ID: id}
+	info := q.Path("info", id)
+	b, err := ioutil.ReadFile(info)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 0 && b[0] == 'F' {
+		e.Sender = string(bytes.TrimRight(b[1:], "\x00"))
+	}
+	fi, err := os.Stat(info)
+	if err != nil {
+		return nil, err
+	}
+	e.Time = fi.ModTime()
+	if e.Remote, err = recipients(q.Path("remote", id)); err != nil {
+		return nil, err
+	}
+	if e.Local, err = recipients(q.Path("local", id)); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(q.Path("mess", id))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err = f.Stat(); err != nil {
+		return nil, err
+	}
+	e.Size = fi.Size()
+	h, _ := textproto.NewReader(bufio.NewReader(f)).ReadMIMEHeader()
+	e.UUID = h.Get("X-QB-UUID")
+	return e, nil
+}
+
+// List returns the messages of the queue, oldest first. Messages
+// removed while the queue is read are skipped.
+func (q *Queue) List() ([]*Entry, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(q.Dir, "info"))
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for _, d := range dirs {
+		fis, err := ioutil.ReadDir(filepath.Join(q.Dir, "info", d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range fis {
+			id, err := strconv.ParseUint(fi.Name(), 10, 64)
+			if err != nil {
+				continue
+			}
+			e, err := q.Read(id)
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].ID < entries[j].ID
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	return entries, nil
+}
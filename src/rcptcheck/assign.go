@@ -0,0 +1,80 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package rcptcheck
+
+import (
+	"os"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+// assignEntry is a users/assign line
+type assignEntry struct {
+	home string
+	dash string
+	ext  string // ext of "=" lines, pre of "+" lines
+}
+
+// assign is users/assign
+// =local:user:uid:gid:homedir:dash:ext:
+// +prefix:user:uid:gid:homedir:dash:pre:
+type assign struct {
+	exact    map[string]assignEntry
+	prefixes map[string]assignEntry
+}
+
+// readAssign reads users/assign, nil if there is none
+func readAssign() (*assign, error) {
+	lines, err := control.ReadLines("users/assign")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	a := &assign{exact: make(map[string]assignEntry), prefixes: make(map[string]assignEntry)}
+	for _, l := range lines {
+		if l == "." {
+			break
+		}
+		t := strings.Split(l, ":")
+		if len(t) < 7 || (l[0] != '=' && l[0] != '+') {
+			continue
+		}
+		e := assignEntry{home: t[4], dash: t[5], ext: t[6]}
+		if l[0] == '=' {
+			a.exact[strings.ToLower(t[0][1:])] = e
+		} else {
+			a.prefixes[strings.ToLower(t[0][1:])] = e
+		}
+	}
+	return a, nil
+}
+
+// wildcard returns the entry of the longest prefix of local and the rest
+// of local
+func (a *assign) wildcard(local string) (e assignEntry, rest string, ok bool) {
+	for i := len(local); i >= 0; i-- {
+		if e, ok = a.prefixes[local[:i]]; ok {
+			return e, local[i:], true
+		}
+	}
+	return
+}
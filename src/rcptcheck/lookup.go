@@ -0,0 +1,91 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package rcptcheck
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/cdb"
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+// Lookup tells if an address (lower cased) exists
+type Lookup interface {
+	Exists(addr string) (bool, error)
+}
+
+// cdbLookup looks addresses up in a cdb. A "@domain" key accepts the
+// whole domain.
+type cdbLookup struct {
+	file string
+}
+
+func (l cdbLookup) Exists(addr string) (bool, error) {
+	db, err := cdb.Open(l.file)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+	if ok, err := db.Has([]byte(addr)); ok || err != nil {
+		return ok, err
+	}
+	return db.Has([]byte(addr[strings.LastIndexByte(addr, '@'):]))
+}
+
+// programLookup runs a program with the address as last argument.
+// Exit codes : 0 exists, 100 unknown, anything else is a failure.
+type programLookup struct {
+	args []string
+}
+
+func (l programLookup) Exists(addr string) (bool, error) {
+	cmd := exec.Command(l.args[0], append(l.args[1:], addr)...)
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err == nil {
+		return true, nil
+	}
+	if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() == 100 {
+		return false, nil
+	}
+	return false, fmt.Errorf("%s: %s", l.args[0], err)
+}
+
+// loadLookup returns the lookup defined in control/rcptcheck, nil if none
+// control/rcptcheck :
+// cdb:/var/qmail/control/validrcptto.cdb
+// program:/usr/local/bin/checkuser arg...
+func loadLookup() (Lookup, error) {
+	def, err := control.ReadFirstLine("control/rcptcheck", "")
+	if err != nil || def == "" {
+		return nil, err
+	}
+	switch {
+	case strings.HasPrefix(def, "cdb:"):
+		return cdbLookup{def[4:]}, nil
+	case strings.HasPrefix(def, "program:"):
+		if args := strings.Fields(def[8:]); len(args) > 0 {
+			return programLookup{args}, nil
+		}
+	}
+	return nil, fmt.Errorf("bad format for control/rcptcheck")
+}
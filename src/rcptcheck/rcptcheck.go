@@ -0,0 +1,209 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package rcptcheck tells if a recipient exists before the message is
+// accepted, following the qmail delivery rules : control/locals,
+// control/virtualdomains, users/assign, the passwd file and the .qmail
+// files of ~alias. A lookup defined in control/rcptcheck (cdb or program)
+// may replace the users/assign, passwd and .qmail rules.
+// When in doubt (unreadable files, lookup failures) recipients exist.
+package rcptcheck
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+// Result is the outcome of a check
+type Result int
+
+// Results
+const (
+	NotLocal Result = iota // not delivered here, rcpthosts decides
+	Exists
+	Unknown
+)
+
+// Checker checks recipients
+type Checker struct {
+	locals  map[string]bool
+	virtual map[string]string // "user@domain", "domain", ".domain" or "" -> prefix
+	assign  *assign           // nil if there is no users/assign
+	lookup  Lookup            // replaces the qmail rules if not nil
+
+	// home returns the home directory of a system user, ok is false if
+	// there is no such user (root doesn't get mail)
+	home func(name string) (dir string, ok bool)
+}
+
+// passwdHome is the home function of the passwd file
+func passwdHome(name string) (string, bool) {
+	u, err := user.Lookup(name)
+	if err != nil || u.Uid == "0" {
+		return "", false
+	}
+	return u.HomeDir, true
+}
+
+// readMap returns the "key:value" lines of an optional control file, keys
+// lower cased
+func readMap(file string) (map[string]string, error) {
+	lines, err := control.ReadLines(file)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	m := make(map[string]string, len(lines))
+	for _, l := range lines {
+		if i := strings.LastIndexByte(l, ':'); i >= 0 {
+			m[strings.ToLower(l[:i])] = l[i+1:]
+		}
+	}
+	return m, nil
+}
+
+// Load returns a Checker configured by control files
+func Load() (*Checker, error) {
+	c := &Checker{locals: make(map[string]bool), home: passwdHome}
+	locals, err := control.ReadLines("control/locals")
+	if os.IsNotExist(err) {
+		// qmail defaults to control/me
+		locals, err = control.ReadLines("control/me")
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, l := range locals {
+		c.locals[strings.ToLower(l)] = true
+	}
+	if c.virtual, err = readMap("control/virtualdomains"); err != nil {
+		return nil, err
+	}
+	if c.assign, err = readAssign(); err != nil {
+		return nil, err
+	}
+	if c.lookup, err = loadLookup(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// localPart returns the local part addr is delivered to by qmail-lspawn,
+// ok is false if addr is not delivered here
+func (c *Checker) localPart(addr string) (local string, ok bool) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 1 {
+		return "", false
+	}
+	addr = strings.ToLower(addr)
+	local, domain := addr[:i], addr[i+1:]
+	if c.locals[domain] {
+		return local, true
+	}
+	prefix, ok := c.virtual[addr]
+	if !ok {
+		prefix, ok = c.virtual[domain]
+	}
+	for j := 0; !ok && j < len(domain); j++ {
+		if domain[j] == '.' {
+			prefix, ok = c.virtual[domain[j:]]
+		}
+	}
+	if !ok {
+		prefix, ok = c.virtual[""]
+	}
+	if !ok || prefix == "" {
+		return "", false
+	}
+	return prefix + "-" + local, true
+}
+
+// Check tells if addr exists
+func (c *Checker) Check(addr string) (Result, error) {
+	local, ok := c.localPart(addr)
+	if !ok {
+		return NotLocal, nil
+	}
+	var exists bool
+	var err error
+	if c.lookup != nil {
+		exists, err = c.lookup.Exists(strings.ToLower(addr))
+	} else {
+		exists, err = c.exists(local)
+	}
+	if err != nil || exists {
+		return Exists, err
+	}
+	return Unknown, nil
+}
+
+// exists tells if qmail-local would deliver to local
+func (c *Checker) exists(local string) (bool, error) {
+	if c.assign != nil {
+		if e, ok := c.assign.exact[local]; ok {
+			return dotQmailExists(e.home, e.dash, e.ext)
+		}
+		if e, rest, ok := c.assign.wildcard(local); ok {
+			return dotQmailExists(e.home, e.dash, e.ext+rest)
+		}
+	}
+	// qmail-getpw : the longest user name followed by "-" or the end
+	for i := len(local); i > 0; i = strings.LastIndexByte(local[:i], '-') {
+		if home, ok := c.home(local[:i]); ok {
+			if i == len(local) {
+				return true, nil
+			}
+			return dotQmailExists(home, "-", local[i+1:])
+		}
+	}
+	home, ok := c.home("alias")
+	if !ok {
+		return true, nil
+	}
+	return dotQmailExists(home, "-", local)
+}
+
+// dotQmailExists tells if there is a .qmail file for ext in home :
+// .qmail-ext, then .qmail-foo-default for ext foo-bar, then .qmail-default
+func dotQmailExists(home, dash, ext string) (bool, error) {
+	if dash == "" && ext == "" {
+		return true, nil
+	}
+	// qmail-local replaces dots by colons
+	ext = strings.Replace(ext, ".", ":", -1)
+	names := []string{".qmail" + dash + ext}
+	for i := len(ext); i >= 0; i-- {
+		if i == 0 || ext[i-1] == '-' {
+			names = append(names, ".qmail"+dash+ext[:i]+"default")
+		}
+	}
+	for _, name := range names {
+		_, err := os.Stat(filepath.Join(home, name))
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			// can't tell
+			return true, err
+		}
+	}
+	return false, nil
+}
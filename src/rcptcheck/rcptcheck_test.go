@@ -0,0 +1,117 @@
+package rcptcheck
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/toorop/qmail-boosters/src/cdb"
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+func setup(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "rcptcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{"control", "users", "joe", "lists", "bob", "alias", "vu"} {
+		os.Mkdir(filepath.Join(dir, d), 0755)
+	}
+	write := func(name, content string) {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	}
+	write("control/locals", "example.com\n")
+	write("control/virtualdomains", "virtual.example:vu\nnot.virtual.example:\n")
+	write("users/assign", "=joe:joe:1001:1001:"+dir+"/joe:::\n+list-:lists:1002:1002:"+dir+"/lists:-::\n+vu-:vu:1003:1003:"+dir+"/vu:-::\n.\n")
+	write("lists/.qmail-announce", "")
+	write("bob/.qmail-x-default", "")
+	write("alias/.qmail-postmaster", "")
+	write("vu/.qmail-info", "")
+	old := control.QmailHome
+	control.QmailHome = dir
+	return dir, func() {
+		control.QmailHome = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+	c, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.home = func(name string) (string, bool) {
+		if name == "bob" || name == "alias" {
+			return filepath.Join(dir, name), true
+		}
+		return "", false
+	}
+	for addr, want := range map[string]Result{
+		"Joe@Example.com":               Exists,
+		"list-announce@example.com":     Exists,
+		"list-other@example.com":        Unknown,
+		"bob@example.com":               Exists,
+		"bob-x-y@example.com":           Exists,
+		"bob-y@example.com":             Unknown,
+		"postmaster@example.com":        Exists,
+		"nobody@example.com":            Unknown,
+		"info@virtual.example":          Exists,
+		"sales@virtual.example":         Unknown,
+		"a@not.virtual.example":         NotLocal,
+		"someone@elsewhere.example":     NotLocal,
+		"list-announce@sub.example.com": NotLocal,
+	} {
+		if got, err := c.Check(addr); got != want || err != nil {
+			t.Errorf("Check(%s): got %v, %v, want %v", addr, got, err, want)
+		}
+	}
+}
+
+func TestLookup(t *testing.T) {
+	dir, cleanup := setup(t)
+	defer cleanup()
+
+	f, _ := os.Create(filepath.Join(dir, "control/valid.cdb"))
+	w, _ := cdb.NewWriter(f)
+	w.Put([]byte("nobody@example.com"), nil)
+	w.Put([]byte("@virtual.example"), nil)
+	w.Close()
+	f.Close()
+	ioutil.WriteFile(filepath.Join(dir, "control/rcptcheck"), []byte("cdb:"+f.Name()+"\n"), 0644)
+	c, err := Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]Result{
+		"Nobody@example.com":    Exists,
+		"joe@example.com":       Unknown,
+		"sales@virtual.example": Exists,
+		"a@elsewhere.example":   NotLocal,
+	} {
+		if got, err := c.Check(addr); got != want || err != nil {
+			t.Errorf("cdb: Check(%s): got %v, %v, want %v", addr, got, err, want)
+		}
+	}
+
+	script := filepath.Join(dir, "check")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\ncase \"$2\" in ok@*) exit 0;; bad@*) exit 100;; esac\nexit 111\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "control/rcptcheck"), []byte("program:"+script+" -x\n"), 0644)
+	if c, err = Load(); err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]Result{
+		"ok@example.com":   Exists,
+		"bad@example.com":  Unknown,
+		"temp@example.com": Exists, // lookup failure
+	} {
+		if got, _ := c.Check(addr); got != want {
+			t.Errorf("program: Check(%s): got %v, want %v", addr, got, want)
+		}
+	}
+	if _, err = c.Check("temp@example.com"); err == nil {
+		t.Error("program: no error for exit code 111")
+	}
+}
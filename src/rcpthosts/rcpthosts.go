@@ -0,0 +1,93 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package rcpthosts tells which domains we accept mail for, as
+// qmail-smtpd does with control/rcpthosts and control/morercpthosts.cdb.
+// Entries are domains, or ".domain" for all its subdomains.
+package rcpthosts
+
+import (
+	"os"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/cdb"
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+// Hosts is the list of domains we accept mail for
+type Hosts struct {
+	list map[string]bool
+	more *cdb.CDB
+}
+
+// New returns Hosts from a list of entries and an optional
+// morercpthosts.cdb
+func New(list []string, more *cdb.CDB) *Hosts {
+	h := &Hosts{list: make(map[string]bool, len(list)), more: more}
+	for _, e := range list {
+		h.list[strings.ToLower(e)] = true
+	}
+	return h
+}
+
+// Load reads control/rcpthosts and control/morercpthosts.cdb. It returns
+// nil if there is no rcpthosts file : every domain is allowed.
+func Load() (*Hosts, error) {
+	list, err := control.ReadLines("control/rcpthosts")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	more, err := cdb.Open(control.Path("control/morercpthosts.cdb"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return New(list, more), nil
+}
+
+func (h *Hosts) has(host string) bool {
+	if h.list[host] {
+		return true
+	}
+	if h.more != nil {
+		ok, _ := h.more.Has([]byte(host))
+		return ok
+	}
+	return false
+}
+
+// Allowed tells if we accept mail for addr. Addresses without domain are
+// allowed, as is everything with a nil Hosts.
+func (h *Hosts) Allowed(addr string) bool {
+	i := strings.LastIndexByte(addr, '@')
+	if h == nil || i < 0 {
+		return true
+	}
+	host := strings.ToLower(addr[i+1:])
+	if h.has(host) {
+		return true
+	}
+	for j := 0; j < len(host); j++ {
+		if host[j] == '.' && h.has(host[j:]) {
+			return true
+		}
+	}
+	return false
+}
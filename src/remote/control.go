@@ -0,0 +1,236 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package remote
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/breaker"
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/smtp"
+)
+
+// readControl returns the lines of a mandatory control file
+func readControl(ctrlFile string) ([]string, error) {
+	lines, err := control.ReadLines(ctrlFile)
+	if err != nil {
+		return nil, errControl(control.Path(ctrlFile))
+	}
+	return lines, nil
+}
+
+func errControl(msg string) *Failure {
+	return tempFailure("Unable to read control files: %s (#4.3.0)", msg)
+}
+
+func getHeloHost() (string, error) {
+	t, err := readControl("control/me")
+	if err != nil {
+		return "", err
+	}
+	if len(t) == 0 {
+		return "", errControl("Bad format for me file")
+	}
+	return strings.TrimSpace(t[0]), nil
+}
+
+// getHeloHostFor returns the HELO name to use when connecting from lAddr.
+// By order of preference : route override, control/helohost, PTR of lAddr,
+// control/me
+func (d *Deliverer) getHeloHostFor(lAddr string, route Route) (heloHost string, err error) {
+	key := fmt.Sprintf("%s;%s", lAddr, route.HeloHost)
+	d.mu.Lock()
+	heloHost, ok := d.heloHosts[key]
+	d.mu.Unlock()
+	if ok {
+		return
+	}
+	heloHost = route.HeloHost
+	if heloHost == "" {
+		// control/helohost
+		// localIP;heloName
+		mapping, _ := control.ReadLines("control/helohost")
+		for _, l := range mapping {
+			parsed := strings.Split(l, ";")
+			if len(parsed) == 2 && parsed[0] == lAddr {
+				heloHost = strings.TrimSpace(parsed[1])
+				break
+			}
+		}
+	}
+	// PTR
+	if heloHost == "" {
+		ptrs, err := net.LookupAddr(lAddr)
+		if err != nil || len(ptrs) == 0 {
+			if heloHost, err = getHeloHost(); err != nil {
+				return "", err
+			}
+		} else {
+			// Remove trailing dot
+			// Exchange doesn't like absolute FDQN
+			heloHost = strings.TrimSuffix(ptrs[0], ".")
+		}
+	}
+	if helocheckEnabled() {
+		d.checkFCrDNS(lAddr, heloHost)
+	}
+	d.mu.Lock()
+	d.heloHosts[key] = heloHost
+	d.mu.Unlock()
+	return
+}
+
+// helocheckEnabled returns true if control/helocheck is set to 1
+func helocheckEnabled() bool {
+	t, err := control.ReadLines("control/helocheck")
+	return err == nil && len(t) > 0 && t[0] == "1"
+}
+
+// checkFCrDNS checks that the PTR of lAddr and the A/AAAA records of
+// heloHost line up, and logs a warning (to qmail-send log via stderr) if not
+func (d *Deliverer) checkFCrDNS(lAddr, heloHost string) {
+	ptrOk := false
+	ptrs, _ := net.LookupAddr(lAddr)
+	for _, ptr := range ptrs {
+		if strings.EqualFold(strings.TrimSuffix(ptr, "."), heloHost) {
+			ptrOk = true
+			break
+		}
+	}
+	aOk := false
+	ips, _ := net.LookupIP(heloHost)
+	for _, ip := range ips {
+		if ip.Equal(net.ParseIP(lAddr)) {
+			aOk = true
+			break
+		}
+	}
+	if (!ptrOk || !aOk) && d.Warnings != nil {
+		fmt.Fprintf(d.Warnings, "qmail-remote: warning: HELO %s doesn't match local IP %s (PTR: %s, A/AAAA: %v)\n", heloHost, lAddr, strings.Join(ptrs, ","), ips)
+	}
+}
+
+// getTimeouts returns SMTP phase timeouts, RFC 5321 defaults overridden by
+// control/timeouts
+// phase;seconds
+func getTimeouts() (timeouts smtp.Timeouts, err error) {
+	timeouts = smtp.DefaultTimeouts
+	lines, err := control.ReadLines("control/timeouts")
+	if err != nil {
+		return timeouts, nil
+	}
+	for _, l := range lines {
+		parsed := strings.Split(l, ";")
+		if len(parsed) != 2 {
+			return timeouts, errControl("Bad format for timeouts file")
+		}
+		sec, err := strconv.Atoi(strings.TrimSpace(parsed[1]))
+		if err != nil || sec < 0 {
+			return timeouts, errControl("Bad format for timeouts file")
+		}
+		d := time.Duration(sec) * time.Second
+		switch strings.ToLower(strings.TrimSpace(parsed[0])) {
+		case "connect":
+			timeouts.Connect = d
+		case "greeting":
+			timeouts.Greeting = d
+		case "ehlo":
+			timeouts.Ehlo = d
+		case "starttls":
+			timeouts.StartTLS = d
+		case "auth":
+			timeouts.Auth = d
+		case "mail":
+			timeouts.Mail = d
+		case "rcpt":
+			timeouts.Rcpt = d
+		case "data":
+			timeouts.Data = d
+		case "datablock":
+			timeouts.DataBlock = d
+		case "datadone":
+			timeouts.DataDone = d
+		case "quit":
+			timeouts.Quit = d
+		default:
+			return timeouts, errControl(fmt.Sprintf("Unknown phase %s in timeouts file", parsed[0]))
+		}
+	}
+	return timeouts, nil
+}
+
+func getDefaultLocalAddr() (string, error) {
+	ip, err := readControl("control/defaultoutgoingip")
+	if err != nil {
+		return "", err
+	}
+	if len(ip) < 1 {
+		return "", errControl("Bad format for defaultOutgoingIp file")
+	}
+	return ip[0], nil
+}
+
+// getDeliveryLimits returns the max number of connections to remote hosts
+// and the max time spent on a delivery (control/maxattempts and
+// control/maxdeliverytime, in seconds)
+func getDeliveryLimits() (maxAttempts int, maxTime time.Duration, err error) {
+	maxAttempts = 10
+	maxTime = 900 * time.Second
+	if t, err := control.ReadLines("control/maxattempts"); err == nil && len(t) > 0 {
+		n, err := strconv.Atoi(t[0])
+		if err != nil || n < 1 {
+			return 0, 0, errControl("Bad format for maxattempts file")
+		}
+		maxAttempts = n
+	}
+	if t, err := control.ReadLines("control/maxdeliverytime"); err == nil && len(t) > 0 {
+		n, err := strconv.Atoi(t[0])
+		if err != nil || n < 1 {
+			return 0, 0, errControl("Bad format for maxdeliverytime file")
+		}
+		maxTime = time.Duration(n) * time.Second
+	}
+	return
+}
+
+// getBreaker returns the circuit breaker of remote addresses defined in
+// control/breaker ("failures;backoff" in seconds), nil if there is none
+func getBreaker() (*breaker.Breaker, error) {
+	t, err := control.ReadLines("control/breaker")
+	if err != nil || len(t) == 0 {
+		return nil, nil
+	}
+	p := strings.Split(t[0], ";")
+	if len(p) != 2 {
+		return nil, errControl("Bad format for breaker file")
+	}
+	failures, err := strconv.Atoi(p[0])
+	if err != nil || failures < 1 {
+		return nil, errControl("Bad format for breaker file")
+	}
+	backoff, err := strconv.Atoi(p[1])
+	if err != nil || backoff < 1 {
+		return nil, errControl("Bad format for breaker file")
+	}
+	return breaker.New(control.Path("breaker"), failures, time.Duration(backoff)*time.Second), nil
+}
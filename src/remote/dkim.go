@@ -0,0 +1,153 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package remote
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/dkim"
+)
+
+// loadKey reads the private key of selector in the key store
+// (control/dkimkeys/domain/selector)
+func loadKey(domain, selector string) (*dkim.Options, error) {
+	key, err := dkim.LoadKey(control.Path(fmt.Sprintf("control/dkimkeys/%s/%s", domain, selector)))
+	if err != nil {
+		return nil, tempFailure("Unable to read DKIM key %s/%s: %s (#4.3.0)", domain, selector, err)
+	}
+	return &dkim.Options{Domain: domain, Selector: selector, Signer: key}, nil
+}
+
+// matchControl returns the line of a per sender/route control file
+// (control/dkim, control/arc, control/senderrewrite) which applies to a
+// message from sender through route, nil if none.
+// By order of preference : "route:NAME", sender domain, "*"
+func matchControl(ctrlFile, sender string, route Route) ([]string, error) {
+	lines, err := control.ReadLines(ctrlFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errControl(control.Path(ctrlFile))
+	}
+	senderHost := ""
+	if t := strings.Split(sender, "@"); len(t) == 2 {
+		senderHost = t[1]
+	}
+	var match []string
+	rank := 0
+	for _, l := range lines {
+		parsed := strings.Split(l, ";")
+		if len(parsed) < 3 {
+			return nil, errControl(fmt.Sprintf("Bad format for %s file", ctrlFile))
+		}
+		r := 0
+		switch {
+		case parsed[0] == "route:"+route.Name:
+			r = 3
+		case senderHost != "" && strings.EqualFold(parsed[0], senderHost):
+			r = 2
+		case parsed[0] == "*":
+			r = 1
+		}
+		if r > rank {
+			match, rank = parsed, r
+		}
+	}
+	return match, nil
+}
+
+// dkimOptions returns the DKIM signing options for a message from sender
+// through route, nil if it is not to be signed
+// control/dkim :
+// senderDomain|route:NAME|*;domain;selector[;canonicalization[;headers]]
+func dkimOptions(sender string, route Route) (*dkim.Options, error) {
+	parsed, err := matchControl("control/dkim", sender, route)
+	if err != nil || parsed == nil {
+		return nil, err
+	}
+	o, err := loadKey(parsed[1], parsed[2])
+	if err != nil {
+		return nil, err
+	}
+	o.HeaderCanonicalization, o.BodyCanonicalization = dkim.Relaxed, dkim.Relaxed
+	if len(parsed) > 3 && parsed[3] != "" {
+		if o.HeaderCanonicalization, o.BodyCanonicalization, err = dkim.ParseCanonicalization(parsed[3]); err != nil {
+			return nil, errControl("Bad format for dkim file")
+		}
+	}
+	if len(parsed) > 4 && parsed[4] != "" {
+		o.Headers = strings.Split(parsed[4], ":")
+	}
+	return o, nil
+}
+
+// sign adds a DKIM signature at the top of msg if control/dkim says so.
+// A configured but unreadable key defers the message rather than sending
+// it unsigned.
+func sign(env *Envelope, msg Message, route Route) (Message, error) {
+	o, err := dkimOptions(env.Sender, route)
+	if err != nil || o == nil {
+		return msg, err
+	}
+	sig := ""
+	if _, err = msg.Seek(0, io.SeekStart); err == nil {
+		sig, err = dkim.Sign(msg, o)
+	}
+	if err != nil {
+		return nil, tempFailure("Unable to sign message: %s (#4.3.0)", err)
+	}
+	return withPrefix(sig, msg), nil
+}
+
+// seal adds an ARC set at the top of msg if control/arc says so
+// control/arc :
+// route:NAME|*;domain;selector[;authservid]
+// authservid defaults to control/me
+func seal(env *Envelope, msg Message, route Route) (Message, error) {
+	parsed, err := matchControl("control/arc", env.Sender, route)
+	if err != nil || parsed == nil {
+		return msg, err
+	}
+	o, err := loadKey(parsed[1], parsed[2])
+	if err != nil {
+		return nil, err
+	}
+	so := &dkim.SealOptions{Options: *o}
+	if len(parsed) > 3 && parsed[3] != "" {
+		so.AuthServID = parsed[3]
+	} else if so.AuthServID, err = getHeloHost(); err != nil {
+		return nil, err
+	}
+	set := ""
+	if _, err = msg.Seek(0, io.SeekStart); err == nil {
+		set, err = dkim.Seal(msg, so)
+	}
+	if err != nil {
+		return nil, tempFailure("Unable to seal message: %s (#4.3.0)", err)
+	}
+	if set == "" { // failed chain
+		return msg, nil
+	}
+	return withPrefix(set, msg), nil
+}
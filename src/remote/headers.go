@@ -0,0 +1,171 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package remote
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/dkim"
+)
+
+// headerOp is an operation of a header policy
+type headerOp struct {
+	op    string // remove, removere, add or replace
+	name  string
+	re    *regexp.Regexp
+	field string // added field, for add and replace
+}
+
+// getHeaderPolicy returns the header policy of route, nil if none
+// control/headers/ROUTE :
+// remove;NAME
+// removere;REGEXP (matched against the unfolded field)
+// add;NAME: VALUE
+// replace;NAME;VALUE
+func getHeaderPolicy(route Route) (ops []headerOp, err error) {
+	if route.Name == "" || strings.Contains(route.Name, "/") || strings.HasPrefix(route.Name, ".") {
+		return nil, nil
+	}
+	ctrlFile := "control/headers/" + route.Name
+	lines, err := control.ReadLines(ctrlFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errControl(control.Path(ctrlFile))
+	}
+	bad := errControl(fmt.Sprintf("Bad format for %s file", ctrlFile))
+	for _, l := range lines {
+		parsed := strings.SplitN(l, ";", 2)
+		if len(parsed) != 2 || parsed[1] == "" {
+			return nil, bad
+		}
+		op := headerOp{op: strings.ToLower(parsed[0])}
+		switch op.op {
+		case "remove":
+			op.name = parsed[1]
+		case "removere":
+			if op.re, err = regexp.Compile(parsed[1]); err != nil {
+				return nil, bad
+			}
+		case "add":
+			if !strings.Contains(parsed[1], ":") {
+				return nil, bad
+			}
+			op.field = parsed[1]
+		case "replace":
+			t := strings.SplitN(parsed[1], ";", 2)
+			if len(t) != 2 {
+				return nil, bad
+			}
+			op.name, op.field = t[0], t[0]+": "+t[1]
+		default:
+			return nil, bad
+		}
+		ops = append(ops, op)
+	}
+	return
+}
+
+// applyHeaderPolicy returns the header fields once ops applied. Added
+// fields go on top, a replaced field stays at the place of its first
+// instance.
+func applyHeaderPolicy(ops []headerOp, fields []string) []string {
+	var added []string
+	for _, op := range ops {
+		var kept []string
+		replaced := false
+		for _, f := range fields {
+			switch op.op {
+			case "remove":
+				if strings.EqualFold(dkim.FieldName(f), op.name) {
+					continue
+				}
+			case "removere":
+				if op.re.MatchString(strings.Replace(f, "\r\n", "", -1)) {
+					continue
+				}
+			case "replace":
+				if strings.EqualFold(dkim.FieldName(f), op.name) {
+					if !replaced {
+						kept = append(kept, op.field)
+					}
+					replaced = true
+					continue
+				}
+			}
+			kept = append(kept, f)
+		}
+		fields = kept
+		if op.op == "add" || (op.op == "replace" && !replaced) {
+			added = append(added, op.field)
+		}
+	}
+	return append(added, fields...)
+}
+
+// filteredMessage is a message whose header is rewritten by a header
+// policy as it is read. It can only be rewound.
+type filteredMessage struct {
+	ops []headerOp
+	msg Message
+	r   io.Reader
+}
+
+func (m *filteredMessage) Read(p []byte) (int, error) {
+	if m.r == nil {
+		br := bufio.NewReader(m.msg)
+		fields, err := dkim.ReadHeader(br)
+		if err != nil {
+			return 0, err
+		}
+		header := ""
+		for _, f := range applyHeaderPolicy(m.ops, fields) {
+			header += f + "\r\n"
+		}
+		m.r = io.MultiReader(strings.NewReader(header+"\r\n"), br)
+	}
+	return m.r.Read(p)
+}
+
+func (m *filteredMessage) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errNotRewind
+	}
+	if _, err := m.msg.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	m.r = nil
+	return 0, nil
+}
+
+// filterHeaders applies the header policy of route to msg
+func filterHeaders(msg Message, route Route) (Message, error) {
+	ops, err := getHeaderPolicy(route)
+	if err != nil || ops == nil {
+		return msg, err
+	}
+	return &filteredMessage{ops: ops, msg: msg}, nil
+}
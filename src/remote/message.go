@@ -0,0 +1,57 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package remote
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+var errNotRewind = errors.New("remote: message can only be rewound")
+
+// prefixedMessage is a message with header fields added at the top
+// (signatures...). It can only be rewound.
+type prefixedMessage struct {
+	prefix string
+	msg    Message
+	r      io.Reader
+}
+
+func withPrefix(prefix string, msg Message) *prefixedMessage {
+	return &prefixedMessage{prefix: prefix, msg: msg}
+}
+
+func (m *prefixedMessage) Read(p []byte) (int, error) {
+	if m.r == nil {
+		m.r = io.MultiReader(strings.NewReader(m.prefix), m.msg)
+	}
+	return m.r.Read(p)
+}
+
+func (m *prefixedMessage) Seek(offset int64, whence int) (int64, error) {
+	if offset != 0 || whence != io.SeekStart {
+		return 0, errNotRewind
+	}
+	if _, err := m.msg.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	m.r = nil
+	return 0, nil
+}
@@ -0,0 +1,332 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package remote delivers messages to remote SMTP hosts following the qmail
+// control files (routes, routemap, smtproutes...). It is the engine of
+// qmail-remote and never exits : every outcome is returned as a
+// DeliveryResult.
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/breaker"
+	"github.com/toorop/qmail-boosters/src/deliverylog"
+	"github.com/toorop/qmail-boosters/src/smtp"
+)
+
+// Envelope is the SMTP envelope of a message
+type Envelope struct {
+	UUID       string // X-QB-UUID, for logs
+	Sender     string
+	Recipients []string
+	MailFrom   string // rewritten sender (control/senderrewrite), if any
+}
+
+// mailFrom returns the address to send in MAIL FROM
+func (e *Envelope) mailFrom() string {
+	if e.MailFrom != "" {
+		return e.MailFrom
+	}
+	return e.Sender
+}
+
+// Message is the message to deliver. It is read from the start at each
+// attempt.
+type Message interface {
+	io.Reader
+	io.Seeker
+}
+
+// Route represents a SMTP route
+type Route struct {
+	Name       string
+	RemoteAddr string // remote IPs or Hostnames
+	LocalAddr  string // local ourtgoing IPs
+	Username   string
+	Password   string
+	HeloHost   string // HELO name override for this route
+	Host       string // host in qmail-remote cmd
+}
+
+// RecipientResult is the outcome of RCPT TO for a recipient
+type RecipientResult struct {
+	Address string
+	Status  byte   // r (accepted), h (rejected) or s (deferred)
+	Text    string // as reported to qmail-rspawn
+	Reply   *smtp.Reply
+}
+
+// Attempt is a delivery attempt to one remote host
+type Attempt struct {
+	Record     deliverylog.Record
+	Connected  bool // false if the connection (or greeting) failed
+	AuthFailed bool
+}
+
+// DeliveryResult is the outcome of a delivery
+type DeliveryResult struct {
+	// Recipients are the RCPT TO outcomes, in envelope order. Empty if the
+	// delivery failed before RCPT TO.
+	Recipients []RecipientResult
+	// Status is K (accepted), Z (deferred) or D (bounced)
+	Status byte
+	// Text is the message status as reported to qmail-rspawn
+	Text string
+	// Reply is the remote reply the status is based on, if any
+	Reply *smtp.Reply
+	// MailFrom is the sender sent in MAIL FROM, after rewriting
+	MailFrom string
+	// Attempts are all attempts made, the last connected one gave the
+	// result
+	Attempts []Attempt
+}
+
+// Summary returns the record of the delivery as a whole : its final
+// status, recipients results and number of attempts. It is the only
+// record of deliveries which failed before any attempt (route, DNS...).
+func (res *DeliveryResult) Summary(env Envelope, route Route) deliverylog.Record {
+	rec := deliverylog.Record{
+		Time:    time.Now(),
+		UUID:    env.UUID,
+		Sender:  env.Sender,
+		Route:   route.Name,
+		Attempt: len(res.Attempts),
+		Status:  string(res.Status),
+		Message: res.Text,
+	}
+	if res.MailFrom != "" && res.MailFrom != env.Sender {
+		rec.MailFrom = res.MailFrom
+	}
+	if res.Reply != nil {
+		rec.Code = res.Reply.Code
+		rec.EnhancedCode = res.Reply.Enhanced.String()
+	}
+	for i, rcptto := range env.Recipients {
+		r := deliverylog.Recipient{Address: rcptto}
+		if i < len(res.Recipients) {
+			rr := res.Recipients[i]
+			r.Status = string(rr.Status)
+			if rr.Reply != nil {
+				r.Code = rr.Reply.Code
+				r.EnhancedCode = rr.Reply.Enhanced.String()
+				r.Message = rr.Reply.Msg
+			}
+		}
+		rec.Recipients = append(rec.Recipients, r)
+	}
+	return rec
+}
+
+// Failure is a failure which doesn't come from a remote reply (control
+// files, DNS, local interfaces...)
+type Failure struct {
+	Permanent bool
+	Msg       string // ends with the enhanced code, ex: (#4.3.0)
+}
+
+func (f *Failure) Error() string {
+	return f.Msg
+}
+
+func permFailure(format string, args ...interface{}) *Failure {
+	return &Failure{true, fmt.Sprintf(format, args...)}
+}
+
+func tempFailure(format string, args ...interface{}) *Failure {
+	return &Failure{false, fmt.Sprintf(format, args...)}
+}
+
+// FailureResult returns the result of a delivery which failed before any
+// remote host was reached
+func FailureResult(env Envelope, err error) DeliveryResult {
+	res := DeliveryResult{Status: 'Z'}
+	if f, ok := err.(*Failure); ok && f.Permanent {
+		res.Status = 'D'
+	}
+	res.Text = fmt.Sprintf("%s:%s:%s:%s", env.UUID, env.Sender, strings.Join(env.Recipients, ","), err)
+	return res
+}
+
+// Deliverer delivers messages
+type Deliverer struct {
+	Timeouts    smtp.Timeouts
+	MaxAttempts int              // max number of connections to remote hosts
+	MaxTime     time.Duration    // max time spent trying remote hosts
+	Warnings    io.Writer        // where to write warnings (HELO check...)
+	Breaker     *breaker.Breaker // remote addresses marked down, nil : none
+
+	mu        sync.Mutex
+	heloHosts map[string]string // "localIP;routeHelo" -> HELO name cache
+}
+
+// NewDeliverer returns a Deliverer configured by control files
+func NewDeliverer() (*Deliverer, error) {
+	d := &Deliverer{Warnings: os.Stderr, heloHosts: make(map[string]string)}
+	var err error
+	if d.Timeouts, err = getTimeouts(); err != nil {
+		return nil, err
+	}
+	if d.MaxAttempts, d.MaxTime, err = getDeliveryLimits(); err != nil {
+		return nil, err
+	}
+	if d.Breaker, err = getBreaker(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// errBreaker is the failure of deliveries whose remote addresses are all
+// marked down
+var errBreaker = errors.New("Remote host(s) marked down after repeated failures, not dialed.")
+
+// record updates the circuit breaker state of a remote address after a
+// connection attempt. Only failures before the greeting count : a host
+// which replies is up.
+func (d *Deliverer) record(rAddr string, connected bool, err error) {
+	if d.Breaker == nil {
+		return
+	}
+	if connected {
+		err = d.Breaker.Success(rAddr)
+	} else if hostDown(err) {
+		err = d.Breaker.Failure(rAddr)
+	} else {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(d.Warnings, "qmail-remote: warning: unable to update breaker state of %s: %s\n", rAddr, err)
+	}
+}
+
+// hostDown tells if a dial error comes from the remote address : refused,
+// unreachable or silent connection, no or bad greeting. Errors of the
+// local address (bind) don't tell anything about the remote host.
+func hostDown(err error) bool {
+	switch e := err.(type) {
+	case *smtp.TimeoutError:
+		return e.Phase == smtp.PhaseConnect || e.Phase == smtp.PhaseGreeting
+	case *smtp.NetError:
+		return e.Phase == smtp.PhaseConnect || e.Phase == smtp.PhaseGreeting
+	case *smtp.Error:
+		return e.Phase == smtp.PhaseGreeting
+	case *net.OpError:
+		return e.Timeout() || errors.Is(e, syscall.ECONNREFUSED) || errors.Is(e, syscall.EHOSTUNREACH) ||
+			errors.Is(e, syscall.ENETUNREACH) || errors.Is(e, syscall.ETIMEDOUT)
+	}
+	return false
+}
+
+// Deliver delivers msg through route using the control files settings
+func Deliver(ctx context.Context, env Envelope, msg Message, route Route) DeliveryResult {
+	d, err := NewDeliverer()
+	if err != nil {
+		return FailureResult(env, err)
+	}
+	return d.Deliver(ctx, env, msg, route)
+}
+
+// Deliver tries remote hosts until one accepts or rejects the message for
+// good. Temporary failures before the message is committed move on to the
+// next host (RFC 5321 section 5.1). Held deliveries (route.Host or route)
+// are deferred at once.
+func (d *Deliverer) Deliver(ctx context.Context, env Envelope, msg Message, route Route) (res DeliveryResult) {
+	if err := d.checkHold(route.Host, route); err != nil {
+		return FailureResult(env, err)
+	}
+	candidates, err := d.getCandidates(ctx, route)
+	if err != nil {
+		return FailureResult(env, err)
+	}
+	if env.MailFrom == "" {
+		if env.MailFrom, err = d.rewriteSender(env.Sender, route); err != nil {
+			return FailureResult(env, err)
+		}
+	}
+	if msg, err = filterHeaders(msg, route); err != nil {
+		return FailureResult(env, err)
+	}
+	if msg, err = sign(&env, msg, route); err != nil {
+		return FailureResult(env, err)
+	}
+	if msg, err = seal(&env, msg, route); err != nil {
+		return FailureResult(env, err)
+	}
+	start := time.Now()
+	var last *attempt
+	for _, cand := range candidates {
+		if len(res.Attempts) >= d.MaxAttempts || time.Since(start) > d.MaxTime || ctx.Err() != nil {
+			break
+		}
+		if d.Breaker != nil && !d.Breaker.Allow(cand.rAddr) {
+			if err == nil {
+				err = errBreaker
+			}
+			continue
+		}
+		var a *attempt
+		a, err = d.deliverTo(ctx, cand, route, &env, msg)
+		if f, ok := err.(*Failure); ok {
+			attempts := res.Attempts
+			res = FailureResult(env, f)
+			res.Attempts = attempts
+			return
+		}
+		d.record(cand.rAddr, a.connected, err)
+		a.rec.Attempt = len(res.Attempts) + 1
+		a.rec.Retry = a.retry
+		if a.rec.Recipients == nil {
+			for _, rcptto := range env.Recipients {
+				a.rec.Recipients = append(a.rec.Recipients, deliverylog.Recipient{Address: rcptto})
+			}
+		}
+		res.Attempts = append(res.Attempts, Attempt{a.rec, a.connected, a.authFailed})
+		if !a.connected {
+			continue
+		}
+		last = a
+		if !a.retry {
+			break
+		}
+	}
+	if last == nil {
+		if err == nil {
+			err = ctx.Err()
+		}
+		attempts := res.Attempts
+		res = FailureResult(env, tempFailure("Sorry, I wasn't able to establish an SMTP connection to remote host(s) %s -> %s. %v (#4.4.1)", route.LocalAddr, route.RemoteAddr, err))
+		res.Attempts = attempts
+		res.MailFrom = env.mailFrom()
+		return
+	}
+	res.Recipients = last.res.Recipients
+	res.Status = last.res.Status
+	res.Text = last.res.Text
+	res.Reply = last.res.Reply
+	res.MailFrom = env.mailFrom()
+	return
+}
@@ -0,0 +1,287 @@
+package remote
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/hold"
+	"github.com/toorop/qmail-boosters/src/smtp/smtptest"
+)
+
+// setupControl points control.QmailHome to a temporary qmail home
+func setupControl(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "remote")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Mkdir(filepath.Join(dir, "control"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "control", "me"), []byte("qmail.test.example\n"), 0644)
+	old := control.QmailHome
+	control.QmailHome = dir
+	return func() {
+		control.QmailHome = old
+		os.RemoveAll(dir)
+	}
+}
+
+func TestDeliver(t *testing.T) {
+	defer setupControl(t)()
+	srv := smtptest.NewUnstartedServer()
+	srv.Replies["RCPT"] = []string{"250 2.1.5 Ok", "550 5.1.1 No such user"}
+	srv.Start()
+	defer srv.Close()
+
+	env := Envelope{UUID: "42", Sender: "a@sender.example", Recipients: []string{"u1@example.com", "u2@example.com"}}
+	route := Route{Name: "test", LocalAddr: "127.0.0.1", RemoteAddr: srv.Addr, HeloHost: "test.example"}
+	res := Deliver(context.Background(), env, strings.NewReader("Subject: test\r\n\r\nhello\r\n"), route)
+
+	if res.Status != 'K' || res.Reply == nil || res.Reply.Enhanced.String() != "2.0.0" {
+		t.Errorf("got status %c, reply %v", res.Status, res.Reply)
+	}
+	if len(res.Recipients) != 2 || res.Recipients[0].Status != 'r' || res.Recipients[1].Status != 'h' || res.Recipients[1].Reply.Code != 550 {
+		t.Errorf("got recipients %+v", res.Recipients)
+	}
+	if len(res.Attempts) != 1 || !res.Attempts[0].Connected || res.Attempts[0].Record.Status != "K" {
+		t.Errorf("got attempts %+v", res.Attempts)
+	}
+}
+
+func TestDeliverFailures(t *testing.T) {
+	defer setupControl(t)()
+	env := Envelope{UUID: "42", Sender: "a@sender.example", Recipients: []string{"u1@example.com"}}
+
+	// control/routemap is missing
+	if _, err := LookupRoute(env.Sender, "example.com"); err == nil {
+		t.Error("LookupRoute: expected an error")
+	} else if res := FailureResult(env, err); res.Status != 'Z' || !strings.HasSuffix(res.Text, "(#4.3.0)") {
+		t.Errorf("got %c %q", res.Status, res.Text)
+	}
+
+	// unknown interface : local misconfiguration, deferred
+	route := Route{Name: "test", LocalAddr: "if:nosuchif0", RemoteAddr: "127.0.0.1:25"}
+	res := Deliver(context.Background(), env, strings.NewReader(""), route)
+	if res.Status != 'Z' || !strings.Contains(res.Text, "nosuchif0") {
+		t.Errorf("got %c %q", res.Status, res.Text)
+	}
+	// skipped in a failover list
+	up := smtptest.NewServer()
+	defer up.Close()
+	route = Route{Name: "test", LocalAddr: "if:nosuchif0&127.0.0.1", RemoteAddr: up.Addr, HeloHost: "test.example"}
+	if res = Deliver(context.Background(), env, strings.NewReader(""), route); res.Status != 'K' {
+		t.Errorf("failover: got %c %q", res.Status, res.Text)
+	}
+
+	// cancelled while the remote host stalls
+	srv := smtptest.NewUnstartedServer()
+	srv.Replies["MAIL"] = []string{smtptest.Stall}
+	srv.Start()
+	defer srv.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	route = Route{Name: "test", LocalAddr: "127.0.0.1", RemoteAddr: srv.Addr, HeloHost: "test.example"}
+	res = Deliver(ctx, env, strings.NewReader(""), route)
+	if res.Status != 'Z' || !strings.Contains(res.Text, "during MAIL") {
+		t.Errorf("got %c %q", res.Status, res.Text)
+	}
+}
+
+func TestDeliverDKIM(t *testing.T) {
+	defer setupControl(t)()
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	ioutil.WriteFile(control.Path("control/dkim"), []byte("*;example.net;s1\nsender.example;example.com;missing\nroute:dkim;example.com;s2;simple/simple;from:subject\n"), 0644)
+	os.MkdirAll(control.Path("control/dkimkeys/example.com"), 0755)
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	ioutil.WriteFile(control.Path("control/dkimkeys/example.com/s2"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	env := Envelope{UUID: "42", Sender: "a@sender.example", Recipients: []string{"u1@example.com"}}
+	msg := "From: a@sender.example\nSubject: test\n\nhello\n"
+
+	// the route wins over the sender domain
+	route := Route{Name: "dkim", LocalAddr: "127.0.0.1", RemoteAddr: srv.Addr, HeloHost: "test.example"}
+	res := Deliver(context.Background(), env, strings.NewReader(msg), route)
+	if res.Status != 'K' {
+		t.Fatalf("got %c %q", res.Status, res.Text)
+	}
+	data := string(srv.Sessions()[0].Data)
+	if !strings.HasPrefix(data, "DKIM-Signature: v=1; a=ed25519-sha256; c=simple/simple; d=example.com; s=s2;") || !strings.Contains(data, "h=from:subject;") || !strings.HasSuffix(data, "\r\nFrom: a@sender.example\r\nSubject: test\r\n\r\nhello\r\n") {
+		t.Errorf("got data %q", data)
+	}
+
+	// ARC set on top of the DKIM signature
+	ioutil.WriteFile(control.Path("control/arc"), []byte("route:dkim;example.com;s2;mx.example.com\n"), 0644)
+	res = Deliver(context.Background(), env, strings.NewReader(msg), route)
+	data = string(srv.Sessions()[1].Data)
+	if res.Status != 'K' || !strings.HasPrefix(data, "ARC-Seal: i=1; a=ed25519-sha256;") || !strings.Contains(data, "\r\nARC-Authentication-Results: i=1; mx.example.com; arc=none\r\nDKIM-Signature: ") {
+		t.Errorf("got %c, data %q", res.Status, data)
+	}
+
+	// the key of the sender domain is missing : deferred
+	route.Name = "other"
+	res = Deliver(context.Background(), env, strings.NewReader(msg), route)
+	if res.Status != 'Z' || !strings.Contains(res.Text, "Unable to read DKIM key example.com/missing") || len(srv.Sessions()) != 2 {
+		t.Errorf("got %c %q", res.Status, res.Text)
+	}
+}
+
+func TestDeliverHeaderPolicy(t *testing.T) {
+	defer setupControl(t)()
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	os.Mkdir(control.Path("control/headers"), 0755)
+	ioutil.WriteFile(control.Path("control/headers/mailjet"), []byte(`# internal headers
+remove;x-qb-uuid
+removere;^Received: from [^ ]+\.internal\.example
+add;List-Unsubscribe: <mailto:unsub@example.com>
+replace;X-Mailer;qmail-boosters; v2
+replace;X-Campaign;42
+`), 0644)
+
+	env := Envelope{UUID: "42", Sender: "a@sender.example", Recipients: []string{"u1@example.com"}}
+	msg := "X-QB-UUID: 42\nReceived: from mx1.internal.example\n\tby relay\nReceived: from outside.example\nX-Mailer: a\nFrom: a@sender.example\nX-Mailer: b\n\nbody\n"
+	route := Route{Name: "mailjet", LocalAddr: "127.0.0.1", RemoteAddr: srv.Addr, HeloHost: "test.example"}
+	res := Deliver(context.Background(), env, strings.NewReader(msg), route)
+	want := "List-Unsubscribe: <mailto:unsub@example.com>\r\nX-Campaign: 42\r\nReceived: from outside.example\r\nX-Mailer: qmail-boosters; v2\r\nFrom: a@sender.example\r\n\r\nbody\r\n"
+	if data := string(srv.Sessions()[0].Data); res.Status != 'K' || data != want {
+		t.Errorf("got %c, data %q, want %q", res.Status, data, want)
+	}
+}
+
+func TestDeliverSenderRewrite(t *testing.T) {
+	defer setupControl(t)()
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	ioutil.WriteFile(control.Path("control/senderrewrite"), []byte("route:fixed;fixed;bounces@example.com\nroute:verp;verp;bounces@example.com\n*;srs;srs.example.com\n"), 0644)
+	ioutil.WriteFile(control.Path("control/srssecrets"), []byte("secret\n"), 0600)
+
+	env := Envelope{UUID: "42", Sender: "a@sender.example", Recipients: []string{"u1@example.com"}}
+	route := Route{LocalAddr: "127.0.0.1", RemoteAddr: srv.Addr, HeloHost: "test.example"}
+	for i, name := range []string{"fixed", "verp", "forward"} {
+		route.Name = name
+		res := Deliver(context.Background(), env, strings.NewReader("Subject: test\n\nhello\n"), route)
+		from := srv.Sessions()[i].From
+		if res.Status != 'K' || res.MailFrom != from || res.Attempts[0].Record.MailFrom != from || res.Attempts[0].Record.Sender != env.Sender {
+			t.Errorf("%s: got %c, MAIL FROM %q, result %q, record %+v", name, res.Status, from, res.MailFrom, res.Attempts[0].Record)
+		}
+		switch name {
+		case "fixed":
+			if from != "bounces@example.com" {
+				t.Errorf("fixed: got %q", from)
+			}
+		case "verp":
+			if from != "bounces-a=sender.example@example.com" {
+				t.Errorf("verp: got %q", from)
+			}
+		case "forward":
+			if !strings.HasPrefix(from, "SRS0=") || !strings.HasSuffix(from, "=sender.example=a@srs.example.com") {
+				t.Errorf("srs: got %q", from)
+			}
+		}
+	}
+
+	// bounces keep the null sender
+	env.Sender = ""
+	res := Deliver(context.Background(), env, strings.NewReader("Subject: test\n\nhello\n"), route)
+	if res.Status != 'K' || srv.Sessions()[3].From != "" || res.Attempts[0].Record.MailFrom != "" {
+		t.Errorf("null sender: got %c, MAIL FROM %q", res.Status, srv.Sessions()[3].From)
+	}
+
+	// an unqualified sender is kept, with a warning
+	var warnings bytes.Buffer
+	d := &Deliverer{Warnings: &warnings}
+	for _, name := range []string{"verp", "forward"} {
+		if from, err := d.rewriteSender("a", Route{Name: name}); from != "a" || err != nil {
+			t.Errorf("%s: got %q %v", name, from, err)
+		}
+	}
+	if !strings.Contains(warnings.String(), "unable to rewrite sender a") {
+		t.Errorf("got warnings %q", warnings.String())
+	}
+}
+
+func TestCheckHold(t *testing.T) {
+	defer setupControl(t)()
+	ioutil.WriteFile(control.Path(hold.File), []byte("example.com;;MX down\nroute:slow;;\nbad name;;\n"), 0644)
+	var warnings bytes.Buffer
+	d := &Deliverer{Warnings: &warnings}
+	err := d.checkHold("example.com", Route{Name: "default"})
+	if f, ok := err.(*Failure); !ok || f.Permanent || f.Msg != "Deliveries to example.com are on hold (MX down). (#4.4.5)" {
+		t.Errorf("got %v", err)
+	}
+	if !strings.Contains(warnings.String(), "bad name") {
+		t.Errorf("got warnings %q", warnings.String())
+	}
+	if err = d.checkHold("example.org", Route{Name: "slow"}); err == nil {
+		t.Errorf("route not held")
+	}
+	if err = d.checkHold("example.org", Route{Name: "default"}); err != nil {
+		t.Errorf("got %v", err)
+	}
+	// nothing is dialed
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	env := Envelope{UUID: "42", Sender: "a@sender.example", Recipients: []string{"u1@example.com"}}
+	route := Route{Name: "default", Host: "example.com", LocalAddr: "127.0.0.1", RemoteAddr: srv.Addr, HeloHost: "test.example"}
+	res := Deliver(context.Background(), env, strings.NewReader("Subject: test\n\nhello\n"), route)
+	if res.Status != 'Z' || !strings.Contains(res.Text, "on hold") || len(srv.Sessions()) != 0 {
+		t.Errorf("held: got %c %s, %d sessions", res.Status, res.Text, len(srv.Sessions()))
+	}
+}
+
+func TestDeliverBreaker(t *testing.T) {
+	defer setupControl(t)()
+	ioutil.WriteFile(control.Path("control/breaker"), []byte("1;60\n"), 0644)
+	os.Mkdir(control.Path("breaker"), 0755)
+	srv := smtptest.NewServer()
+	defer srv.Close()
+	// nothing listens on port 1
+	env := Envelope{UUID: "42", Sender: "a@sender.example", Recipients: []string{"u1@example.com"}}
+	route := Route{Name: "test", LocalAddr: "127.0.0.1", RemoteAddr: "127.0.0.1:1&" + srv.Addr, HeloHost: "test.example"}
+
+	res := Deliver(context.Background(), env, strings.NewReader("Subject: test\r\n\r\nhello\r\n"), route)
+	if res.Status != 'K' || len(res.Attempts) != 2 || res.Attempts[0].Connected {
+		t.Fatalf("got status %c, attempts %+v", res.Status, res.Attempts)
+	}
+	res = Deliver(context.Background(), env, strings.NewReader("Subject: test\r\n\r\nhello\r\n"), route)
+	if res.Status != 'K' || len(res.Attempts) != 1 || res.Attempts[0].Record.Attempt != 1 {
+		t.Errorf("down address dialed: attempts %+v", res.Attempts)
+	}
+
+	// greeting failure
+	greeting := smtptest.NewUnstartedServer()
+	greeting.Replies["GREETING"] = []string{"421 4.3.2 Service not available"}
+	greeting.Start()
+	defer greeting.Close()
+	route.RemoteAddr = greeting.Addr + "&" + srv.Addr
+	Deliver(context.Background(), env, strings.NewReader("Subject: test\r\n\r\nhello\r\n"), route)
+	if res = Deliver(context.Background(), env, strings.NewReader("Subject: test\r\n\r\nhello\r\n"), route); len(res.Attempts) != 1 {
+		t.Errorf("421 greeting not counted: attempts %+v", res.Attempts)
+	}
+
+	// the local address can't be bound, the remote one is not at fault
+	route.LocalAddr, route.RemoteAddr = "192.0.2.1", srv.Addr
+	if res = Deliver(context.Background(), env, strings.NewReader("Subject: test\r\n\r\nhello\r\n"), route); res.Status != 'Z' {
+		t.Fatalf("bind: got status %c, %s", res.Status, res.Text)
+	}
+	if _, err := os.Stat(filepath.Join(control.Path("breaker"), srv.Addr)); err == nil {
+		t.Errorf("bind error counted against %s", srv.Addr)
+	}
+
+	route.LocalAddr, route.RemoteAddr = "127.0.0.1", "127.0.0.1:1"
+	res = Deliver(context.Background(), env, strings.NewReader("Subject: test\r\n\r\nhello\r\n"), route)
+	if res.Status != 'Z' || len(res.Attempts) != 0 || !strings.Contains(res.Text, "marked down") {
+		t.Errorf("got status %c, %s", res.Status, res.Text)
+	}
+}
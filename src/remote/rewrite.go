@@ -0,0 +1,70 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package remote
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/toorop/qmail-boosters/src/srs"
+)
+
+// rewriteSender returns the MAIL FROM for a message from sender through
+// route. The null sender (bounces) is never rewritten. A sender which
+// can't be rewritten (unqualified address...) is kept, with a warning,
+// only a bad configuration fails, temporarily.
+// control/senderrewrite :
+// senderDomain|route:NAME|*;fixed;bounces@example.com
+// senderDomain|route:NAME|*;verp;bounces@example.com -> bounces-user=domain@example.com
+// senderDomain|route:NAME|*;srs;srs.example.com
+func (d *Deliverer) rewriteSender(sender string, route Route) (string, error) {
+	if sender == "" {
+		return sender, nil
+	}
+	parsed, err := matchControl("control/senderrewrite", sender, route)
+	if err != nil || parsed == nil {
+		return sender, err
+	}
+	switch parsed[1] {
+	case "fixed":
+		return parsed[2], nil
+	case "verp":
+		at := strings.LastIndexByte(parsed[2], '@')
+		i := strings.LastIndexByte(sender, '@')
+		if at < 1 || i < 1 {
+			break
+		}
+		return parsed[2][:at] + "-" + sender[:i] + "=" + sender[i+1:] + parsed[2][at:], nil
+	case "srs":
+		s, err := srs.Load(parsed[2])
+		if err != nil {
+			return "", tempFailure("Unable to load SRS settings: %s (#4.3.0)", err)
+		}
+		rewritten, err := s.Forward(sender)
+		if err != nil {
+			fmt.Fprintf(d.Warnings, "qmail-remote: warning: unable to rewrite sender %s: %s\n", sender, err)
+			return sender, nil
+		}
+		return rewritten, nil
+	default:
+		return "", errControl("Bad format for senderrewrite file")
+	}
+	fmt.Fprintf(d.Warnings, "qmail-remote: warning: unable to rewrite sender %s\n", sender)
+	return sender, nil
+}
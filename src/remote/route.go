@@ -0,0 +1,332 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package remote
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/hold"
+)
+
+// LookupRoute returns the route for a message from sender to remoteHost,
+// from control/routemap, control/routes and control/smtproutes
+func LookupRoute(sender string, remoteHost string) (route Route, err error) {
+	var senderHost string
+
+	route.Name = "default"
+	route.Host = remoteHost
+
+	// if remotehost is an IP skip test
+	if net.ParseIP(remoteHost) != nil {
+		route.Name = remoteHost
+		route.RemoteAddr = fmt.Sprintf("%s:25", remoteHost)
+		return
+	}
+
+	t := strings.Split(sender, "@")
+	if len(t) == 1 { // bounce
+		senderHost = "bounce"
+	} else {
+		senderHost = t[1]
+	}
+
+	// Find route name in route map
+	routesMap, err := readControl("control/routemap")
+	if err != nil {
+		return
+	}
+	for _, r1 := range routesMap {
+		parsed := strings.Split(r1, ";")
+		if len(parsed) < 3 {
+			continue
+		}
+		if (parsed[0] == "*" || parsed[0] == senderHost) && (parsed[1] == "*" || parsed[1] == remoteHost) {
+			route.Name = parsed[2]
+			break
+		}
+	}
+
+	// Find route from control/routes
+	routesC, err := readControl("control/routes")
+	if err != nil {
+		return
+	}
+	for _, strRoute := range routesC {
+		parsedRoute := strings.Split(strRoute, ";")
+		if parsedRoute[0] == route.Name {
+			if len(parsedRoute) < 5 {
+				return route, tempFailure("Unable to read control file 'routes'. Bad format or file not found (#4.3.0)")
+			}
+			route.LocalAddr = parsedRoute[1]
+			route.RemoteAddr = parsedRoute[2]
+			route.Username = parsedRoute[3]
+			route.Password = parsedRoute[4]
+			// optional HELO host
+			if len(parsedRoute) > 5 {
+				route.HeloHost = parsedRoute[5]
+			}
+			break
+		}
+	}
+
+	// Route found
+	if route.Name != "default" && route.RemoteAddr != "" {
+		return
+	}
+
+	// try to find route in smtproutes
+	smtproutes, err := readControl("control/smtproutes")
+	if err != nil {
+		return
+	}
+	for _, l := range smtproutes {
+		s := strings.Split(l, ":")
+		if s[0] == remoteHost && len(s) > 1 {
+			route.Name = "smtproutes"
+			route.RemoteAddr = fmt.Sprintf("%s:25", s[1])
+			break
+		}
+	}
+	return
+}
+
+// checkHold returns a temporary failure if deliveries to remoteHost or
+// through route are held (control/holddomains), nothing is dialed. Bad
+// lines are only warned about.
+func (d *Deliverer) checkHold(remoteHost string, route Route) error {
+	holds, err := hold.Load()
+	if _, ok := err.(hold.BadLines); ok {
+		fmt.Fprintf(d.Warnings, "qmail-remote: warning: %s\n", err)
+	} else if err != nil {
+		return errControl(control.Path(hold.File))
+	}
+	h := hold.Find(holds, remoteHost, route.Name, time.Now())
+	if h == nil {
+		return nil
+	}
+	msg := "Deliveries to " + h.Name + " are on hold"
+	if !h.Until.IsZero() {
+		msg += " until " + h.Until.UTC().Format("2 Jan 2006 15:04:05 GMT")
+	}
+	if h.Reason != "" {
+		msg += " (" + h.Reason + ")"
+	}
+	return tempFailure("%s. (#4.4.5)", msg)
+}
+
+// Return route form MX records
+// cat = failover | roundrobin
+func getMxRoute(ctx context.Context, host, sep string) (route string) {
+	mxs, err := net.DefaultResolver.LookupMX(ctx, host)
+	if err != nil {
+		route = host
+	} else {
+		for i, mx := range mxs {
+			if i == 0 {
+				route = fmt.Sprintf("%s:25", mx.Host[0:len(mx.Host)-1])
+			} else {
+				route = fmt.Sprintf("%s%s%s:25", route, sep, mx.Host[0:len(mx.Host)-1])
+			}
+		}
+	}
+
+	return
+}
+
+// toto.com:25 -> 111.111.111.111:25
+func hostPortToIPPort(ctx context.Context, dsnHost string) (string, error) {
+	host, port, _ := net.SplitHostPort(dsnHost)
+	// If hostname get IP
+	if net.ParseIP(host) == nil {
+		t, err := net.DefaultResolver.LookupHost(ctx, host)
+		if err != nil {
+			if isNoSuchHostErr(err) {
+				return "", permFailure("Sorry, I couldn't resolve this hostname %s. (#5.4.4)", host)
+			}
+			return "", tempFailure("Sorry, I couldn't resolve this hostname %s - %s (#4.4.1)", host, err.Error())
+		}
+		return net.JoinHostPort(t[0], port), nil
+	}
+	return dsnHost, nil
+}
+
+// isNoSuchHostErr check if err is a "no such host" error
+func isNoSuchHostErr(err error) bool {
+	if strings.Contains(err.Error(), "no such host") {
+		return true
+	}
+	return false
+}
+
+// resolveLocalAddr returns the IP to bind to for a local address entry.
+// Entries like "if:eth1" or "if:eth1/v6" are resolved to the current IPv4
+// (or IPv6) address of the interface, anything else is returned as is.
+func resolveLocalAddr(lAddr string) (string, error) {
+	if !strings.HasPrefix(lAddr, "if:") {
+		return lAddr, nil
+	}
+	name := lAddr[3:]
+	v6 := false
+	if strings.HasSuffix(name, "/v6") {
+		name = name[:len(name)-3]
+		v6 = true
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return "", tempFailure("Sorry, I couldn't find local interface %s. (#4.4.1)", name)
+	}
+	noAddr := tempFailure("Sorry, local interface %s has no usable address. (#4.4.1)", lAddr[3:])
+	if iface.Flags&net.FlagUp == 0 {
+		return "", noAddr
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return "", noAddr
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || !ipnet.IP.IsGlobalUnicast() {
+			continue
+		}
+		if (ipnet.IP.To4() == nil) == v6 {
+			return ipnet.IP.String(), nil
+		}
+	}
+	return "", noAddr
+}
+
+// candidate is a local address / remote address pair to try
+type candidate struct {
+	lAddr string
+	rAddr string // ip:port
+}
+
+// getCandidates returns the local/remote address pairs to try, in order
+func (d *Deliverer) getCandidates(ctx context.Context, route Route) (candidates []candidate, err error) {
+	var tAddrs []string  // temp address slices
+	lAddrs := list.New() // Local addresses
+	rAddrs := list.New() // Remote addresses
+
+	///////////////////////////////
+	// Locals address
+
+	// Si il n'y a pas d'adresse locale il faut prendre celle de la eth0
+	if route.LocalAddr == "" {
+		if route.LocalAddr, err = getDefaultLocalAddr(); err != nil {
+			return nil, err
+		}
+	}
+
+	pushRemote := func(a string) error {
+		ipPort, err := hostPortToIPPort(ctx, a)
+		if err == nil {
+			rAddrs.PushBack(ipPort)
+		}
+		return err
+	}
+
+	// failover, round robin or unique IP. Unusable entries (interface
+	// down...) are skipped, the delivery fails only if none is left.
+	switch {
+	case strings.Contains(route.LocalAddr, "&"):
+		tAddrs = strings.Split(route.LocalAddr, "&")
+	case strings.Contains(route.LocalAddr, "|"):
+		tAddrs = strings.Split(route.LocalAddr, "|")
+		rand.Seed(time.Now().UTC().UnixNano())
+		rand.Shuffle(len(tAddrs), func(i, j int) { tAddrs[i], tAddrs[j] = tAddrs[j], tAddrs[i] })
+	default:
+		tAddrs = []string{route.LocalAddr}
+	}
+	var localErr error
+	for _, a := range tAddrs {
+		ip, err := resolveLocalAddr(a)
+		if err != nil {
+			localErr = err
+			continue
+		}
+		lAddrs.PushBack(ip)
+	}
+	if lAddrs.Len() == 0 {
+		return nil, localErr
+	}
+
+	///////////////////////////////
+	// Remote address
+	// If no route specified use MX
+	if route.RemoteAddr == "" || route.RemoteAddr == "mx" {
+		route.RemoteAddr = getMxRoute(ctx, route.Host, "&")
+	}
+
+	// failover ?
+	tAddrs = strings.Split(route.RemoteAddr, "&")
+	if len(tAddrs) > 1 {
+		for _, tAddr := range tAddrs {
+			if tAddr == "mx" {
+				mxs, err := net.DefaultResolver.LookupMX(ctx, route.Host)
+				if err != nil {
+					rAddrs.PushBack(net.JoinHostPort(route.Host, "25"))
+				} else {
+					for _, mx := range mxs {
+						rAddrs.PushBack(net.JoinHostPort(mx.Host[0:len(mx.Host)-1], "25"))
+					}
+				}
+			} else if err = pushRemote(tAddr); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// round robin
+	if rAddrs.Len() == 0 { // -> no failover
+		tAddrs = strings.Split(route.RemoteAddr, "|")
+		if len(tAddrs) > 1 {
+			var i int
+			rand.Seed(time.Now().UTC().UnixNano())
+			for len(tAddrs) > 0 {
+				i = rand.Intn(len(tAddrs))
+				if err = pushRemote(tAddrs[i]); err != nil {
+					return nil, err
+				}
+				tAddrs = append(tAddrs[:i], tAddrs[i+1:]...)
+			}
+		}
+	}
+	// Unique IP/hostname
+	if rAddrs.Len() == 0 { // -> no failover & no roud robin
+		if err = pushRemote(route.RemoteAddr); err != nil {
+			return nil, err
+		}
+	}
+
+	// Test all remote Host
+	for rAddr := rAddrs.Front(); rAddr != nil; rAddr = rAddr.Next() {
+		//  Try all r address
+		for lAddr := lAddrs.Front(); lAddr != nil; lAddr = lAddr.Next() {
+			candidates = append(candidates, candidate{lAddr.Value.(string), rAddr.Value.(string)})
+		}
+	}
+	return
+}
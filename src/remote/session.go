@@ -0,0 +1,377 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package remote
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/deliverylog"
+	"github.com/toorop/qmail-boosters/src/smtp"
+)
+
+// permanent tells if a failure reply is permanent. The basic code decides
+// (RFC 3463), an enhanced code of class 4 only makes a 5xx reply
+// temporary (550 4.7.1 greylisted...).
+// Unexpected codes (2xx, 3xx) are temporary.
+func permanent(r *smtp.Reply) bool {
+	return r.Code/100 == 5 && r.Enhanced.Class != 4
+}
+
+// statusCode returns the enhanced status code to put at the end of the
+// status line : the remote one if any, X.0.0 otherwise.
+func statusCode(r *smtp.Reply) string {
+	if r.Enhanced.Class != 0 {
+		return r.Enhanced.String()
+	}
+	if r.Code/100 == 2 {
+		return "2.0.0"
+	}
+	if permanent(r) {
+		return "5.0.0"
+	}
+	return "4.0.0"
+}
+
+// attempt is the outcome of a delivery attempt to one remote host.
+// Its result is only returned if we won't try another host.
+type attempt struct {
+	env        *Envelope
+	res        DeliveryResult
+	retry      bool // temporary failure before the message was committed
+	connected  bool
+	authFailed bool
+	rec        deliverylog.Record
+}
+
+// status sets the message status (K, Z or D)
+func (a *attempt) status(code byte, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	a.res.Status = code
+	a.res.Text = msg
+	a.rec.Status = string(code)
+	a.rec.Message = msg
+}
+
+// reply records a SMTP reply as the one the status is based on
+func (a *attempt) reply(r *smtp.Reply) {
+	a.res.Reply = r
+	a.rec.Code = r.Code
+	a.rec.EnhancedCode = r.Enhanced.String()
+}
+
+// rcpt adds a recipient result
+func (a *attempt) rcpt(status byte, rcptto string, r *smtp.Reply, format string, args ...interface{}) {
+	a.res.Recipients = append(a.res.Recipients, RecipientResult{
+		Address: rcptto,
+		Status:  status,
+		Text:    fmt.Sprintf(format, args...),
+		Reply:   r,
+	})
+	a.rec.Recipients = append(a.rec.Recipients, deliverylog.Recipient{
+		Address:      rcptto,
+		Status:       string(status),
+		Code:         r.Code,
+		EnhancedCode: r.Enhanced.String(),
+		Message:      r.Msg,
+	})
+}
+
+// envelope returns the uuid:sender:recipients prefix of status lines
+func (a *attempt) envelope() string {
+	return fmt.Sprintf("%s:%s:%s", a.env.UUID, a.env.Sender, strings.Join(a.env.Recipients, ","))
+}
+
+// sessionErr returns the SMTP reply carried by err. For errors which are
+// not replies (timeout, network, TLS) it sets a deferral and returns nil :
+// the connection is broken.
+func (a *attempt) sessionErr(dsn string, err error) *smtp.Reply {
+	switch e := err.(type) {
+	case *smtp.Error:
+		a.reply(&e.Reply)
+		return &e.Reply
+	case *smtp.TimeoutError:
+		a.timeout(dsn, e)
+	case *smtp.TLSError:
+		a.status('Z', "%s:TLS failure while speaking to %s. %s (#4.7.5)", a.envelope(), dsn, e)
+	default:
+		a.connectionLost(dsn, err)
+	}
+	return nil
+}
+
+// timeout sets a deferral for a SMTP phase timeout
+func (a *attempt) timeout(dsn string, err *smtp.TimeoutError) {
+	a.status('Z', "%s:Sorry, timeout occured during %s while speaking to %s. (#4.4.2)", a.envelope(), err.Phase, dsn)
+}
+
+// connectionLost sets a deferral for a network error after connection
+func (a *attempt) connectionLost(dsn string, err error) {
+	a.status('Z', "%s:Connection to %s died. %s (#4.4.2)", a.envelope(), dsn, err)
+}
+
+// isPhase tells if err is a timeout or network error during phase
+func isPhase(err error, phase string) bool {
+	switch e := err.(type) {
+	case *smtp.TimeoutError:
+		return e.Phase == phase
+	case *smtp.NetError:
+		return e.Phase == phase
+	}
+	return false
+}
+
+// dial returns a SMTP client connected to the remote address of cand
+func (d *Deliverer) dial(cand candidate, heloHost string) (*smtp.Client, error) {
+	return smtp.Dial(cand.rAddr, cand.lAddr, heloHost, d.Timeouts)
+}
+
+// watch closes c if ctx is done before stop is called
+func watch(ctx context.Context, c *smtp.Client) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// deliverTo tries to deliver the message to the remote host of cand.
+// The attempt is not connected if the connection failed.
+func (d *Deliverer) deliverTo(ctx context.Context, cand candidate, route Route, env *Envelope, msg Message) (*attempt, error) {
+	a := &attempt{env: env}
+	a.rec.Time = time.Now()
+	a.rec.UUID = env.UUID
+	a.rec.Sender = env.Sender
+	if env.mailFrom() != env.Sender {
+		a.rec.MailFrom = env.mailFrom()
+	}
+	a.rec.Route = route.Name
+	a.rec.LocalIP = cand.lAddr
+	a.rec.RemoteIP, a.rec.RemotePort, _ = net.SplitHostPort(cand.rAddr)
+	heloHost, err := d.getHeloHostFor(cand.lAddr, route)
+	if err != nil {
+		return nil, err
+	}
+	a.rec.Helo = heloHost
+	c, err := d.dial(cand, heloHost)
+	if err != nil {
+		a.rec.Status = "Z"
+		a.rec.Message = err.Error()
+		a.retry = true
+		return a, err
+	}
+	a.connected = true
+	stop := watch(ctx, c)
+	dsn := c.Raddr
+	broken := false
+	defer func() {
+		stop()
+		if c == nil {
+			return
+		}
+		a.rec.SetPhases(c.Timings())
+		if broken {
+			c.Close()
+		} else {
+			c.Quit()
+		}
+	}()
+
+	// STARTTLS ?
+	// 2013-06-22 14:19:30.670252500 delivery 196893: deferral: Sorry_but_i_don't_understand_SMTP_response_:_local_error:_unexpected_message_/
+	// 2013-06-18 10:08:29.273083500 delivery 856840: deferral: Sorry_but_i_don't_understand_SMTP_response_:_failed_to_parse_certificate_from_server:_negative_serial_number_/
+	// https://code.google.com/p/go/issues/detail?id=3930
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		var config tls.Config
+		config.InsecureSkipVerify = true
+		// If TLS nego failed bypass secure transmission
+		err = c.StartTLS(&config)
+		if err != nil { // fallback to no TLS
+			stop()
+			c.Close()
+			c, err = d.dial(cand, heloHost)
+			if err != nil {
+				stop = func() {}
+				a.connected = false
+				a.rec.Status = "Z"
+				a.rec.Message = err.Error()
+				a.retry = true
+				return a, err
+			}
+			stop = watch(ctx, c)
+		} else if state, ok := c.TLSConnectionState(); ok {
+			a.rec.TLS = &deliverylog.TLS{Version: tls.VersionName(state.Version), Cipher: tls.CipherSuiteName(state.CipherSuite)}
+		}
+	}
+
+	// Auth
+	var auth smtp.Auth
+	if route.Username != "" && route.Password != "" {
+		_, auths := c.Extension("AUTH")
+
+		if strings.Contains(auths, "CRAM-MD5") {
+			auth = smtp.CRAMMD5Auth(route.Username, route.Password)
+			a.rec.Auth = "CRAM-MD5"
+		} else { // PLAIN
+			host, _, _ := net.SplitHostPort(cand.rAddr)
+			auth = smtp.PlainAuth("", route.Username, route.Password, host)
+			a.rec.Auth = "PLAIN"
+		}
+	}
+
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); ok {
+			err := c.Auth(auth)
+			if err != nil {
+				// an other relay may accept us
+				a.retry = true
+				a.authFailed = true
+				if e, ok := err.(*smtp.Error); ok {
+					a.reply(&e.Reply)
+					a.status('Z', "%s:%s->%s:%s:%s:Auth failure (perhaps temp) dialing to host : %s (#%s)", env.UUID, c.Laddr, dsn, env.Sender, strings.Join(env.Recipients, ","), e.Msg, statusCode(&e.Reply))
+					return a, nil
+				}
+				switch err.(type) {
+				case *smtp.TimeoutError, *smtp.NetError:
+					broken = true
+					a.sessionErr(dsn, err)
+				default: // local error (no TLS for PLAIN...)
+					a.status('Z', "%s:%s->%s:%s:%s:Auth failure (perhaps temp) dialing to host : %s (#5.4.4)", env.UUID, c.Laddr, dsn, env.Sender, strings.Join(env.Recipients, ","), err)
+				}
+				return a, nil
+			}
+		}
+	}
+
+	if _, err := c.Mail(env.mailFrom()); err != nil {
+		r := a.sessionErr(dsn, err)
+		if r == nil {
+			broken, a.retry = true, true
+			return a, nil
+		}
+		code := byte('Z')
+		if permanent(r) {
+			code = 'D'
+		} else {
+			a.retry = true
+		}
+		a.status(code, "%s:%s->%s:%s:%s:Connected to remote host but sender was rejected. %s (#%s)", env.UUID, c.Laddr, dsn, env.Sender, strings.Join(env.Recipients, ","), r.Msg, statusCode(r))
+		return a, nil
+	}
+
+	flagAtLeastOneRecipitentSuccess := false
+	flagTempFailure := false
+	var lastRcptR *smtp.Reply
+	for _, rcptto := range env.Recipients {
+		r, err := c.Rcpt(rcptto)
+		if err != nil {
+			if r = a.sessionErr(dsn, err); r == nil {
+				broken, a.retry = true, true
+				return a, nil
+			}
+			status := byte('h')
+			if !permanent(r) {
+				status = 's'
+				flagTempFailure = true
+			}
+			lastRcptR = r
+			a.rcpt(status, rcptto, r, "%s:%s->%s:%s:%s: does not like recipient. %s (#%s)", env.UUID, c.Laddr, dsn, env.Sender, rcptto, r.Msg, statusCode(r))
+		} else {
+			a.rcpt('r', rcptto, r, "%s:%s->%s:%s:%s:recipient accepted. (#%s)", env.UUID, c.Laddr, dsn, env.Sender, rcptto, statusCode(r))
+			flagAtLeastOneRecipitentSuccess = true
+		}
+	}
+	// rcpt records are for recipients only
+	a.rec.Code, a.rec.EnhancedCode = 0, ""
+	a.res.Reply = nil
+
+	if !flagAtLeastOneRecipitentSuccess {
+		// next MX may accept temporary rejected recipients
+		a.retry = flagTempFailure
+		a.reply(lastRcptR)
+		a.status('D', "Giving up on %s (#%s)", route.RemoteAddr, statusCode(lastRcptR))
+		return a, nil
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		r := a.sessionErr(dsn, err)
+		if r == nil {
+			broken, a.retry = true, true
+			return a, nil
+		}
+		code := byte('Z')
+		if permanent(r) {
+			code = 'D'
+		} else { // code >=400
+			a.retry = true
+		}
+		a.status(code, " failed on DATA command : %s (#%s)", r.Msg, statusCode(r))
+		return a, nil
+	}
+
+	if _, err = msg.Seek(0, io.SeekStart); err == nil {
+		_, err = io.Copy(w, msg)
+	}
+	if err != nil {
+		// the final dot wasn't sent, message is not committed
+		broken, a.retry = true, true
+		if _, ok := err.(*smtp.TimeoutError); !ok {
+			if _, ok = err.(*smtp.NetError); !ok {
+				// local read error, the next host won't do better
+				a.retry = false
+				a.status('Z', "%s:Unable to read message. (#4.3.0)", a.envelope())
+				return a, nil
+			}
+		}
+		a.sessionErr(dsn, err)
+		return a, nil
+	}
+
+	if err = w.Close(); err != nil {
+		r := a.sessionErr(dsn, err)
+		if r == nil {
+			broken = true
+			// if the final dot was sent the message may have been committed
+			a.retry = !isPhase(err, smtp.PhaseDataDone)
+			return a, nil
+		}
+		code := byte('Z')
+		if permanent(r) {
+			code = 'D'
+		} else { // code >=400
+			a.retry = true
+		}
+		a.status(code, " failed after I sent the message: %s (#%s)", r.Msg, statusCode(r))
+		return a, nil
+	}
+	r := w.Reply()
+	a.reply(r)
+	a.status('K', " accepted message: %s (#%s)", r.Msg, statusCode(r))
+	return a, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EnhancedCode is a RFC 3463 enhanced status code (class.subject.detail).
+// The zero value means the server didn't send one.
+type EnhancedCode struct {
+	Class   int
+	Subject int
+	Detail  int
+}
+
+func (e EnhancedCode) String() string {
+	if e.Class == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d.%d.%d", e.Class, e.Subject, e.Detail)
+}
+
+// ParseEnhancedCode parses the enhanced status code at the begining of line
+// and returns it with the rest of the line.
+// ok is false if line doesn't start with an enhanced status code.
+func ParseEnhancedCode(line string) (code EnhancedCode, text string, ok bool) {
+	field := line
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		field, text = line[:i], strings.TrimLeft(line[i:], " \t")
+	}
+	parts := strings.Split(field, ".")
+	if len(parts) != 3 {
+		return EnhancedCode{}, line, false
+	}
+	var n [3]int
+	for i, p := range parts {
+		// class is one digit, subject and detail 1 to 3 digits
+		if p == "" || len(p) > 3 || (i == 0 && len(p) > 1) {
+			return EnhancedCode{}, line, false
+		}
+		v, err := strconv.Atoi(p)
+		if err != nil || v < 0 {
+			return EnhancedCode{}, line, false
+		}
+		n[i] = v
+	}
+	if n[0] != 2 && n[0] != 4 && n[0] != 5 {
+		return EnhancedCode{}, line, false
+	}
+	return EnhancedCode{n[0], n[1], n[2]}, text, true
+}
+
+// SplitEnhancedCode extracts the enhanced status code of a (possibly multi
+// line) reply text, as sent by servers supporting ENHANCEDSTATUSCODES
+// (RFC 2034). The code is removed from each line.
+func SplitEnhancedCode(msg string) (code EnhancedCode, text string) {
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		c, t, ok := ParseEnhancedCode(line)
+		if !ok {
+			continue
+		}
+		if i == 0 {
+			code = c
+		}
+		lines[i] = t
+	}
+	if code.Class == 0 {
+		return code, msg
+	}
+	return code, strings.Join(lines, "\n")
+}
+
+// Reply is a SMTP server reply
+type Reply struct {
+	Code     int
+	Enhanced EnhancedCode
+	Msg      string // reply text without enhanced codes, lines joined by \n
+}
+
+func newReply(code int, msg string) (r Reply) {
+	r.Code = code
+	r.Enhanced, r.Msg = SplitEnhancedCode(msg)
+	return
+}
+
+func (r *Reply) String() string {
+	if r.Enhanced.Class != 0 {
+		return fmt.Sprintf("%03d %s %s", r.Code, r.Enhanced, r.Msg)
+	}
+	return fmt.Sprintf("%03d %s", r.Code, r.Msg)
+}
+
+// Error is a SMTP reply which is not the one expected by the command
+// (usually 4xx or 5xx).
+type Error struct {
+	Reply
+	Phase string // phase of the session the reply was received in
+}
+
+func (e *Error) Error() string {
+	return e.Reply.String()
+}
+
+// NetError is a network failure, or a reply that can't be parsed, during a
+// phase of the session. The connection should be considered broken.
+type NetError struct {
+	Phase string
+	Err   error
+}
+
+func (e *NetError) Error() string {
+	return fmt.Sprintf("%s during %s", e.Err, e.Phase)
+}
+
+// TLSError is a failed TLS handshake after STARTTLS
+type TLSError struct {
+	Err error
+}
+
+func (e *TLSError) Error() string {
+	return fmt.Sprintf("TLS handshake failed: %s", e.Err)
+}
+
+// TimeoutError is returned when a phase of the session exceeds its deadline
+type TimeoutError struct {
+	Phase string
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timeout during %s", e.Phase)
+}
+
+// Timeout implements net.Error
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary implements net.Error
+func (e *TimeoutError) Temporary() bool { return true }
@@ -0,0 +1,49 @@
+// Copyright 2010 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package smtp
+
+import (
+	"testing"
+)
+
+var splitEnhancedCodeTests = []struct {
+	msg  string
+	code EnhancedCode
+	text string
+}{
+	{"5.1.1 User unknown", EnhancedCode{5, 1, 1}, "User unknown"},
+	{"4.7.1 Greylisted\n4.7.1 Try again later", EnhancedCode{4, 7, 1}, "Greylisted\nTry again later"},
+	{"2.0.0 Ok: queued as 42", EnhancedCode{2, 0, 0}, "Ok: queued as 42"},
+	{"4.2.2", EnhancedCode{4, 2, 2}, ""},
+	{"5.7.123 Long detail", EnhancedCode{5, 7, 123}, "Long detail"},
+	{"User unknown", EnhancedCode{}, "User unknown"},
+	{"3.1.1 bad class", EnhancedCode{}, "3.1.1 bad class"},
+	{"5.1 truncated", EnhancedCode{}, "5.1 truncated"},
+	{"55.1.1 two digit class", EnhancedCode{}, "55.1.1 two digit class"},
+	{"Mailbox full\n5.2.2 only on second line", EnhancedCode{}, "Mailbox full\n5.2.2 only on second line"},
+}
+
+func TestSplitEnhancedCode(t *testing.T) {
+	for _, tt := range splitEnhancedCodeTests {
+		code, text := SplitEnhancedCode(tt.msg)
+		if code != tt.code || text != tt.text {
+			t.Errorf("SplitEnhancedCode(%q) = %v, %q; want %v, %q", tt.msg, code, text, tt.code, tt.text)
+		}
+	}
+}
+
+func TestError(t *testing.T) {
+	e := &Error{Reply: newReply(550, "5.1.1 No such user\n5.1.1 here")}
+	if e.Code != 550 || e.Enhanced.String() != "5.1.1" || e.Msg != "No such user\nhere" {
+		t.Errorf("got %+v", e)
+	}
+	if e.Error() != "550 5.1.1 No such user\nhere" {
+		t.Errorf("Error() = %q", e.Error())
+	}
+	e = &Error{Reply: newReply(421, "Service not available")}
+	if e.Error() != "421 Service not available" {
+		t.Errorf("Error() = %q", e.Error())
+	}
+}
@@ -0,0 +1,244 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package smtp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Server side errors
+var (
+	ErrLineTooLong = errors.New("line too long")
+	ErrBareLF      = errors.New("bare LF")
+	ErrSyntax      = errors.New("syntax error")
+)
+
+// maxLine is the max length of a command line, RFC 5321 says 512
+const maxLine = 4096
+
+// ServerConn is the server side of a SMTP session.
+// Replies are buffered and only flushed when the client waits for them,
+// which is all PIPELINING (RFC 2920) needs.
+type ServerConn struct {
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// NewServerConn returns a ServerConn reading commands from r and writing
+// replies to w
+func NewServerConn(r io.Reader, w io.Writer) *ServerConn {
+	return &ServerConn{bufio.NewReader(r), bufio.NewWriter(w)}
+}
+
+// Reply sends a reply, msg lines are separated by \n
+func (s *ServerConn) Reply(code int, msg string) error {
+	lines := strings.Split(msg, "\n")
+	for i, l := range lines {
+		sep := " "
+		if i < len(lines)-1 {
+			sep = "-"
+		}
+		fmt.Fprintf(s.w, "%03d%s%s\r\n", code, sep, l)
+	}
+	return s.flush()
+}
+
+// flush sends buffered replies unless the client already sent the next
+// commands
+func (s *ServerConn) flush() error {
+	if s.r.Buffered() > 0 {
+		return nil
+	}
+	return s.w.Flush()
+}
+
+// Flush sends buffered replies, before closing the connection
+func (s *ServerConn) Flush() error {
+	return s.w.Flush()
+}
+
+// Reset makes the connection use r and w, after a TLS handshake.
+// Commands pipelined with STARTTLS are discarded (RFC 3207 section 4.2).
+func (s *ServerConn) Reset(r io.Reader, w io.Writer) {
+	s.r.Reset(r)
+	s.w.Reset(w)
+}
+
+// ReadLine flushes pending replies and reads a line, without its
+// terminator
+func (s *ServerConn) ReadLine() (string, error) {
+	if err := s.flush(); err != nil {
+		return "", err
+	}
+	var b []byte
+	for {
+		chunk, err := s.r.ReadSlice('\n')
+		b = append(b, chunk...)
+		if len(b) > maxLine {
+			return "", ErrLineTooLong
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// ReadCommand flushes pending replies and reads the next command.
+// verb is upper cased, arg is the rest of the line.
+func (s *ServerConn) ReadCommand() (verb, arg string, err error) {
+	line, err := s.ReadLine()
+	if err != nil {
+		return
+	}
+	verb = line
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		verb, arg = line[:i], strings.TrimLeft(line[i+1:], " ")
+	}
+	return strings.ToUpper(verb), arg, nil
+}
+
+// DataReader returns a reader of the message sent after DATA, up to the
+// final dot. Leading dots are removed and lines end with LF, as in the
+// qmail queue. A line ending with a bare LF is an ErrBareLF (see
+// http://pobox.com/~djb/docs/smtplf.html).
+func (s *ServerConn) DataReader() io.Reader {
+	return &dataReader{r: s.r}
+}
+
+// RawDataReader returns a reader of the message sent after DATA as the
+// client sent it, final dot included, for proxies
+func (s *ServerConn) RawDataReader() io.Reader {
+	return &dataReader{r: s.r, raw: true}
+}
+
+type dataReader struct {
+	r    *bufio.Reader
+	raw  bool
+	line []byte // rest of the current line
+	mid  bool   // in a line longer than the buffer
+	done bool
+	err  error
+}
+
+func (d *dataReader) Read(p []byte) (n int, err error) {
+	for len(d.line) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+		if d.done {
+			return 0, io.EOF
+		}
+		line, err := d.r.ReadSlice('\n')
+		start := !d.mid
+		if d.raw {
+			d.mid = err == bufio.ErrBufferFull
+			if err != nil && err != bufio.ErrBufferFull {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				d.err = err
+				return 0, err
+			}
+			d.done = start && (string(line) == ".\r\n" || string(line) == ".\n")
+			d.line = append(d.line[:0], line...)
+			break
+		}
+		if err == bufio.ErrBufferFull {
+			// long line, the terminator is checked with its last part
+			if start && line[0] == '.' {
+				line = line[1:]
+			}
+			d.line = append(d.line[:0], line...)
+			if line[len(line)-1] == '\r' {
+				// keep the CR with its LF
+				d.line = d.line[:len(d.line)-1]
+				d.r.UnreadByte()
+			}
+			d.mid = true
+			continue
+		}
+		d.mid = false
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			d.err = err
+			return 0, err
+		}
+		if len(line) < 2 || line[len(line)-2] != '\r' {
+			d.err = ErrBareLF
+			return 0, d.err
+		}
+		line = append(line[:len(line)-2], '\n')
+		if start && line[0] == '.' {
+			if len(line) == 2 {
+				d.done = true
+				return 0, io.EOF
+			}
+			line = line[1:]
+		}
+		d.line = append(d.line[:0], line...)
+	}
+	n = copy(p, d.line)
+	d.line = d.line[n:]
+	return n, nil
+}
+
+// ParsePath parses the argument of MAIL or RCPT (keyword is "FROM" or
+// "TO") and returns the address and ESMTP parameters. It is lenient, as
+// qmail-smtpd is : "FROM: user@host" is accepted and source routes are
+// removed.
+func ParsePath(arg, keyword string) (addr, params string, err error) {
+	if len(arg) < len(keyword)+1 || !strings.EqualFold(arg[:len(keyword)], keyword) || arg[len(keyword)] != ':' {
+		return "", "", ErrSyntax
+	}
+	arg = strings.TrimLeft(arg[len(keyword)+1:], " ")
+	if strings.HasPrefix(arg, "<") {
+		i := strings.IndexByte(arg, '>')
+		if i < 0 {
+			return "", "", ErrSyntax
+		}
+		addr, params = arg[1:i], strings.TrimLeft(arg[i+1:], " ")
+	} else {
+		addr = arg
+		if i := strings.IndexByte(arg, ' '); i >= 0 {
+			addr, params = arg[:i], strings.TrimLeft(arg[i+1:], " ")
+		}
+	}
+	// @a,@b:user@host
+	if strings.HasPrefix(addr, "@") {
+		i := strings.IndexByte(addr, ':')
+		if i < 0 {
+			return "", "", ErrSyntax
+		}
+		addr = addr[i+1:]
+	}
+	if strings.ContainsAny(addr, " \t<>") {
+		return "", "", ErrSyntax
+	}
+	return addr, params, nil
+}
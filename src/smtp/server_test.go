@@ -0,0 +1,45 @@
+package smtp
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	for _, tc := range []struct {
+		arg, addr, params string
+		ok                bool
+	}{
+		{"FROM:<a@example.com>", "a@example.com", "", true},
+		{"from: <a@example.com> SIZE=42 BODY=8BITMIME", "a@example.com", "SIZE=42 BODY=8BITMIME", true},
+		{"FROM:<>", "", "", true},
+		{"FROM:a@example.com", "a@example.com", "", true},
+		{"FROM:<@relay.example,@other.example:a@example.com>", "a@example.com", "", true},
+		{"FROM <a@example.com>", "", "", false},
+		{"FROM:<a@example.com", "", "", false},
+		{"TO:<a@example.com>", "", "", false},
+	} {
+		addr, params, err := ParsePath(tc.arg, "FROM")
+		if (err == nil) != tc.ok || addr != tc.addr || params != tc.params {
+			t.Errorf("ParsePath(%q): got %q, %q, %v", tc.arg, addr, params, err)
+		}
+	}
+}
+
+func TestDataReader(t *testing.T) {
+	long := strings.Repeat("x", 5000)
+	s := NewServerConn(strings.NewReader("Subject: a\r\n\r\n..a\r\n."+long+"\r\n.\r\nQUIT\r\n"), ioutil.Discard)
+	data, err := ioutil.ReadAll(s.DataReader())
+	if want := "Subject: a\n\n.a\n" + long + "\n"; err != nil || string(data) != want {
+		t.Errorf("got %q, %v", data, err)
+	}
+	if verb, _, err := s.ReadCommand(); verb != "QUIT" || err != nil {
+		t.Errorf("next command: got %q, %v", verb, err)
+	}
+
+	s = NewServerConn(strings.NewReader("a\r\nb\n.\r\n"), ioutil.Discard)
+	if _, err := ioutil.ReadAll(s.DataReader()); err != ErrBareLF {
+		t.Errorf("bare LF: got %v", err)
+	}
+}
@@ -4,9 +4,10 @@
 
 // Package smtp implements the Simple Mail Transfer Protocol as defined in RFC 5321.
 // It also implements the following extensions:
-//	8BITMIME  RFC 1652
-//	AUTH      RFC 2554
-//	STARTTLS  RFC 3207
+//	8BITMIME             RFC 1652
+//	AUTH                 RFC 2554
+//	STARTTLS             RFC 3207
+//	ENHANCEDSTATUSCODES  RFC 2034
 // Additional extensions may be handled by clients.
 
 package smtp
@@ -14,8 +15,6 @@ package smtp
 import (
 	"crypto/tls"
 	"encoding/base64"
-	"errors"
-	"fmt"
 	"io"
 	"net"
 	"net/textproto"
@@ -45,119 +44,227 @@ type Client struct {
 	Raddr string
 	// Remote port
 	Rport string
+	// per phase deadlines
+	timeouts Timeouts
+	// phase in progress, for timeout reporting
+	phase string
+	// time spent in each phase
+	timings    map[string]time.Duration
+	phaseStart time.Time
 }
 
-// Dial returns a new Client connected to an SMTP server at addr.
-// change dial method to :
-//  - allow localAddr parameter
-//  - add timeout
-// func DialTCP(net string, laddr, raddr *TCPAddr) (*TCPConn, error)
+// SMTP session phases, as used in TimeoutError
+const (
+	PhaseConnect   = "connect"
+	PhaseGreeting  = "greeting"
+	PhaseEhlo      = "EHLO"
+	PhaseStartTLS  = "STARTTLS"
+	PhaseAuth      = "AUTH"
+	PhaseMail      = "MAIL"
+	PhaseRcpt      = "RCPT"
+	PhaseData      = "DATA"
+	PhaseDataBlock = "data block"
+	PhaseDataDone  = "final dot"
+	PhaseQuit      = "QUIT"
+)
 
-// dialChan represente la structuer retournée par la commande dial
-type dialChan struct {
-	conn *net.TCPConn
-	err  error
+// Timeouts holds the deadline of each phase of an SMTP session.
+// A zero duration means no deadline.
+type Timeouts struct {
+	Connect   time.Duration
+	Greeting  time.Duration
+	Ehlo      time.Duration
+	StartTLS  time.Duration
+	Auth      time.Duration
+	Mail      time.Duration
+	Rcpt      time.Duration
+	Data      time.Duration // DATA initiation
+	DataBlock time.Duration // each write of the message
+	DataDone  time.Duration // reply to the final dot
+	Quit      time.Duration
 }
 
-func Dial(remoteAddr string, localAddr string, heloHost string, timeout int) (*Client, error) {
-	raddr, err := net.ResolveTCPAddr("tcp4", remoteAddr)
+// DefaultTimeouts are the values recommended by RFC 5321 section 4.5.3.2.
+// The RFC doesn't cover connect, EHLO, STARTTLS, AUTH and QUIT.
+var DefaultTimeouts = Timeouts{
+	Connect:   10 * time.Second,
+	Greeting:  5 * time.Minute,
+	Ehlo:      5 * time.Minute,
+	StartTLS:  5 * time.Minute,
+	Auth:      5 * time.Minute,
+	Mail:      5 * time.Minute,
+	Rcpt:      5 * time.Minute,
+	Data:      2 * time.Minute,
+	DataBlock: 3 * time.Minute,
+	DataDone:  10 * time.Minute,
+	Quit:      5 * time.Minute,
+}
+
+// network returns the network to dial remoteAddr from localAddr on : the
+// family of localAddr, else of a literal remote IP, else IPv4. Host names
+// of routes then never resolve to an address localAddr can't reach.
+func network(remoteAddr, localAddr string) string {
+	ip := net.ParseIP(localAddr)
+	if ip == nil {
+		host, _, _ := net.SplitHostPort(remoteAddr)
+		ip = net.ParseIP(host)
+	}
+	if ip != nil && ip.To4() == nil {
+		return "tcp6"
+	}
+	return "tcp4"
+}
+
+// Dial returns a new Client connected to an SMTP server at addr.
+// change dial method to :
+//  - allow localAddr parameter
+//  - add per phase timeouts
+func Dial(remoteAddr string, localAddr string, heloHost string, timeouts Timeouts) (*Client, error) {
+	nw := network(remoteAddr, localAddr)
+	raddr, err := net.ResolveTCPAddr(nw, remoteAddr)
 	if err != nil {
 		return nil, err
 	}
 
-	var laddr *net.TCPAddr
-
+	dialer := net.Dialer{Timeout: timeouts.Connect}
 	if len(localAddr) > 0 {
-		laddr, err = net.ResolveTCPAddr("tcp", fmt.Sprintf("%s:0", localAddr))
+		dialer.LocalAddr, err = net.ResolveTCPAddr(nw, net.JoinHostPort(localAddr, "0"))
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// Dial timeout
-	connectTimer := time.NewTimer(time.Duration(timeout) * time.Second)
-	done := make(chan dialChan, 1)
-	go func() {
-		conn, err := net.DialTCP("tcp", laddr, raddr)
-		done <- dialChan{conn, err}
-	}()
-
-	// Wait for the conn or  timeout
-	select {
-	case r := <-done:
-		if r.err == nil {
-			host := remoteAddr[:strings.Index(remoteAddr, ":")]
-			return NewClient(r.conn, host, heloHost)
-		} else {
-			return nil, r.err
-		}
-	// Timeout
-	case <-connectTimer.C:
-		return nil, errors.New("Timeout")
-	}
-
-	/*conn, err := net.DialTCP("tcp", laddr, raddr)
-
+	start := time.Now()
+	conn, err := dialer.Dial(nw, raddr.String())
 	if err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return nil, &TimeoutError{PhaseConnect}
+		}
 		return nil, err
 	}
-	host := remoteAddr[:strings.Index(remoteAddr, ":")]
-	return NewClient(conn, host, heloHost)*/
+	host, _, _ := net.SplitHostPort(remoteAddr)
+	c, err := newClient(conn, host, heloHost, timeouts)
+	if c != nil {
+		c.timings[PhaseConnect] = c.phaseStart.Sub(start)
+	}
+	return c, err
 }
 
 // NewClient returns a new Client using an existing connection and host as a
 // server name to be used when authenticating.
 func NewClient(conn net.Conn, host string, heloHost string) (*Client, error) {
-	// Remote port
-	/*_, rPort, err := net.SplitHostPort(host)
-	if err != nil {
-		return nil, err
-	}*/
-	text := textproto.NewConn(conn)
-	_, _, err := text.ReadResponse(220)
+	return newClient(conn, host, heloHost, DefaultTimeouts)
+}
+
+func newClient(conn net.Conn, host string, heloHost string, timeouts Timeouts) (*Client, error) {
+	c := &Client{Text: textproto.NewConn(conn), conn: conn, serverName: host, heloHost: heloHost, Laddr: conn.LocalAddr().String(), Raddr: conn.RemoteAddr().String(), timeouts: timeouts, timings: make(map[string]time.Duration)}
+	c.setPhase(PhaseGreeting, timeouts.Greeting)
+	_, err := c.readReply(220)
 	if err != nil {
-		text.Close()
+		c.Text.Close()
 		return nil, err
 	}
-	c := &Client{Text: text, conn: conn, serverName: host, heloHost: heloHost, Laddr: conn.LocalAddr().String(), Raddr: conn.RemoteAddr().String()}
 	err = c.ehlo()
-	if err != nil {
+	if _, ok := err.(*Error); ok {
 		err = c.helo()
 	}
-	return c, err
+	if err != nil {
+		c.Text.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// setPhase records the phase in progress and sets the connection deadline
+func (c *Client) setPhase(phase string, timeout time.Duration) {
+	now := time.Now()
+	if c.phase != "" {
+		c.timings[c.phase] += now.Sub(c.phaseStart)
+	}
+	c.phase = phase
+	c.phaseStart = now
+	if timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(timeout))
+	} else {
+		c.conn.SetDeadline(time.Time{})
+	}
+}
+
+// Timings returns the time spent in each phase of the session so far
+func (c *Client) Timings() map[string]time.Duration {
+	now := time.Now()
+	c.timings[c.phase] += now.Sub(c.phaseStart)
+	c.phaseStart = now
+	timings := make(map[string]time.Duration, len(c.timings))
+	for phase, d := range c.timings {
+		timings[phase] = d
+	}
+	return timings
+}
+
+// TLSConnectionState returns the client's TLS connection state.
+// ok is false if STARTTLS has not been done.
+func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	return tc.ConnectionState(), true
+}
+
+// netErr converts a network error to a TimeoutError or a NetError for the
+// current phase
+func (c *Client) netErr(err error) error {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return &TimeoutError{c.phase}
+	}
+	return &NetError{c.phase, err}
 }
 
 // cmd is a convenience function that sends a command and returns the response
-func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+func (c *Client) cmd(expectCode int, format string, args ...interface{}) (*Reply, error) {
 	id, err := c.Text.Cmd(format, args...)
 	if err != nil {
-		return 0, "", err
+		return nil, c.netErr(err)
 	}
 	c.Text.StartResponse(id)
 	defer c.Text.EndResponse(id)
+	return c.readReply(expectCode)
+}
+
+// readReply reads a reply from the server, expectCode is used as in
+// textproto.Reader.ReadResponse. An unexpected reply is returned as an *Error.
+func (c *Client) readReply(expectCode int) (*Reply, error) {
 	code, msg, err := c.Text.ReadResponse(expectCode)
-	return code, msg, err
+	if err != nil {
+		if tpe, ok := err.(*textproto.Error); ok {
+			return nil, &Error{newReply(tpe.Code, tpe.Msg), c.phase}
+		}
+		return nil, c.netErr(err)
+	}
+	r := newReply(code, msg)
+	return &r, nil
 }
 
 // helo sends the HELO greeting to the server. It should be used only when the
 // server does not support ehlo.
 func (c *Client) helo() error {
 	c.ext = nil
-	cmd := fmt.Sprintf("HELO %s", c.heloHost)
-	_, _, err := c.cmd(250, cmd)
+	c.setPhase(PhaseEhlo, c.timeouts.Ehlo)
+	_, err := c.cmd(250, "HELO %s", c.heloHost)
 	return err
 }
 
 // ehlo sends the EHLO (extended hello) greeting to the server. It
 // should be the preferred greeting for servers that support it.
 func (c *Client) ehlo() error {
-	cmd := fmt.Sprintf("EHLO %s", c.heloHost)
-	_, msg, err := c.cmd(250, cmd)
+	c.setPhase(PhaseEhlo, c.timeouts.Ehlo)
+	r, err := c.cmd(250, "EHLO %s", c.heloHost)
 	if err != nil {
 		return err
 	}
 	ext := make(map[string]string)
-	extList := strings.Split(msg, "\n")
+	extList := strings.Split(r.Msg, "\n")
 	if len(extList) > 1 {
 		extList = extList[1:]
 		for _, line := range extList {
@@ -178,12 +285,21 @@ func (c *Client) ehlo() error {
 
 // StartTLS sends the STARTTLS command and encrypts all further communication.
 // Only servers that advertise the STARTTLS extension support this function.
+// A failed handshake is returned as a *TLSError.
 func (c *Client) StartTLS(config *tls.Config) error {
-	_, _, err := c.cmd(220, "STARTTLS")
+	c.setPhase(PhaseStartTLS, c.timeouts.StartTLS)
+	_, err := c.cmd(220, "STARTTLS")
 	if err != nil {
 		return err
 	}
-	c.conn = tls.Client(c.conn, config)
+	tlsConn := tls.Client(c.conn, config)
+	if err = tlsConn.Handshake(); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return &TimeoutError{c.phase}
+		}
+		return &TLSError{err}
+	}
+	c.conn = tlsConn
 	c.Text = textproto.NewConn(c.conn)
 	c.tls = true
 	return c.ehlo()
@@ -194,7 +310,8 @@ func (c *Client) StartTLS(config *tls.Config) error {
 // does not necessarily indicate an invalid address. Many servers
 // will not verify addresses for security reasons.
 func (c *Client) Verify(addr string) error {
-	_, _, err := c.cmd(250, "VRFY %s", addr)
+	c.setPhase(PhaseRcpt, c.timeouts.Rcpt)
+	_, err := c.cmd(250, "VRFY %s", addr)
 	return err
 }
 
@@ -203,6 +320,7 @@ func (c *Client) Verify(addr string) error {
 // Only servers that advertise the AUTH extension support this function.
 func (c *Client) Auth(a Auth) error {
 	encoding := base64.StdEncoding
+	c.setPhase(PhaseAuth, c.timeouts.Auth)
 	mech, resp, err := a.Start(&ServerInfo{c.serverName, c.tls, c.auth})
 	if err != nil {
 		c.Quit()
@@ -210,19 +328,21 @@ func (c *Client) Auth(a Auth) error {
 	}
 	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
 	encoding.Encode(resp64, resp)
-	code, msg64, err := c.cmd(0, "AUTH %s %s", mech, resp64)
+	r, err := c.cmd(0, "AUTH %s %s", mech, resp64)
 	for err == nil {
 		var msg []byte
-		switch code {
+		switch r.Code {
 		case 334:
-			msg, err = encoding.DecodeString(msg64)
+			msg, err = encoding.DecodeString(r.Msg)
 		case 235:
 			// the last message isn't base64 because it isn't a challenge
-			msg = []byte(msg64)
+			msg = []byte(r.Msg)
 		default:
-			err = &textproto.Error{Code: code, Msg: msg64}
+			err = &Error{*r, c.phase}
+		}
+		if err == nil {
+			resp, err = a.Next(msg, r.Code == 334)
 		}
-		resp, err = a.Next(msg, code == 334)
 
 		if err != nil {
 			// abort the AUTH
@@ -235,7 +355,7 @@ func (c *Client) Auth(a Auth) error {
 		}
 		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
 		encoding.Encode(resp64, resp)
-		code, msg64, err = c.cmd(0, string(resp64))
+		r, err = c.cmd(0, "%s", resp64)
 	}
 	return err
 }
@@ -244,52 +364,70 @@ func (c *Client) Auth(a Auth) error {
 // If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
 // parameter.
 // This initiates a mail transaction and is followed by one or more Rcpt calls.
-func (c *Client) Mail(from string) error {
+func (c *Client) Mail(from string) (*Reply, error) {
 	cmdStr := "MAIL FROM:<%s>"
 	if c.ext != nil {
 		if _, ok := c.ext["8BITMIME"]; ok {
 			cmdStr += " BODY=8BITMIME"
 		}
 	}
-	_, _, err := c.cmd(250, cmdStr, from)
-	return err
+	c.setPhase(PhaseMail, c.timeouts.Mail)
+	return c.cmd(250, cmdStr, from)
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
 // A call to Rcpt must be preceded by a call to Mail and may be followed by
 // a Data call or another Rcpt call.
-func (c *Client) Rcpt(to string) error {
-	_, _, err := c.cmd(25, "RCPT TO:<%s>", to)
-	return err
+func (c *Client) Rcpt(to string) (*Reply, error) {
+	c.setPhase(PhaseRcpt, c.timeouts.Rcpt)
+	return c.cmd(25, "RCPT TO:<%s>", to)
 }
 
-type dataCloser struct {
-	c *Client
-	io.WriteCloser
+// DataWriter writes the message after a DATA command
+type DataWriter struct {
+	c     *Client
+	w     io.WriteCloser
+	reply *Reply
 }
 
-func (d *dataCloser) Close() error {
-	var rerr error
-	d.WriteCloser.Close()
-	_, msg, err := d.c.Text.ReadResponse(250)
-	if err == nil {
-		rerr = errors.New(fmt.Sprintf("O%s", msg))
-	} else {
-		rerr = errors.New(fmt.Sprintf("1%s", err.Error()))
+// Write sends a block of the message, each block has its own deadline
+func (d *DataWriter) Write(p []byte) (int, error) {
+	d.c.setPhase(PhaseDataBlock, d.c.timeouts.DataBlock)
+	n, err := d.w.Write(p)
+	if err != nil {
+		return n, d.c.netErr(err)
 	}
-	return rerr
+	return n, nil
+}
+
+// Close sends the final dot and reads the server reply. If the server
+// refuses the message the reply is returned as an *Error.
+func (d *DataWriter) Close() (err error) {
+	d.c.setPhase(PhaseDataBlock, d.c.timeouts.DataBlock)
+	if err = d.w.Close(); err != nil {
+		return d.c.netErr(err)
+	}
+	d.c.setPhase(PhaseDataDone, d.c.timeouts.DataDone)
+	d.reply, err = d.c.readReply(250)
+	return
+}
+
+// Reply returns the server reply to the final dot, once Close succeeded
+func (d *DataWriter) Reply() *Reply {
+	return d.reply
 }
 
 // Data issues a DATA command to the server and returns a writer that
 // can be used to write the data. The caller should close the writer
 // before calling any more methods on c.
 // A call to Data must be preceded by one or more calls to Rcpt.
-func (c *Client) Data() (io.WriteCloser, error) {
-	_, _, err := c.cmd(354, "DATA")
+func (c *Client) Data() (*DataWriter, error) {
+	c.setPhase(PhaseData, c.timeouts.Data)
+	_, err := c.cmd(354, "DATA")
 	if err != nil {
 		return nil, err
 	}
-	return &dataCloser{c, c.Text.DotWriter()}, nil
+	return &DataWriter{c: c, w: c.Text.DotWriter()}, nil
 }
 
 // SendMail connects to the server at addr, switches to TLS if possible,
@@ -351,15 +489,23 @@ func (c *Client) Extension(ext string) (bool, string) {
 // Reset sends the RSET command to the server, aborting the current mail
 // transaction.
 func (c *Client) Reset() error {
-	_, _, err := c.cmd(250, "RSET")
+	c.setPhase(PhaseMail, c.timeouts.Mail)
+	_, err := c.cmd(250, "RSET")
 	return err
 }
 
 // Quit sends the QUIT command and closes the connection to the server.
 func (c *Client) Quit() error {
-	_, _, err := c.cmd(221, "QUIT")
+	c.setPhase(PhaseQuit, c.timeouts.Quit)
+	_, err := c.cmd(221, "QUIT")
 	if err != nil {
 		return err
 	}
 	return c.Text.Close()
 }
+
+// Close closes the connection without sending QUIT, to be used when the
+// session is broken (timeout, network error).
+func (c *Client) Close() error {
+	return c.Text.Close()
+}
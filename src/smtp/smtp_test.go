@@ -0,0 +1,20 @@
+package smtp
+
+import "testing"
+
+func TestNetwork(t *testing.T) {
+	for _, tc := range []struct {
+		remote, local, want string
+	}{
+		{"mx.example.com:25", "", "tcp4"},
+		{"mx.example.com:25", "192.0.2.1", "tcp4"},
+		{"mx.example.com:25", "2001:db8::1", "tcp6"},
+		{"[2001:db8::25]:25", "", "tcp6"},
+		{"192.0.2.25:25", "", "tcp4"},
+		{"[2001:db8::25]:25", "192.0.2.1", "tcp4"},
+	} {
+		if got := network(tc.remote, tc.local); got != tc.want {
+			t.Errorf("network(%s, %s): got %s, want %s", tc.remote, tc.local, got, tc.want)
+		}
+	}
+}
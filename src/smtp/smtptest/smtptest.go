@@ -0,0 +1,502 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package smtptest provides a scriptable SMTP server for tests, listening
+// on the loopback interface.
+//
+//	srv := smtptest.NewUnstartedServer()
+//	srv.Replies["RCPT"] = []string{"250 2.1.5 Ok", "550 5.1.1 No such user"}
+//	srv.Start()
+//	defer srv.Close()
+//
+// Replies are consumed in order for each session, the last one is repeated.
+package smtptest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Special replies
+const (
+	// Drop closes the connection instead of replying
+	Drop = "<drop>"
+	// Stall never replies (until the server is closed)
+	Stall = "<stall>"
+)
+
+// EndOfData is the key of Replies for the reply to the final dot
+const EndOfData = "."
+
+// Greeting is the key of Replies for the greeting
+const Greeting = "GREETING"
+
+// DefaultReplies are the replies used for commands not in Server.Replies
+var DefaultReplies = map[string]string{
+	Greeting:   "220 smtptest ESMTP",
+	"HELO":     "250 smtptest",
+	"MAIL":     "250 2.1.0 Ok",
+	"RCPT":     "250 2.1.5 Ok",
+	"DATA":     "354 End data with <CR><LF>.<CR><LF>",
+	EndOfData:  "250 2.0.0 Ok: queued as 42",
+	"RSET":     "250 2.0.0 Ok",
+	"NOOP":     "250 2.0.0 Ok",
+	"VRFY":     "252 2.0.0 Cannot VRFY user",
+	"QUIT":     "221 2.0.0 Bye",
+	"STARTTLS": "220 2.0.0 Ready to start TLS",
+}
+
+// Session is what a client sent during a connection
+type Session struct {
+	RemoteAddr string
+	Helo       string
+	TLS        bool
+	AuthUser   string
+	From       string
+	To         []string // accepted recipients
+	Data       []byte   // message, with CRLF line endings and dots unstuffed
+	Commands   []string // all command lines received
+}
+
+// Server is a scriptable SMTP server
+type Server struct {
+	// Addr is ip:port, set by Start
+	Addr string
+	// Extensions are the EHLO keywords, STARTTLS and AUTH are added
+	// when TLSConfig and Users are set
+	Extensions []string
+	// Replies are scripted replies by command verb (MAIL, RCPT, EHLO...),
+	// Greeting or EndOfData. Multi-line replies use \n.
+	Replies map[string][]string
+	// TLSConfig enables STARTTLS
+	TLSConfig *tls.Config
+	// Users enables AUTH (user -> password)
+	Users map[string]string
+	// Mechanisms are the AUTH mechanisms offered, among PLAIN, LOGIN and
+	// CRAM-MD5
+	Mechanisms []string
+	// Delay is applied before each reply
+	Delay time.Duration
+
+	ln       net.Listener
+	mu       sync.Mutex
+	sessions []*Session
+	conns    map[net.Conn]bool
+	closed   chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewUnstartedServer returns a Server with default settings, to be
+// configured then started
+func NewUnstartedServer() *Server {
+	return &Server{
+		Extensions: []string{"8BITMIME", "ENHANCEDSTATUSCODES", "PIPELINING"},
+		Replies:    make(map[string][]string),
+		Mechanisms: []string{"PLAIN", "LOGIN", "CRAM-MD5"},
+		conns:      make(map[net.Conn]bool),
+		closed:     make(chan struct{}),
+	}
+}
+
+// NewServer returns a started Server with default settings
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// Start starts listening on a random port of 127.0.0.1
+func (s *Server) Start() {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: failed to listen: %v", err))
+	}
+	s.ln = ln
+	s.Addr = ln.Addr().String()
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns[conn] = true
+			s.mu.Unlock()
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(conn)
+			}()
+		}
+	}()
+}
+
+// Close stops the server and closes all connections
+func (s *Server) Close() {
+	close(s.closed)
+	s.ln.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Sessions returns the sessions handled so far
+func (s *Server) Sessions() []*Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sessions := make([]*Session, len(s.sessions))
+	copy(sessions, s.sessions)
+	return sessions
+}
+
+// EnableTLS sets TLSConfig with a self-signed certificate for 127.0.0.1
+func (s *Server) EnableTLS() {
+	cert, err := GenerateCert("127.0.0.1", "localhost")
+	if err != nil {
+		panic(fmt.Sprintf("smtptest: %v", err))
+	}
+	s.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+}
+
+// GenerateCert returns a self-signed certificate for hosts (IPs or names)
+func GenerateCert(hosts ...string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "smtptest"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// conn is a server side connection
+type conn struct {
+	s       *Server
+	c       net.Conn
+	text    *textproto.Conn
+	sess    *Session
+	counts  map[string]int
+	dropped bool
+}
+
+// reply returns the next reply for key
+func (c *conn) reply(key string) string {
+	replies := c.s.Replies[key]
+	if len(replies) == 0 {
+		return DefaultReplies[key]
+	}
+	i := c.counts[key]
+	c.counts[key]++
+	if i >= len(replies) {
+		i = len(replies) - 1
+	}
+	return replies[i]
+}
+
+// send sends reply, which may be multi-line. It returns false if the
+// connection has been dropped.
+func (c *conn) send(reply string) bool {
+	if c.s.Delay > 0 {
+		time.Sleep(c.s.Delay)
+	}
+	switch reply {
+	case Drop:
+		c.c.Close()
+		c.dropped = true
+		return false
+	case Stall:
+		<-c.s.closed
+		c.dropped = true
+		return false
+	}
+	lines := strings.Split(reply, "\n")
+	code := lines[0][:3]
+	for i, l := range lines {
+		text := strings.TrimPrefix(l, code)
+		text = strings.TrimLeft(text, " -")
+		sep := "-"
+		if i == len(lines)-1 {
+			sep = " "
+		}
+		if err := c.text.PrintfLine("%s%s%s", code, sep, text); err != nil {
+			c.dropped = true
+			return false
+		}
+	}
+	return true
+}
+
+// send sends the scripted reply for key
+func (c *conn) sendFor(key string) bool {
+	return c.send(c.reply(key))
+}
+
+func (s *Server) serve(nc net.Conn) {
+	c := &conn{s: s, c: nc, text: textproto.NewConn(nc), sess: &Session{RemoteAddr: nc.RemoteAddr().String()}, counts: make(map[string]int)}
+	s.mu.Lock()
+	s.sessions = append(s.sessions, c.sess)
+	s.mu.Unlock()
+	defer func() {
+		nc.Close()
+		s.mu.Lock()
+		delete(s.conns, nc)
+		s.mu.Unlock()
+	}()
+
+	if !c.sendFor(Greeting) {
+		return
+	}
+	for {
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		c.sess.Commands = append(c.sess.Commands, line)
+		s.mu.Unlock()
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		verb = strings.ToUpper(verb)
+		if !c.handle(verb, arg) {
+			return
+		}
+	}
+}
+
+// handle handles a command, it returns false when the session is over
+func (c *conn) handle(verb, arg string) bool {
+	s := c.s
+	switch verb {
+	case "EHLO":
+		c.sess.Helo = arg
+		if r := s.Replies["EHLO"]; len(r) > 0 {
+			return c.sendFor("EHLO")
+		}
+		lines := []string{"250 smtptest"}
+		lines = append(lines, s.Extensions...)
+		if s.TLSConfig != nil && !c.sess.TLS {
+			lines = append(lines, "STARTTLS")
+		}
+		if len(s.Users) > 0 {
+			lines = append(lines, "AUTH "+strings.Join(s.Mechanisms, " "))
+		}
+		return c.send(strings.Join(lines, "\n"))
+	case "HELO":
+		c.sess.Helo = arg
+		return c.sendFor("HELO")
+	case "STARTTLS":
+		if s.TLSConfig == nil || c.sess.TLS {
+			return c.send("502 5.5.1 STARTTLS not available")
+		}
+		r := c.reply("STARTTLS")
+		if !c.send(r) || !strings.HasPrefix(r, "220") {
+			return !c.dropped
+		}
+		tlsConn := tls.Server(c.c, s.TLSConfig)
+		if err := tlsConn.Handshake(); err != nil {
+			return false
+		}
+		c.c = tlsConn
+		c.text = textproto.NewConn(tlsConn)
+		c.sess.TLS = true
+		return true
+	case "AUTH":
+		if r := s.Replies["AUTH"]; len(r) > 0 {
+			return c.sendFor("AUTH")
+		}
+		return c.auth(arg)
+	case "MAIL":
+		r := c.reply("MAIL")
+		if strings.HasPrefix(r, "250") {
+			c.sess.From = address(arg)
+		}
+		return c.send(r)
+	case "RCPT":
+		r := c.reply("RCPT")
+		if strings.HasPrefix(r, "25") {
+			c.sess.To = append(c.sess.To, address(arg))
+		}
+		return c.send(r)
+	case "DATA":
+		r := c.reply("DATA")
+		if !c.send(r) || !strings.HasPrefix(r, "354") {
+			return !c.dropped
+		}
+		data, err := c.text.ReadDotBytes()
+		if err != nil {
+			return false
+		}
+		c.s.mu.Lock()
+		c.sess.Data = []byte(strings.Replace(string(data), "\n", "\r\n", -1))
+		c.s.mu.Unlock()
+		return c.sendFor(EndOfData)
+	case "QUIT":
+		c.sendFor("QUIT")
+		return false
+	case "RSET", "NOOP", "VRFY":
+		return c.sendFor(verb)
+	}
+	return c.send("502 5.5.2 Error: command not recognized")
+}
+
+// auth handles AUTH PLAIN, LOGIN and CRAM-MD5
+func (c *conn) auth(arg string) bool {
+	if len(c.s.Users) == 0 {
+		return c.send("502 5.5.1 AUTH not available")
+	}
+	t := strings.Fields(arg)
+	if len(t) == 0 {
+		return c.send("501 5.5.4 Syntax: AUTH mechanism")
+	}
+	mech := strings.ToUpper(t[0])
+	offered := false
+	for _, m := range c.s.Mechanisms {
+		offered = offered || m == mech
+	}
+	if !offered {
+		return c.send("504 5.5.4 Unrecognized authentication type")
+	}
+	var user, pass string
+	ok := false
+	switch mech {
+	case "PLAIN":
+		resp := ""
+		if len(t) > 1 {
+			resp = t[1]
+		} else {
+			if !c.send("334 ") {
+				return false
+			}
+			line, err := c.text.ReadLine()
+			if err != nil {
+				return false
+			}
+			resp = line
+		}
+		b, err := base64.StdEncoding.DecodeString(resp)
+		if err != nil {
+			return c.send("501 5.5.2 Cannot decode response")
+		}
+		p := strings.Split(string(b), "\x00")
+		if len(p) != 3 {
+			return c.send("501 5.5.2 Bad PLAIN response")
+		}
+		user, pass = p[1], p[2]
+		ok = c.s.Users[user] == pass
+	case "LOGIN":
+		var fields [2]string
+		for i, prompt := range []string{"VXNlcm5hbWU6", "UGFzc3dvcmQ6"} {
+			if !c.send("334 " + prompt) {
+				return false
+			}
+			line, err := c.text.ReadLine()
+			if err != nil {
+				return false
+			}
+			b, err := base64.StdEncoding.DecodeString(line)
+			if err != nil {
+				return c.send("501 5.5.2 Cannot decode response")
+			}
+			fields[i] = string(b)
+		}
+		user, pass = fields[0], fields[1]
+		ok = c.s.Users[user] == pass
+	case "CRAM-MD5":
+		challenge := fmt.Sprintf("<%d.%d@smtptest>", time.Now().UnixNano(), len(c.s.sessions))
+		if !c.send("334 " + base64.StdEncoding.EncodeToString([]byte(challenge))) {
+			return false
+		}
+		line, err := c.text.ReadLine()
+		if err != nil {
+			return false
+		}
+		b, err := base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			return c.send("501 5.5.2 Cannot decode response")
+		}
+		p := strings.SplitN(string(b), " ", 2)
+		if len(p) == 2 {
+			user = p[0]
+			if secret, exists := c.s.Users[user]; exists {
+				d := hmac.New(md5.New, []byte(secret))
+				d.Write([]byte(challenge))
+				ok = fmt.Sprintf("%x", d.Sum(nil)) == p[1]
+			}
+		}
+	default:
+		return c.send("504 5.5.4 Unrecognized authentication type")
+	}
+	if !ok {
+		return c.send("535 5.7.8 Authentication credentials invalid")
+	}
+	c.s.mu.Lock()
+	c.sess.AuthUser = user
+	c.s.mu.Unlock()
+	return c.send("235 2.7.0 Authentication successful")
+}
+
+// address extracts the address from FROM:<addr> params
+func address(arg string) string {
+	if i := strings.IndexByte(arg, '<'); i >= 0 {
+		if j := strings.IndexByte(arg[i:], '>'); j >= 0 {
+			return arg[i+1 : i+j]
+		}
+	}
+	if i := strings.IndexByte(arg, ':'); i >= 0 {
+		return strings.TrimSpace(arg[i+1:])
+	}
+	return arg
+}
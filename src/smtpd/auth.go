@@ -0,0 +1,191 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package smtpd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// errTempAuth is a checkpassword temporary failure
+var errTempAuth = fmt.Errorf("temporary authentication failure")
+
+// errAuthFailures ends sessions guessing passwords
+var errAuthFailures = fmt.Errorf("too many authentication failures")
+
+// maxAuthFailures is the number of failed AUTH which ends a session
+const maxAuthFailures = 3
+
+// authDelay is the delay before the reply to the first failed AUTH, it
+// grows with the next ones
+var authDelay = 2 * time.Second
+
+// checkpassword runs the checkpassword command, which reads
+// user\0password\0timestamp\0 on fd 3. For CRAM-MD5 it reads
+// user\0response\0challenge\0, as with cmd5checkpw.
+// Exit codes : 0 ok, 111 temporary failure, anything else bad password.
+func (s *Session) checkpassword(user, secret, stamp string) (bool, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return false, errTempAuth
+	}
+	cmd := exec.Command(s.Checkpassword[0], s.Checkpassword[1:]...)
+	cmd.ExtraFiles = []*os.File{r}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		w.Close()
+		return false, errTempAuth
+	}
+	w.WriteString(user + "\x00" + secret + "\x00" + stamp + "\x00")
+	w.Close()
+	if err = cmd.Wait(); err != nil {
+		if ee, ok := err.(*exec.ExitError); ok && ee.ExitCode() != 111 && ee.ExitCode() != -1 {
+			return false, nil
+		}
+		return false, errTempAuth
+	}
+	return true, nil
+}
+
+// readAuthLine sends a 334 challenge and returns the decoded answer.
+// ok is false if the client aborted or sent garbage (already replied).
+func (s *Session) readAuthLine(challenge string) (answer string, ok bool, err error) {
+	s.conn.Reply(334, base64.StdEncoding.EncodeToString([]byte(challenge)))
+	line, err := s.conn.ReadLine()
+	if err != nil {
+		return "", false, err
+	}
+	return s.decodeAuth(line)
+}
+
+// decodeAuth decodes a base64 SASL answer
+func (s *Session) decodeAuth(line string) (string, bool, error) {
+	if line == "*" {
+		s.conn.Reply(501, "auth exchange cancelled (#5.0.0)")
+		return "", false, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(line)
+	if err != nil {
+		s.conn.Reply(501, "malformed auth input (#5.5.4)")
+		return "", false, nil
+	}
+	return string(b), true, nil
+}
+
+// auth handles AUTH PLAIN, LOGIN and CRAM-MD5, only offered over TLS.
+// Failures are answered later and later, the session ends after
+// maxAuthFailures. A non nil error ends the session.
+func (s *Session) auth(arg string) error {
+	switch {
+	case s.Checkpassword == nil:
+		s.conn.Reply(502, "unimplemented (#5.5.1)")
+		return nil
+	case !s.tls:
+		s.conn.Reply(538, "encryption required for requested authentication mechanism (#5.7.11)")
+		return nil
+	case s.user != "":
+		s.conn.Reply(503, "you're already authenticated (#5.5.0)")
+		return nil
+	case s.seenMail:
+		s.conn.Reply(503, "no auth during mail transaction (#5.5.0)")
+		return nil
+	}
+	mech, initial := arg, ""
+	if i := strings.IndexByte(arg, ' '); i >= 0 {
+		mech, initial = arg[:i], strings.TrimSpace(arg[i+1:])
+	}
+	var user, secret, stamp string
+	var ok bool
+	var err error
+	switch strings.ToUpper(mech) {
+	case "PLAIN":
+		var resp string
+		if initial != "" {
+			resp, ok, err = s.decodeAuth(initial)
+		} else {
+			resp, ok, err = s.readAuthLine("")
+		}
+		if !ok {
+			return err
+		}
+		// authzid\0authcid\0passwd
+		t := strings.Split(resp, "\x00")
+		if len(t) != 3 || t[1] == "" || (t[0] != "" && t[0] != t[1]) {
+			s.conn.Reply(501, "malformed auth input (#5.5.4)")
+			return nil
+		}
+		user, secret = t[1], t[2]
+	case "LOGIN":
+		if initial != "" {
+			user, ok, err = s.decodeAuth(initial)
+		} else {
+			user, ok, err = s.readAuthLine("Username:")
+		}
+		if !ok {
+			return err
+		}
+		if secret, ok, err = s.readAuthLine("Password:"); !ok {
+			return err
+		}
+	case "CRAM-MD5":
+		stamp = fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixNano(), s.Me)
+		var resp string
+		if resp, ok, err = s.readAuthLine(stamp); !ok {
+			return err
+		}
+		i := strings.LastIndexByte(resp, ' ')
+		if i < 1 {
+			s.conn.Reply(501, "malformed auth input (#5.5.4)")
+			return nil
+		}
+		user, secret = resp[:i], resp[i+1:]
+	default:
+		s.conn.Reply(504, "auth type unimplemented (#5.5.1)")
+		return nil
+	}
+	if stamp == "" {
+		stamp = fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().Unix(), s.Me)
+	}
+	ok, err = s.checkpassword(user, secret, stamp)
+	switch {
+	case err != nil:
+		s.conn.Reply(454, "temporary authentication failure (#4.3.0)")
+	case !ok:
+		s.authBad++
+		if s.Log != nil {
+			s.Log.Printf("authentication failed for %s from %s", user, s.RemoteIP)
+		}
+		time.Sleep(time.Duration(s.authBad) * authDelay)
+		if s.authBad >= maxAuthFailures {
+			s.conn.Reply(421, "too many authentication failures (#4.7.0)")
+			return errAuthFailures
+		}
+		s.conn.Reply(535, "authentication failed (#5.7.8)")
+	default:
+		s.user = user
+		s.conn.Reply(235, "ok, go ahead (#2.0.0)")
+	}
+	return nil
+}
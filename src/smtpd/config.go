@@ -0,0 +1,161 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+package smtpd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+	"github.com/toorop/qmail-boosters/src/rcpthosts"
+)
+
+// Config is read from control files and from the tcpserver environment
+type Config struct {
+	Me          string
+	Greeting    string
+	LocalIPHost string
+	RcptHosts   *rcpthosts.Hosts // nil : no control/rcpthosts, every domain is allowed
+	BadMailFrom []string
+	Databytes   int64 // 0 : no limit
+	Timeout     time.Duration
+
+	LocalHost   string
+	RemoteIP    string
+	RemoteHost  string
+	RemoteInfo  string
+	RelayClient *string // RELAYCLIENT, nil if not set
+
+	TLSConfig     *tls.Config // STARTTLS is offered if set
+	Checkpassword []string    // checkpassword command, AUTH is offered over TLS if set
+	AuthRequired  bool        // MAIL needs AUTH (submission)
+}
+
+// readList returns the lines of an optional control file, lower cased
+func readList(file string) ([]string, error) {
+	lines, err := control.ReadLines(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for i := range lines {
+		lines[i] = strings.ToLower(lines[i])
+	}
+	if lines == nil {
+		lines = []string{}
+	}
+	return lines, nil
+}
+
+// readInt returns the number in the first line of file, def if none
+func readInt(file string, def int64) (int64, error) {
+	s, err := control.ReadFirstLine(file, "")
+	if err != nil || s == "" {
+		return def, err
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+func getenv(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// ReadConfig reads the control files (me, smtpgreeting, localiphost,
+// rcpthosts, morercpthosts.cdb, badmailfrom, databytes, timeoutsmtpd) and
+// the tcpserver environment
+func ReadConfig() (*Config, error) {
+	c := &Config{}
+	var err error
+	if c.Me, err = control.ReadFirstLine("control/me", ""); err != nil {
+		return nil, err
+	}
+	if c.Me == "" {
+		return nil, fmt.Errorf("no control/me")
+	}
+	if c.Greeting, err = control.ReadFirstLine("control/smtpgreeting", c.Me); err != nil {
+		return nil, err
+	}
+	if c.LocalIPHost, err = control.ReadFirstLine("control/localiphost", c.Me); err != nil {
+		return nil, err
+	}
+	if c.RcptHosts, err = rcpthosts.Load(); err != nil {
+		return nil, err
+	}
+	if c.BadMailFrom, err = readList("control/badmailfrom"); err != nil {
+		return nil, err
+	}
+	if c.Databytes, err = readInt("control/databytes", 0); err != nil {
+		return nil, err
+	}
+	if v := os.Getenv("DATABYTES"); v != "" {
+		if c.Databytes, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, err
+		}
+	}
+	timeout, err := readInt("control/timeoutsmtpd", 1200)
+	if err != nil {
+		return nil, err
+	}
+	c.Timeout = time.Duration(timeout) * time.Second
+
+	c.LocalHost = getenv("TCPLOCALHOST", getenv("TCPLOCALIP", "unknown"))
+	c.RemoteIP = getenv("TCPREMOTEIP", "unknown")
+	c.RemoteHost = getenv("TCPREMOTEHOST", "unknown")
+	c.RemoteInfo = os.Getenv("TCPREMOTEINFO")
+	if v, ok := os.LookupEnv("RELAYCLIENT"); ok {
+		c.RelayClient = &v
+	}
+	return c, nil
+}
+
+// ReadTLSConfig returns the TLS configuration of control/servercert.pem
+// (certificate then key, as with the qmail TLS patch), nil if there is no
+// such file
+func ReadTLSConfig() (*tls.Config, error) {
+	file := control.Path("control/servercert.pem")
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(file, file)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{pair}}, nil
+}
+
+// badMail tells if addr is in control/badmailfrom (address or @domain)
+func (c *Config) badMail(addr string) bool {
+	addr = strings.ToLower(addr)
+	i := strings.LastIndexByte(addr, '@')
+	for _, b := range c.BadMailFrom {
+		if b == addr || (i >= 0 && b == addr[i:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,444 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package smtpd is the SMTP server of qmail-smtpd and qmail-submission.
+// It behaves as qmail-smtpd does and injects messages with qmail-queue,
+// stamped with X-QB-UUID and Received header fields.
+package smtpd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/qmailqueue"
+	"github.com/toorop/qmail-boosters/src/smtp"
+	"github.com/toorop/qmail-boosters/src/uuid"
+)
+
+// maxHops is the max number of Received and Delivered-To header fields
+const maxHops = 100
+
+// Session is a SMTP session
+type Session struct {
+	*Config
+	Log *log.Logger // where accepted messages are logged, if not nil
+
+	conn    *smtp.ServerConn
+	netConn net.Conn // nil under tcpserver
+	tls     bool
+	user    string // authenticated user
+	authBad int    // failed AUTH
+
+	helo        string
+	esmtp       bool
+	seenMail    bool
+	mailFrom    string
+	badMailFrom bool
+	rcpts       []string
+}
+
+// NewSession returns a session reading commands from r and writing
+// replies to w (stdin and stdout under tcpserver)
+func NewSession(cfg *Config, r io.Reader, w io.Writer) *Session {
+	return &Session{Config: cfg, conn: smtp.NewServerConn(r, w)}
+}
+
+// deadlineConn ends reads after the session timeout
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c deadlineConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(p)
+}
+
+// TimeoutReader reads R and ends the process when nothing comes for
+// Timeout, as qmail-smtpd does (stdin may not support deadlines)
+type TimeoutReader struct {
+	R       io.Reader
+	Timeout time.Duration
+}
+
+func (t *TimeoutReader) Read(p []byte) (int, error) {
+	timer := time.AfterFunc(t.Timeout, func() {
+		os.Stdout.WriteString("451 timeout (#4.4.2)\r\n")
+		os.Exit(1)
+	})
+	defer timer.Stop()
+	return t.R.Read(p)
+}
+
+// StdioConn is the client connection under tcpserver (stdin and stdout)
+// as a net.Conn, to run TLS on it. Deadlines are ignored : R is usually
+// a TimeoutReader.
+type StdioConn struct {
+	R io.Reader
+	W io.Writer
+}
+
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
+
+func (c *StdioConn) Read(p []byte) (int, error)         { return c.R.Read(p) }
+func (c *StdioConn) Write(p []byte) (int, error)        { return c.W.Write(p) }
+func (c *StdioConn) Close() error                       { return nil }
+func (c *StdioConn) LocalAddr() net.Addr                { return stdioAddr{} }
+func (c *StdioConn) RemoteAddr() net.Addr               { return stdioAddr{} }
+func (c *StdioConn) SetDeadline(t time.Time) error      { return nil }
+func (c *StdioConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *StdioConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// NewConnSession returns a session on a network connection, c is a
+// *tls.Conn for implicit TLS (port 465)
+func NewConnSession(cfg *Config, c net.Conn) *Session {
+	s := &Session{Config: cfg, netConn: c}
+	_, s.tls = c.(*tls.Conn)
+	rw := deadlineConn{c, cfg.Timeout}
+	s.conn = smtp.NewServerConn(rw, rw)
+	return s
+}
+
+// parseAddr parses the argument of MAIL or RCPT, [IP] domains are
+// replaced by control/localiphost
+func (s *Session) parseAddr(arg, keyword string) (string, bool) {
+	addr, _, err := smtp.ParsePath(arg, keyword)
+	if err != nil {
+		s.conn.Reply(555, "syntax error (#5.5.4)")
+		return "", false
+	}
+	if i := strings.LastIndexByte(addr, '@'); i >= 0 && strings.HasPrefix(addr[i+1:], "[") && strings.HasSuffix(addr, "]") {
+		addr = addr[:i+1] + s.LocalIPHost
+	}
+	return addr, true
+}
+
+// isTimeout tells if err is a read timeout of a network session
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// Serve runs the session until QUIT or the connection is lost
+func (s *Session) Serve() error {
+	defer s.conn.Flush()
+	s.conn.Reply(220, s.Greeting+" ESMTP")
+	for {
+		verb, arg, err := s.conn.ReadCommand()
+		if err == smtp.ErrLineTooLong {
+			s.conn.Reply(500, "line too long (#5.5.2)")
+			return err
+		}
+		if isTimeout(err) {
+			s.conn.Reply(451, "timeout (#4.4.2)")
+		}
+		if err != nil {
+			return err
+		}
+		switch verb {
+		case "HELO", "EHLO":
+			s.helo, s.esmtp, s.seenMail = arg, verb == "EHLO", false
+			if s.esmtp {
+				s.conn.Reply(250, s.ehlo())
+			} else {
+				s.conn.Reply(250, s.Me)
+			}
+		case "STARTTLS":
+			if err = s.startTLS(); err != nil {
+				return err
+			}
+		case "AUTH":
+			if err = s.auth(arg); err != nil {
+				return err
+			}
+		case "MAIL":
+			if s.AuthRequired && s.user == "" {
+				s.conn.Reply(530, "authentication required (#5.7.0)")
+				continue
+			}
+			addr, ok := s.parseAddr(arg, "FROM")
+			if !ok {
+				continue
+			}
+			s.mailFrom, s.badMailFrom, s.seenMail, s.rcpts = addr, s.badMail(addr), true, nil
+			s.conn.Reply(250, "ok")
+		case "RCPT":
+			s.rcpt(arg)
+		case "DATA":
+			if err = s.data(); err != nil {
+				if isTimeout(err) {
+					s.conn.Reply(451, "timeout (#4.4.2)")
+				}
+				return err
+			}
+		case "RSET":
+			s.seenMail = false
+			s.conn.Reply(250, "flushed")
+		case "NOOP":
+			s.conn.Reply(250, "ok")
+		case "VRFY":
+			s.conn.Reply(252, "send some mail, i'll try my best")
+		case "HELP":
+			s.conn.Reply(214, "qmail-boosters home page: https://github.com/toorop/qmail-boosters")
+		case "QUIT":
+			s.conn.Reply(221, s.Me)
+			return nil
+		default:
+			s.conn.Reply(502, "unimplemented (#5.5.1)")
+		}
+	}
+}
+
+// ehlo returns the EHLO reply
+func (s *Session) ehlo() string {
+	ext := []string{s.Me, "PIPELINING", "8BITMIME"}
+	if s.TLSConfig != nil && s.netConn != nil && !s.tls {
+		ext = append(ext, "STARTTLS")
+	}
+	if s.Checkpassword != nil && s.tls {
+		ext = append(ext, "AUTH LOGIN PLAIN CRAM-MD5")
+	}
+	return strings.Join(ext, "\n")
+}
+
+// startTLS handles STARTTLS, the session starts again after the handshake
+func (s *Session) startTLS() error {
+	if s.TLSConfig == nil || s.netConn == nil {
+		s.conn.Reply(502, "unimplemented (#5.5.1)")
+		return nil
+	}
+	if s.tls {
+		s.conn.Reply(503, "already in TLS (#5.5.1)")
+		return nil
+	}
+	s.conn.Reply(220, "ready for tls")
+	s.conn.Flush()
+	c := tls.Server(s.netConn, s.TLSConfig)
+	c.SetDeadline(time.Now().Add(s.Timeout))
+	if err := c.Handshake(); err != nil {
+		return err
+	}
+	c.SetDeadline(time.Time{})
+	rw := deadlineConn{c, s.Timeout}
+	s.conn.Reset(rw, rw)
+	s.netConn, s.tls = c, true
+	s.helo, s.esmtp, s.seenMail = "", false, false
+	return nil
+}
+
+func (s *Session) rcpt(arg string) {
+	if !s.seenMail {
+		s.conn.Reply(503, "MAIL first (#5.5.1)")
+		return
+	}
+	addr, ok := s.parseAddr(arg, "TO")
+	if !ok {
+		return
+	}
+	if addr == "" {
+		s.conn.Reply(555, "syntax error (#5.5.4)")
+		return
+	}
+	if s.badMailFrom {
+		s.conn.Reply(553, "sorry, your envelope sender is in my badmailfrom list (#5.7.1)")
+		return
+	}
+	if s.RelayClient != nil {
+		addr += *s.RelayClient
+	} else if s.user == "" && !s.RcptHosts.Allowed(addr) {
+		s.conn.Reply(553, "sorry, that domain isn't in my list of allowed rcpthosts (#5.7.1)")
+		return
+	}
+	s.rcpts = append(s.rcpts, addr)
+	s.conn.Reply(250, "ok")
+}
+
+// safe replaces the characters qmail-smtpd doesn't put in Received
+// header fields by "?"
+func safe(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', strings.ContainsRune(".@%+/=:-", r):
+			return r
+		}
+		return '?'
+	}, s)
+}
+
+// received returns the Received header field of the message. The
+// authenticated user, if any, is named as the remote info.
+func (s *Session) received(now time.Time) string {
+	var b strings.Builder
+	b.WriteString("Received: from " + safe(s.RemoteHost))
+	if !strings.EqualFold(s.helo, s.RemoteHost) {
+		b.WriteString(" (HELO " + safe(s.helo) + ")")
+	}
+	b.WriteString(" (")
+	switch {
+	case s.user != "":
+		b.WriteString(safe(s.user) + "@")
+	case s.RemoteInfo != "":
+		b.WriteString(safe(s.RemoteInfo) + "@")
+	}
+	// RFC 3848
+	protocol := "SMTP"
+	if s.esmtp {
+		protocol = "ESMTP"
+		if s.tls {
+			protocol += "S"
+		}
+		if s.user != "" {
+			protocol += "A"
+		}
+	}
+	fmt.Fprintf(&b, "%s)\n  by %s with %s; %s\n", safe(s.RemoteIP), safe(s.LocalHost), protocol, now.UTC().Format("2 Jan 2006 15:04:05 -0000"))
+	return b.String()
+}
+
+// receivedRe matches the Received field added by Session.received, the
+// HELO is only there if it isn't the remote host name
+var receivedRe = regexp.MustCompile(`^Received: from (\S+) (?:\(HELO ([^)]*)\) )?`)
+
+// ReceivedHelo returns the HELO of the client, read in the Received field
+// added by qmail-smtpd, for qmail-queue wrappers
+func ReceivedHelo(msg io.Reader) string {
+	r := bufio.NewReader(msg)
+	for {
+		l, err := r.ReadString('\n')
+		if m := receivedRe.FindStringSubmatch(l); m != nil {
+			if m[2] != "" {
+				return m[2]
+			}
+			return m[1]
+		}
+		if err != nil || l == "\n" {
+			return ""
+		}
+	}
+}
+
+// hasPrefixFold tells if b begins with prefix, ignoring case
+func hasPrefixFold(b []byte, prefix string) bool {
+	return len(b) >= len(prefix) && strings.EqualFold(string(b[:len(prefix)]), prefix)
+}
+
+// blast copies the message to w, counting its size and its hops (Received
+// and Delivered-To header fields). It stops writing when the message is
+// too big or looping but reads it up to the final dot.
+func (s *Session) blast(w io.Writer) (size int64, hops int, err error) {
+	br := bufio.NewReader(s.conn.DataReader())
+	inHeader, bol := true, true
+	for {
+		chunk, err := br.ReadSlice('\n')
+		if len(chunk) > 0 {
+			if inHeader && bol {
+				if chunk[0] == '\n' {
+					inHeader = false
+				} else if hasPrefixFold(chunk, "received:") || hasPrefixFold(chunk, "delivered-to:") {
+					hops++
+				}
+			}
+			size += int64(len(chunk))
+			if (s.Databytes == 0 || size <= s.Databytes) && hops < maxHops {
+				w.Write(chunk)
+			}
+			bol = chunk[len(chunk)-1] == '\n'
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+		case io.EOF:
+			return size, hops, nil
+		default:
+			return size, hops, err
+		}
+	}
+}
+
+// data receives the message and queues it. A non nil error ends the
+// session.
+func (s *Session) data() error {
+	if !s.seenMail {
+		s.conn.Reply(503, "MAIL first (#5.5.1)")
+		return nil
+	}
+	if len(s.rcpts) == 0 {
+		s.conn.Reply(503, "RCPT first (#5.5.1)")
+		return nil
+	}
+	s.seenMail = false
+	id, err := uuid.New()
+	if err != nil {
+		s.conn.Reply(451, "qqt failure (#4.3.0)")
+		return nil
+	}
+	q, err := qmailqueue.OpenUUID(id)
+	if err != nil {
+		s.conn.Reply(451, "qqt failure (#4.3.0)")
+		return nil
+	}
+	s.conn.Reply(354, "go ahead")
+	now := time.Now()
+	fmt.Fprintf(q, "X-QB-UUID: %s\n", id)
+	io.WriteString(q, s.received(now))
+	size, hops, err := s.blast(q)
+	if err != nil {
+		q.Abort()
+		if err == smtp.ErrBareLF {
+			s.conn.Reply(451, "See http://pobox.com/~djb/docs/smtplf.html.")
+		}
+		return err
+	}
+	if hops >= maxHops {
+		q.Abort()
+		s.conn.Reply(554, "too many hops, this message is looping (#5.4.6)")
+		return nil
+	}
+	if s.Databytes > 0 && size > s.Databytes {
+		q.Abort()
+		s.conn.Reply(552, "sorry, that message size exceeds my databytes limit (#5.3.4)")
+		return nil
+	}
+	if err = q.Close(s.mailFrom, s.rcpts); err != nil {
+		code := 451
+		if e, ok := err.(*qmailqueue.Error); ok && e.Permanent {
+			code = 554
+		}
+		s.conn.Reply(code, err.Error())
+		return nil
+	}
+	if s.Log != nil {
+		user := ""
+		if s.user != "" {
+			user = " user " + s.user
+		}
+		s.Log.Printf("%s accepted message qp %d from %s%s <%s> to %d recipient(s)", id, q.Pid(), s.RemoteIP, user, s.mailFrom, len(s.rcpts))
+	}
+	s.conn.Reply(250, fmt.Sprintf("ok %d qp %d", now.Unix(), q.Pid()))
+	return nil
+}
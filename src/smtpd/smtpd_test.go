@@ -0,0 +1,247 @@
+package smtpd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/rcpthosts"
+	"github.com/toorop/qmail-boosters/src/smtp"
+	"github.com/toorop/qmail-boosters/src/smtp/smtptest"
+)
+
+// TestMain runs the test binary as a checkpassword program accepting
+// alice/secret when SMTPD_TEST_CHECKPASSWORD is set
+func TestMain(m *testing.M) {
+	if os.Getenv("SMTPD_TEST_CHECKPASSWORD") == "1" {
+		b, _ := ioutil.ReadAll(os.NewFile(3, "fd3"))
+		t := strings.Split(string(b), "\x00")
+		if len(t) < 3 || t[0] != "alice" {
+			os.Exit(1)
+		}
+		d := hmac.New(md5.New, []byte("secret"))
+		d.Write([]byte(t[2]))
+		if t[1] != "secret" && t[1] != fmt.Sprintf("%x", d.Sum(nil)) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// fakeQueue installs a qmail-queue which saves the message and the
+// envelope in dir and exits with the code in dir/exit
+func fakeQueue(t *testing.T) (dir string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "smtpd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(dir, "qmail-queue")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\ncat > "+dir+"/msg\ncat <&1 > "+dir+"/env\nexit `cat "+dir+"/exit`\n"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "exit"), []byte("0\n"), 0644)
+	old := os.Getenv("QMAILQUEUE")
+	os.Setenv("QMAILQUEUE", script)
+	return dir, func() {
+		os.Setenv("QMAILQUEUE", old)
+		os.RemoveAll(dir)
+	}
+}
+
+func newConfig() *Config {
+	return &Config{
+		Me:          "mx.example.com",
+		Greeting:    "mx.example.com",
+		LocalIPHost: "mx.example.com",
+		RcptHosts:   rcpthosts.New([]string{"example.com", ".example.net", "mx.example.com"}, nil),
+		BadMailFrom: []string{"spam@bad.example", "@worse.example"},
+		LocalHost:   "mx.example.com",
+		RemoteIP:    "192.0.2.1",
+		RemoteHost:  "client.example.org",
+		Timeout:     10 * time.Second,
+	}
+}
+
+// run runs a session on the commands in client and returns the replies,
+// with the time and qp of accepted messages replaced by "T" and "P"
+func run(cfg *Config, client string) string {
+	var out bytes.Buffer
+	NewSession(cfg, strings.NewReader(client), &out).Serve()
+	return regexp.MustCompile(`ok \d+ qp \d+`).ReplaceAllString(out.String(), "ok T qp P")
+}
+
+func TestSession(t *testing.T) {
+	dir, cleanup := fakeQueue(t)
+	defer cleanup()
+
+	client := "EHLO client.example.org\r\nMAIL FROM:<a@example.org>\r\nRCPT TO:<b@example.com>\r\nRCPT TO:<c@sub.example.net>\r\nRCPT TO:<d@[192.0.2.25]>\r\nRCPT TO:<e@elsewhere.example>\r\nDATA\r\nSubject: test\r\n\r\n..dot\r\n.\r\nQUIT\r\n"
+	want := "220 mx.example.com ESMTP\r\n250-mx.example.com\r\n250-PIPELINING\r\n250 8BITMIME\r\n250 ok\r\n250 ok\r\n250 ok\r\n250 ok\r\n553 sorry, that domain isn't in my list of allowed rcpthosts (#5.7.1)\r\n354 go ahead\r\n250 ok T qp P\r\n221 mx.example.com\r\n"
+	if got := run(newConfig(), client); got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+	msg, _ := ioutil.ReadFile(filepath.Join(dir, "msg"))
+	if !regexp.MustCompile("^X-QB-UUID: [0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}\nReceived: from client.example.org \\(192.0.2.1\\)\n  by mx.example.com with ESMTP; [^\n]+ -0000\nSubject: test\n\n.dot\n$").Match(msg) {
+		t.Errorf("got message %q", msg)
+	}
+	env, _ := ioutil.ReadFile(filepath.Join(dir, "env"))
+	if string(env) != "Fa@example.org\x00Tb@example.com\x00Tc@sub.example.net\x00Td@mx.example.com\x00\x00" {
+		t.Errorf("got envelope %q", env)
+	}
+}
+
+func TestReceivedHelo(t *testing.T) {
+	for msg, want := range map[string]string{
+		"X-QB-UUID: x\nReceived: from unknown (HELO client.example.org) (192.0.2.1)\n  by mx.example.com with SMTP; date\n\nbody\n": "client.example.org",
+		"Received: from client.example.org (192.0.2.1)\n  by mx.example.com with ESMTP; date\n\nbody\n":                             "client.example.org",
+		"Subject: test\n\nReceived: from body.example (192.0.2.1)\n":                                                                "",
+	} {
+		if got := ReceivedHelo(strings.NewReader(msg)); got != want {
+			t.Errorf("ReceivedHelo(%q): got %q, want %q", msg, got, want)
+		}
+	}
+}
+
+func TestSessionErrors(t *testing.T) {
+	dir, cleanup := fakeQueue(t)
+	defer cleanup()
+
+	cfg := newConfig()
+	for _, tc := range []struct {
+		name   string
+		exit   string
+		client string
+		want   string
+	}{
+		{"sequence", "0", "RCPT TO:<b@example.com>\r\nDATA\r\nMAIL FROM:<a@example.org>\r\nDATA\r\nFOO\r\n", "503 MAIL first (#5.5.1)\r\n503 MAIL first (#5.5.1)\r\n250 ok\r\n503 RCPT first (#5.5.1)\r\n502 unimplemented (#5.5.1)\r\n"},
+		{"syntax", "0", "MAIL <a@example.org>\r\nMAIL FROM:<a@example.org\r\n", "555 syntax error (#5.5.4)\r\n555 syntax error (#5.5.4)\r\n"},
+		{"badmailfrom", "0", "MAIL FROM:<x@Worse.example>\r\nRCPT TO:<b@example.com>\r\n", "250 ok\r\n553 sorry, your envelope sender is in my badmailfrom list (#5.7.1)\r\n"},
+		{"qq permanent", "31", "MAIL FROM:<>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\r\n.\r\n", "250 ok\r\n250 ok\r\n354 go ahead\r\n554 mail server permanently rejected message (#5.3.0)\r\n"},
+		{"qq temporary", "53", "MAIL FROM:<>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\r\n.\r\n", "250 ok\r\n250 ok\r\n354 go ahead\r\n451 qq write error or disk full (#4.3.0)\r\n"},
+		{"bare LF", "0", "MAIL FROM:<>\r\nRCPT TO:<b@example.com>\r\nDATA\r\nhello\n.\r\n", "250 ok\r\n250 ok\r\n354 go ahead\r\n451 See http://pobox.com/~djb/docs/smtplf.html.\r\n"},
+		{"loop", "0", "MAIL FROM:<>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n" + strings.Repeat("Received: x\r\n", 100) + "\r\nhello\r\n.\r\n", "250 ok\r\n250 ok\r\n354 go ahead\r\n554 too many hops, this message is looping (#5.4.6)\r\n"},
+	} {
+		ioutil.WriteFile(filepath.Join(dir, "exit"), []byte(tc.exit), 0644)
+		if got := run(cfg, tc.client); got != "220 mx.example.com ESMTP\r\n"+tc.want {
+			t.Errorf("%s: got\n%q\nwant\n%q", tc.name, got, tc.want)
+		}
+	}
+
+	// databytes, the whole message is read
+	cfg.Databytes = 10
+	ioutil.WriteFile(filepath.Join(dir, "exit"), []byte("0"), 0644)
+	got := run(cfg, "MAIL FROM:<>\r\nRCPT TO:<b@example.com>\r\nDATA\r\n0123456789\r\n.\r\nNOOP\r\n")
+	if want := "220 mx.example.com ESMTP\r\n250 ok\r\n250 ok\r\n354 go ahead\r\n552 sorry, that message size exceeds my databytes limit (#5.3.4)\r\n250 ok\r\n"; got != want {
+		t.Errorf("databytes: got\n%q\nwant\n%q", got, want)
+	}
+
+	// RELAYCLIENT
+	relay := ""
+	cfg.Databytes, cfg.RelayClient = 0, &relay
+	got = run(cfg, "HELO client\r\nMAIL FROM:<a@example.org>\r\nRCPT TO:<e@elsewhere.example>\r\nDATA\r\nhello\r\n.\r\n")
+	if want := "220 mx.example.com ESMTP\r\n250 mx.example.com\r\n250 ok\r\n250 ok\r\n354 go ahead\r\n250 ok T qp P\r\n"; got != want {
+		t.Errorf("relayclient: got\n%q\nwant\n%q", got, want)
+	}
+	msg, _ := ioutil.ReadFile(filepath.Join(dir, "msg"))
+	if !strings.Contains(string(msg), "\nReceived: from client.example.org (HELO client) (192.0.2.1)\n  by mx.example.com with SMTP; ") {
+		t.Errorf("got message %q", msg)
+	}
+}
+
+// dial runs a network session with cfg and returns a client connected to
+// it
+func dial(t *testing.T, cfg *Config) *smtp.Client {
+	server, client := net.Pipe()
+	go func() {
+		NewConnSession(cfg, server).Serve()
+		server.Close()
+	}()
+	c, err := smtp.NewClient(client, "mx.example.com", "laptop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestSubmission(t *testing.T) {
+	dir, cleanup := fakeQueue(t)
+	defer cleanup()
+	os.Setenv("SMTPD_TEST_CHECKPASSWORD", "1")
+	defer os.Unsetenv("SMTPD_TEST_CHECKPASSWORD")
+	defer func(d time.Duration) { authDelay = d }(authDelay)
+	authDelay = time.Millisecond
+
+	cert, err := smtptest.GenerateCert("mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := newConfig()
+	cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	cfg.Checkpassword = []string{os.Args[0], "true"}
+	cfg.AuthRequired = true
+
+	// no AUTH without TLS
+	want := "220 mx.example.com ESMTP\r\n250-mx.example.com\r\n250-PIPELINING\r\n250 8BITMIME\r\n538 encryption required for requested authentication mechanism (#5.7.11)\r\n530 authentication required (#5.7.0)\r\n"
+	if got := run(cfg, "EHLO laptop\r\nAUTH PLAIN AGFsaWNlAHNlY3JldA==\r\nMAIL FROM:<alice@example.org>\r\n"); got != want {
+		t.Errorf("got\n%q\nwant\n%q", got, want)
+	}
+
+	c := dial(t, cfg)
+	if ok, _ := c.Extension("AUTH"); ok {
+		t.Error("AUTH offered before STARTTLS")
+	}
+	if err = c.StartTLS(&tls.Config{InsecureSkipVerify: true}); err != nil {
+		t.Fatal(err)
+	}
+	if ok, mechs := c.Extension("AUTH"); !ok || mechs != "LOGIN PLAIN CRAM-MD5" {
+		t.Errorf("got AUTH %q", mechs)
+	}
+	if _, err = c.Mail("alice@example.org"); err == nil || !strings.Contains(err.Error(), "530") {
+		t.Errorf("MAIL before AUTH: got %v", err)
+	}
+	if err = c.Auth(smtp.CRAMMD5Auth("alice", "secret")); err != nil {
+		t.Fatal(err)
+	}
+	c.Mail("alice@example.org")
+	// relaying is allowed
+	if _, err = c.Rcpt("bob@elsewhere.example"); err != nil {
+		t.Fatal(err)
+	}
+	w, _ := c.Data()
+	w.Write([]byte("Subject: hello\r\n\r\nhi\r\n"))
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+	msg, _ := ioutil.ReadFile(filepath.Join(dir, "msg"))
+	if !regexp.MustCompile("^X-QB-UUID: [-0-9a-f]{36}\nReceived: from client.example.org \\(HELO laptop\\) \\(alice@192.0.2.1\\)\n  by mx.example.com with ESMTPSA; ").Match(msg) {
+		t.Errorf("got message %q", msg)
+	}
+
+	// bad password
+	c = dial(t, cfg)
+	c.StartTLS(&tls.Config{InsecureSkipVerify: true})
+	if err = c.Auth(smtp.PlainAuth("", "alice", "wrong", "mx.example.com")); err == nil || !strings.Contains(err.Error(), "535") {
+		t.Errorf("bad password: got %v", err)
+	}
+
+	// the session ends after maxAuthFailures
+	var out bytes.Buffer
+	bad := "AUTH PLAIN AGFsaWNlAHdyb25n\r\n"
+	s := NewSession(cfg, strings.NewReader("EHLO laptop\r\n"+strings.Repeat(bad, maxAuthFailures+1)), &out)
+	s.tls = true
+	if err = s.Serve(); err != errAuthFailures {
+		t.Errorf("got %v", err)
+	}
+	if got := out.String(); strings.Count(got, "535 ") != maxAuthFailures-1 || !strings.HasSuffix(got, "421 too many authentication failures (#4.7.0)\r\n") {
+		t.Errorf("got %q", got)
+	}
+}
@@ -0,0 +1,205 @@
+/*
+
+   Copyright 2014 Stéphane Depierrepont
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+*/
+
+// Package srs implements the Sender Rewriting Scheme, as libsrs2 does :
+//
+//	user@example.com -> SRS0=HHHH=TT=example.com=user@forwarder.example
+//	SRS0=HHHH=TT=example.com=user@hop1.example -> SRS1=HHHH=hop1.example==HHHH=TT=example.com=user@forwarder.example
+//
+// HHHH is a truncated HMAC-SHA1 of the address, TT a timestamp (days,
+// base32) : forged or expired addresses are refused when reversed.
+//
+// Secrets are read from control/srssecrets (one per line, the first one
+// signs, all of them are accepted for reversing to allow rotation), the
+// max age in days from control/srsmaxage (21 by default).
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/toorop/qmail-boosters/src/control"
+)
+
+const (
+	base32    = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	hashLen   = 4
+	precision = 24 * 60 * 60 // timestamp unit, in seconds
+	slots     = 1024         // timestamps wrap
+)
+
+// Errors returned by Reverse
+var (
+	ErrNotSRS  = errors.New("not a SRS address")
+	ErrBadHash = errors.New("bad SRS hash")
+	ErrExpired = errors.New("SRS address expired")
+)
+
+// SRS rewrites addresses for Domain
+type SRS struct {
+	Secrets []string // the first one signs
+	Domain  string   // domain of rewritten addresses
+	MaxAge  int      // in days
+	now     func() time.Time
+}
+
+// Load returns a SRS for domain configured by control files
+func Load(domain string) (*SRS, error) {
+	secrets, err := control.ReadLines("control/srssecrets")
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("no secret in control/srssecrets")
+	}
+	s := &SRS{Secrets: secrets, Domain: domain, MaxAge: 21}
+	if t, err := control.ReadLines("control/srsmaxage"); err == nil && len(t) > 0 {
+		if s.MaxAge, err = strconv.Atoi(t[0]); err != nil || s.MaxAge < 1 {
+			return nil, errors.New("bad format for control/srsmaxage")
+		}
+	}
+	return s, nil
+}
+
+func (s *SRS) time() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// hash returns the truncated HMAC of data with secret
+func hash(secret string, data ...string) string {
+	h := hmac.New(sha1.New, []byte(secret))
+	for _, d := range data {
+		h.Write([]byte(strings.ToLower(d)))
+	}
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))[:hashLen]
+}
+
+// checkHash tells if h is the hash of data with one of the secrets
+func (s *SRS) checkHash(h string, data ...string) bool {
+	for _, secret := range s.Secrets {
+		if strings.EqualFold(h, hash(secret, data...)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *SRS) timestamp() string {
+	t := s.time().Unix() / precision % slots
+	return string([]byte{base32[t>>5&31], base32[t&31]})
+}
+
+// checkTimestamp tells if ts is not older than MaxAge
+func (s *SRS) checkTimestamp(ts string) bool {
+	if len(ts) != 2 {
+		return false
+	}
+	var t int64
+	for _, c := range strings.ToUpper(ts) {
+		i := strings.IndexRune(base32, c)
+		if i < 0 {
+			return false
+		}
+		t = t<<5 | int64(i)
+	}
+	now := s.time().Unix() / precision % slots
+	age := (now - t + slots) % slots
+	return age <= int64(s.MaxAge)
+}
+
+// split splits an address in local part and domain
+func split(address string) (local, domain string, err error) {
+	i := strings.LastIndexByte(address, '@')
+	if i < 1 || i == len(address)-1 {
+		return "", "", ErrNotSRS
+	}
+	return address[:i], address[i+1:], nil
+}
+
+// hasPrefix tells if local begins with prefix (SRS0, SRS1) followed by a
+// separator
+func hasPrefix(local, prefix string) bool {
+	return len(local) > len(prefix) && strings.EqualFold(local[:len(prefix)], prefix) && strings.ContainsRune("=+-", rune(local[len(prefix)]))
+}
+
+// Forward returns the rewritten address of sender
+func (s *SRS) Forward(sender string) (string, error) {
+	local, domain, err := split(sender)
+	if err != nil {
+		return "", errors.New("bad sender address")
+	}
+	if strings.EqualFold(domain, s.Domain) {
+		return sender, nil
+	}
+	secret := s.Secrets[0]
+	switch {
+	case hasPrefix(local, "SRS1"):
+		// SRS1=HHHH=hop1==... : only the hash changes
+		t := strings.SplitN(local[5:], "=", 3)
+		if len(t) != 3 || !strings.HasPrefix(t[2], "=") {
+			break
+		}
+		return "SRS1=" + hash(secret, t[1], t[2]) + "=" + t[1] + "=" + t[2] + "@" + s.Domain, nil
+	case hasPrefix(local, "SRS0"):
+		rest := "=" + local[5:]
+		return "SRS1=" + hash(secret, domain, rest) + "=" + domain + "=" + rest + "@" + s.Domain, nil
+	}
+	ts := s.timestamp()
+	return "SRS0=" + hash(secret, ts, domain, local) + "=" + ts + "=" + domain + "=" + local + "@" + s.Domain, nil
+}
+
+// Reverse returns the address a SRS address stands for : the original
+// sender for SRS0, the SRS0 address of the first forwarder for SRS1
+func (s *SRS) Reverse(address string) (string, error) {
+	local, _, err := split(address)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case hasPrefix(local, "SRS0"):
+		t := strings.SplitN(local[5:], "=", 4)
+		if len(t) != 4 || t[3] == "" {
+			return "", ErrNotSRS
+		}
+		if !s.checkHash(t[0], t[1], t[2], t[3]) {
+			return "", ErrBadHash
+		}
+		if !s.checkTimestamp(t[1]) {
+			return "", ErrExpired
+		}
+		return t[3] + "@" + t[2], nil
+	case hasPrefix(local, "SRS1"):
+		t := strings.SplitN(local[5:], "=", 3)
+		if len(t) != 3 || !strings.HasPrefix(t[2], "=") {
+			return "", ErrNotSRS
+		}
+		if !s.checkHash(t[0], t[1], t[2]) {
+			return "", ErrBadHash
+		}
+		return "SRS0" + t[2] + "@" + t[1], nil
+	}
+	return "", ErrNotSRS
+}
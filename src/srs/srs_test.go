@@ -0,0 +1,69 @@
+package srs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardReverse(t *testing.T) {
+	now := time.Date(2014, 6, 1, 12, 0, 0, 0, time.UTC)
+	s := &SRS{Secrets: []string{"secret"}, Domain: "srs.example", MaxAge: 21, now: func() time.Time { return now }}
+
+	srs0, err := s.Forward("user@example.com")
+	if err != nil || !strings.HasPrefix(srs0, "SRS0=") || !strings.HasSuffix(srs0, "=example.com=user@srs.example") {
+		t.Fatalf("Forward: got %q, %v", srs0, err)
+	}
+	if orig, err := s.Reverse(srs0); err != nil || orig != "user@example.com" {
+		t.Errorf("Reverse(%q): got %q, %v", srs0, orig, err)
+	}
+	// case is not significant
+	if orig, err := s.Reverse(strings.ToLower(srs0)); err != nil || orig != "user@example.com" {
+		t.Errorf("Reverse(lower): got %q, %v", orig, err)
+	}
+	if got, _ := s.Forward("user@srs.example"); got != "user@srs.example" {
+		t.Errorf("local sender rewritten to %q", got)
+	}
+
+	// second forwarder
+	hop := &SRS{Secrets: []string{"other"}, Domain: "hop2.example", MaxAge: 21, now: s.now}
+	srs1, err := hop.Forward(srs0)
+	if err != nil || !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=srs.example==") {
+		t.Fatalf("Forward(SRS0): got %q, %v", srs1, err)
+	}
+	if back, err := hop.Reverse(srs1); err != nil || back != srs0 {
+		t.Errorf("Reverse(%q): got %q, %v, want %q", srs1, back, err, srs0)
+	}
+	// third forwarder keeps the first hop
+	third := &SRS{Secrets: []string{"third"}, Domain: "hop3.example", MaxAge: 21, now: s.now}
+	again, err := third.Forward(srs1)
+	if err != nil || !strings.Contains(again, "=srs.example==") {
+		t.Fatalf("Forward(SRS1): got %q, %v", again, err)
+	}
+	if back, err := third.Reverse(again); err != nil || back != srs0 {
+		t.Errorf("Reverse(%q): got %q, %v, want %q", again, back, err, srs0)
+	}
+
+	// forged
+	if _, err := hop.Reverse(srs0); err != ErrBadHash {
+		t.Errorf("wrong secret: got %v", err)
+	}
+	if _, err := s.Reverse("SRS0=AAAA" + srs0[9:]); err != ErrBadHash {
+		t.Errorf("bad hash: got %v", err)
+	}
+	if _, err := s.Reverse("user@example.com"); err != ErrNotSRS {
+		t.Errorf("not SRS: got %v", err)
+	}
+
+	// rotated secret
+	rotated := &SRS{Secrets: []string{"new", "secret"}, MaxAge: 21, now: s.now}
+	if _, err := rotated.Reverse(srs0); err != nil {
+		t.Errorf("old secret refused: %v", err)
+	}
+
+	// expired
+	now = now.Add(22 * 24 * time.Hour)
+	if _, err := s.Reverse(srs0); err != ErrExpired {
+		t.Errorf("expired: got %v", err)
+	}
+}